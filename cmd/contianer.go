@@ -10,8 +10,8 @@ import (
 
 var runContainerCMD = &cobra.Command{
 	Use:  "run [command]",
-	Long: `Create a container with namespace and cgroups limit: myDocker run -t [command]`,
-	Args: cobra.ExactArgs(1),
+	Long: `Create a container with namespace and cgroups limit: myDocker run -t [command], the image's default command is used when command is omitted`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if tty && Detach {
 			// 两个标志不运行同时设置
@@ -22,7 +22,11 @@ var runContainerCMD = &cobra.Command{
 		id := container.RandStringContainerID(10)
 		log.Log.Infof("Container ID [%s]", id)
 		// 获取交互flag值与command, 启动容器
-		container.Run(tty, strings.Split(args[0], " "), ResourceLimitCfg, CgroupName, Volume, Name, ImageTarPath, id, EnvSlice, Port, NetWorkName)
+		var cmdArray []string
+		if len(args) == 1 {
+			cmdArray = strings.Split(args[0], " ")
+		}
+		container.Run(tty, cmdArray, ResourceLimitCfg, CgroupName, Volume, Name, ImageRef, id, EnvSlice, NetworkCfg)
 		return nil
 	},
 }
@@ -64,3 +68,33 @@ var removeContainerCMD = &cobra.Command{
 		container.RemoveContainer(args[0])
 	},
 }
+
+var inspectContainerCMD = &cobra.Command{
+	Use:   "inspect [container_id]",
+	Short: "display detailed information of a container",
+	Long:  "display detailed information of a container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return container.InspectContainer(args[0])
+	},
+}
+
+var copyCMD = &cobra.Command{
+	Use:   "cp [container:]src_path [container:]dest_path",
+	Short: "copy files between a container and the host",
+	Long:  "copy files or directories between a container and the host, - reads a tar archive from stdin or writes a tar archive to stdout, e.g. cp abc:/etc/hosts ./hosts",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return container.CopyFiles(args[0], args[1])
+	},
+}
+
+var diffContainerCMD = &cobra.Command{
+	Use:   "diff [container_id]",
+	Short: "list changes in the filesystem of a container",
+	Long:  "list files added (A), changed (C) and deleted (D) in the write layer of a container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return container.DiffContainer(args[0], jsonOutput)
+	},
+}
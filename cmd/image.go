@@ -1,16 +1,263 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"xwj/mydocker/container"
+	"xwj/mydocker/image"
 )
 
 var commitContainerCMD = &cobra.Command{
-	Use:   "commit [container_id] [image_tar_name]",
+	Use:   "commit [container_id] [name:tag]",
 	Short: "commit a container into image",
-	Long:  "commit a container into image",
+	Long:  "commit the write layer of a container as a new layer on top of its image, e.g. commit --change 'ENV FOO=bar' [container_id] [name:tag]",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref := ""
+		if len(args) == 2 {
+			ref = args[1]
+		}
+		img, err := container.CommitContainer(args[0], ref, commitOpts)
+		if err != nil {
+			return err
+		}
+		fmt.Println(img.ID)
+		return nil
+	},
+}
+
+var imageSubCMD = &cobra.Command{
+	Use:   "image",
+	Short: "manage images",
+	Long:  "manage images in the local content-addressed image store",
+}
+
+var imageLoadCMD = &cobra.Command{
+	Use:   "load [tar_file]",
+	Short: "load an image from a tar archive",
+	Long:  "load a docker save archive, an OCI image layout or a root filesystem tar archive into the image store, root filesystem archives default the name to the file name before the first dot",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		images, err := image.Load(args[0], imageTag)
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			fmt.Printf("Loaded image: %s (%s)\n", strings.Join(img.RepoTags, ", "), image.ShortID(img.ID))
+		}
+		return nil
+	},
+}
+
+var imageListCMD = &cobra.Command{
+	Use:   "ls",
+	Short: "list images",
+	Long:  "list images in the local image store",
+	Args:  cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		images, err := image.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
+		for _, img := range images {
+			created := ""
+			if img.Config.Created != nil {
+				created = img.Config.Created.Local().Format("2006-01-02 15:04:05")
+			}
+			size := image.HumanSize(img.Size())
+			tags := img.RepoTags
+			// 没有name:tag的镜像
+			if len(tags) == 0 {
+				tags = []string{"<none>:<none>"}
+			}
+			for _, ref := range tags {
+				name, tag := image.SplitReference(ref)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, tag, image.ShortID(img.ID), created, size)
+			}
+		}
+		return w.Flush()
+	},
+}
+
+var imageRemoveCMD = &cobra.Command{
+	Use:   "rm [image]...",
+	Short: "remove images",
+	Long:  "remove images, refuse to remove images used by containers unless --force",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inUse := container.ImagesInUse()
+		for _, ref := range args {
+			removed, err := image.Remove(ref, forceRemove, inUse)
+			if err != nil {
+				return err
+			}
+			for _, line := range removed {
+				fmt.Println(line)
+			}
+		}
+		return nil
+	},
+}
+
+var imagePruneCMD = &cobra.Command{
+	Use:   "prune",
+	Short: "remove unused images",
+	Long:  "remove images without a name:tag and layers no longer referenced by any image or container, --all removes all images not used by containers",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return container.PruneImages(pruneAll)
+	},
+}
+
+var imageTagCMD = &cobra.Command{
+	Use:   "tag [source_image] [target_image]",
+	Short: "create a tag that refers to an image",
+	Long:  "create a name:tag that refers to an image",
 	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		container.CommitContainer(args[0], args[1])
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return image.Tag(args[0], args[1])
+	},
+}
+
+var imageInspectCMD = &cobra.Command{
+	Use:   "inspect [image]",
+	Short: "display detailed information of an image",
+	Long:  "display config, layers and history of an image as json",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		img, err := image.Get(args[0])
+		if err != nil {
+			return err
+		}
+		jsonBytes, err := json.MarshalIndent(img.Inspect(), "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonBytes))
+		return nil
 	},
 }
+
+var buildCMD = &cobra.Command{
+	Use:   "build [context]",
+	Short: "build an image from a Dockerfile",
+	Long:  "build an image from a Dockerfile with FROM, RUN, COPY, ADD, ENV, WORKDIR, USER, CMD, ENTRYPOINT, EXPOSE and LABEL, each step is cached by its parent image and instruction",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		img, err := container.Build(dockerfile, args[0], imageTag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Successfully built %s\n", image.ShortID(img.ID))
+		if imageTag != "" {
+			fmt.Printf("Successfully tagged %s\n", imageTag)
+		}
+		return nil
+	},
+}
+
+var imagePullCMD = &cobra.Command{
+	Use:   "pull [name:tag]",
+	Short: "pull an image from a registry",
+	Long:  "pull an image from a registry v2 endpoint into the local image store, names without a registry host are pulled from Docker Hub",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		img, err := image.Pull(args[0], registryOpts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pulled image: %s (%s)\n", strings.Join(img.RepoTags, ", "), image.ShortID(img.ID))
+		return nil
+	},
+}
+
+var imagePushCMD = &cobra.Command{
+	Use:   "push [name:tag]",
+	Short: "push an image to a registry",
+	Long:  "push an image to the registry v2 endpoint in its name, e.g. image push localhost:5000/busybox:latest",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return image.Push(args[0], registryOpts)
+	},
+}
+
+var imageSaveCMD = &cobra.Command{
+	Use:     "save [name:tag...]",
+	Aliases: []string{"export"},
+	Short:   "save images to a tar archive",
+	Long:    "save one or more images to a tar archive in docker-archive or OCI image layout format, written to stdout when -o is not set",
+	Args:    cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeOutput(archiveOutput, func(w io.Writer) error {
+			return image.Save(w, args, saveFormat)
+		})
+	},
+}
+
+var exportContainerCMD = &cobra.Command{
+	Use:   "export [container_id]",
+	Short: "export the filesystem of a container",
+	Long:  "export the merged root filesystem of a container as an uncompressed tar archive, written to stdout when -o is not set",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeOutput(archiveOutput, func(w io.Writer) error {
+			return container.ExportContainer(args[0], w)
+		})
+	},
+}
+
+var importImageCMD = &cobra.Command{
+	Use:   "import [tar_file|-] [name:tag]",
+	Short: "import a filesystem tar archive as an image",
+	Long:  "create a single layer image from a flat root filesystem tar archive, - reads the archive from stdin, e.g. import --change 'CMD [\"sh\"]' fs.tar name:tag",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref := ""
+		if len(args) == 2 {
+			ref = args[1]
+		}
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		img, err := image.Import(r, ref, importChanges)
+		if err != nil {
+			return err
+		}
+		fmt.Println(img.ID)
+		return nil
+	},
+}
+
+// writeOutput 将输出写入文件，路径为空或者-时写到标准输出
+// 先写入临时文件再重命名，失败时不留下不完整的文件
+func writeOutput(path string, write func(w io.Writer) error) error {
+	if path == "" || path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -1,6 +1,12 @@
 package cmd
 
-import "xwj/mydocker/cgroups/subsystems"
+import (
+	"github.com/spf13/cobra"
+	"xwj/mydocker/cgroups/subsystems"
+	"xwj/mydocker/image"
+	"xwj/mydocker/network"
+	"xwj/mydocker/record"
+)
 
 var (
 	tty              bool                           // 是否交互式执行
@@ -9,20 +15,49 @@ var (
 	Volume           string                         // 数据卷
 	Detach           bool                           // 后台运行
 	Name             string                         // 容器名称
-	ImageTarPath     string                         // 镜像的tar包路径
+	ImageRef         string                         // 镜像引用，兼容镜像的tar包路径
 	EnvSlice         []string                       // 环境变量
-	NetWorkName      string                         // 网络名
-	Port             []string                       // 端口映射
+	NetworkCfg       = &record.NetworkConfig{}      // 网络配置
+	jsonOutput       bool                           // 以json格式输出
+
+	driver      string                  // 网络驱动名称
+	ipamCfg     = &network.IPAMConfig{} // 网络的地址分配配置
+	auxAddress  []string                // 保留的辅助地址，host=ip
+	parent      string                  // macvlan/ipvlan的父接口
+	networkOpts []string                // 网络驱动选项
+	cniConfig   string                  // CNI网络的conflist配置文件
+	ipv6        bool                    // 是否开启IPv6
+	icc         bool                    // 网络中的容器之间是否可以互相通信
+	internal    bool                    // 是否为不能访问外部网络的内部网络
+	mtu         int                     // 网络设备的MTU
 
-	driver string // 网络驱动名称
-	subnet string // 子网网段
+	imageTag      string                     // 镜像的name:tag
+	forceRemove   bool                       // 强制删除
+	pruneAll      bool                       // 清理所有没有被容器使用的镜像
+	verbose       bool                       // 输出详细信息
+	commitOpts    = &image.CommitOptions{}   // 提交镜像的说明、作者与配置修改
+	dockerfile    string                     // 构建使用的Dockerfile
+	registryOpts  = &image.RegistryOptions{} // 访问registry的认证与上传选项
+	archiveOutput string                     // 镜像包或者容器文件系统tar包的输出路径
+	saveFormat    string                     // 镜像包的格式
+	importChanges []string                   // 导入镜像时对镜像配置的修改
+
+	proxyProto         string // 代理的协议
+	proxyHostIP        string // 代理监听的宿主机地址
+	proxyHostPort      int    // 代理监听的宿主机端口
+	proxyContainerIP   string // 转发的容器地址
+	proxyContainerPort int    // 转发的容器端口
 )
 
 func init() {
 	rootCMD.AddCommand(initContainerCMD, runContainerCMD, commitContainerCMD,
 		listContainersCMD, logContainersCMD, execContainerCMD, stopContainerCMD,
-		removeContainerCMD, networkSubCMD)
-	networkSubCMD.AddCommand(networkCreateCMD, networkListCMD, networkRemoveCMD)
+		removeContainerCMD, inspectContainerCMD, diffContainerCMD, copyCMD, buildCMD, exportContainerCMD, importImageCMD, networkSubCMD, imageSubCMD, systemSubCMD, proxyCMD)
+	networkSubCMD.AddCommand(networkCreateCMD, networkListCMD, networkRemoveCMD, networkReconcileCMD, networkPeerCMD)
+	networkPeerCMD.AddCommand(networkPeerAddCMD, networkPeerRemoveCMD, networkPeerReloadCMD, networkPeerListCMD)
+	imageSubCMD.AddCommand(imageLoadCMD, imageListCMD, imageRemoveCMD, imageTagCMD, imageInspectCMD,
+		imagePullCMD, imagePushCMD, imageSaveCMD, imagePruneCMD)
+	systemSubCMD.AddCommand(systemPruneCMD, systemDiskUsageCMD)
 
 	runContainerCMD.Flags().BoolVarP(&tty, "tty", "t", false, "enable tty")
 	runContainerCMD.Flags().StringVarP(&ResourceLimitCfg.MemoryLimit, "memory-limit", "m", "200m", "memory limit")
@@ -32,13 +67,63 @@ func init() {
 	runContainerCMD.Flags().StringVarP(&Volume, "volume", "v", "", "add a volume")
 	runContainerCMD.Flags().BoolVarP(&Detach, "detach", "d", false, "Run container in background and print container ID")
 	runContainerCMD.Flags().StringVarP(&Name, "container-name", "n", "", "set a container nickname")
-	runContainerCMD.Flags().StringVarP(&ImageTarPath, "image-tar-path", "i", "./busybox.tar", "used image tar file path")
+	runContainerCMD.Flags().StringVarP(&ImageRef, "image", "i", "./busybox.tar", "image reference name[:tag] or id, an image tar file path is also accepted")
+	runContainerCMD.Flags().StringVarP(&ImageRef, "image-tar-path", "", "./busybox.tar", "used image tar file path")
+	_ = runContainerCMD.Flags().MarkDeprecated("image-tar-path", "use --image instead")
 	runContainerCMD.Flags().StringSliceVarP(&EnvSlice, "set-environment", "e", []string{}, "set environment")
-	runContainerCMD.Flags().StringVarP(&NetWorkName, "net", "", "", "choose network")
-	runContainerCMD.Flags().StringSliceVarP(&Port, "port-mapping", "p", []string{}, "set a port mapping")
+	runContainerCMD.Flags().StringVarP(&NetworkCfg.Network, "net", "", "", "choose network")
+	runContainerCMD.Flags().StringSliceVarP(&NetworkCfg.PortMapping, "port-mapping", "p", []string{}, "set a port mapping, [hostIP:]hostPort[-end]:containerPort[-end][/tcp|udp|sctp]")
+	runContainerCMD.Flags().BoolVarP(&NetworkCfg.PublishAll, "publish-all", "P", false, "publish all exposed ports to random host ports")
+	runContainerCMD.Flags().StringSliceVarP(&NetworkCfg.Expose, "expose", "", []string{}, "expose a port or a range of ports, port[-end][/proto]")
+	runContainerCMD.Flags().StringVarP(&NetworkCfg.IP, "ip", "", "", "static IPv4 or IPv6 address of the container")
+	runContainerCMD.Flags().StringVarP(&NetworkCfg.MacAddress, "mac-address", "", "", "container MAC address, derived from the ip by default")
+	runContainerCMD.Flags().StringVarP(&NetworkCfg.RateOut, "net-rate-out", "", "", "limit the egress rate of the container, e.g. 10mbit")
+	runContainerCMD.Flags().StringVarP(&NetworkCfg.RateIn, "net-rate-in", "", "", "limit the ingress rate of the container, e.g. 10mbit")
+	runContainerCMD.Flags().BoolVarP(&NetworkCfg.UserlandProxy, "userland-proxy", "", false, "use userland proxy instead of firewall rules for port mapping")
+
+	diffContainerCMD.Flags().BoolVarP(&jsonOutput, "json", "", false, "print changes as json")
 
 	networkCreateCMD.Flags().StringVarP(&driver, "driver", "", "bridge", "network driver")
-	networkCreateCMD.Flags().StringVarP(&subnet, "subnet", "", "", "subnet cidr")
+	networkCreateCMD.Flags().StringSliceVarP(&ipamCfg.Subnets, "subnet", "", []string{}, "subnet cidr, specify twice for an IPv4 and an IPv6 subnet")
+	networkCreateCMD.Flags().StringSliceVarP(&ipamCfg.Gateways, "gateway", "", []string{}, "gateway of the subnet, defaults to the first address")
+	networkCreateCMD.Flags().StringSliceVarP(&ipamCfg.IPRanges, "ip-range", "", []string{}, "allocate container ips from a sub-range of the subnet")
+	networkCreateCMD.Flags().StringSliceVarP(&auxAddress, "aux-address", "", []string{}, "reserve an address for a host device, host=ip")
+	networkCreateCMD.Flags().BoolVarP(&ipv6, "ipv6", "", false, "enable IPv6 networking")
+	networkCreateCMD.Flags().StringVarP(&parent, "parent", "", "", "parent interface for macvlan/ipvlan network")
+	networkCreateCMD.Flags().StringSliceVarP(&networkOpts, "opt", "o", []string{}, "driver specific options, e.g. ipvlan_mode=l3, vni=100")
+	networkCreateCMD.Flags().StringVarP(&cniConfig, "config", "", "", "cni conflist file for cni network")
+	networkCreateCMD.Flags().BoolVarP(&icc, "icc", "", true, "enable inter container communication in bridge network")
+	networkCreateCMD.Flags().BoolVarP(&internal, "internal", "", false, "restrict external access of bridge network")
+	networkCreateCMD.Flags().IntVarP(&mtu, "mtu", "", 0, "mtu of the bridge and container interfaces")
+
+	commitContainerCMD.Flags().StringVarP(&commitOpts.Message, "message", "m", "", "commit message")
+	commitContainerCMD.Flags().StringVarP(&commitOpts.Author, "author", "a", "", "author, e.g. \"name <email>\"")
+	commitContainerCMD.Flags().StringArrayVarP(&commitOpts.Changes, "change", "c", []string{}, "apply a Dockerfile instruction to the image config: ENV, CMD, ENTRYPOINT, WORKDIR, USER, EXPOSE, LABEL")
+
+	exportContainerCMD.Flags().StringVarP(&archiveOutput, "output", "o", "", "write to a file instead of stdout")
+	importImageCMD.Flags().StringArrayVarP(&importChanges, "change", "c", []string{}, "apply a Dockerfile instruction to the image config: ENV, CMD, ENTRYPOINT, WORKDIR, USER, EXPOSE, LABEL")
+	buildCMD.Flags().StringVarP(&dockerfile, "file", "f", "", "path of the Dockerfile, defaults to context/Dockerfile")
+	buildCMD.Flags().StringVarP(&imageTag, "tag", "t", "", "name and optionally a tag in the name:tag format")
+
+	imageLoadCMD.Flags().StringVarP(&imageTag, "tag", "t", "", "name and optionally a tag in the name:tag format")
+	imageRemoveCMD.Flags().BoolVarP(&forceRemove, "force", "f", false, "untag images used by containers")
+	for _, c := range []*cobra.Command{imagePruneCMD, systemPruneCMD} {
+		c.Flags().BoolVarP(&pruneAll, "all", "a", false, "remove all images not used by containers, not just dangling ones")
+	}
+	systemDiskUsageCMD.Flags().BoolVarP(&verbose, "verbose", "v", false, "show space usage of each image, container and volume")
+	for _, c := range []*cobra.Command{imagePullCMD, imagePushCMD} {
+		c.Flags().StringVarP(&registryOpts.Username, "username", "u", "", "registry username")
+		c.Flags().StringVarP(&registryOpts.Password, "password", "p", "", "registry password")
+		c.Flags().BoolVarP(&registryOpts.Insecure, "insecure", "", false, "use plain http to access the registry")
+	}
+	imageSaveCMD.Flags().StringVarP(&archiveOutput, "output", "o", "", "write to a file instead of stdout")
+	imageSaveCMD.Flags().StringVarP(&saveFormat, "format", "", image.FormatDockerArchive, "archive format, docker-archive or oci")
+	imagePushCMD.Flags().Int64VarP(&registryOpts.ChunkSize, "chunk-size", "", image.DefaultChunkSize, "upload blobs larger than this in chunks of this many bytes, 0 uploads in a single request")
+
+	proxyCMD.Flags().StringVarP(&proxyProto, "proto", "", "tcp", "proxy protocol")
+	proxyCMD.Flags().StringVarP(&proxyHostIP, "host-ip", "", "0.0.0.0", "host ip to listen on")
+	proxyCMD.Flags().IntVarP(&proxyHostPort, "host-port", "", 0, "host port to listen on")
+	proxyCMD.Flags().StringVarP(&proxyContainerIP, "container-ip", "", "", "container ip to forward to")
+	proxyCMD.Flags().IntVarP(&proxyContainerPort, "container-port", "", 0, "container port to forward to")
 	networkCreateCMD.MarkFlagRequired("driver")
-	networkCreateCMD.MarkFlagRequired("subnet")
 }
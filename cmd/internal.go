@@ -7,6 +7,7 @@ import (
 	"xwj/mydocker/container"
 	"xwj/mydocker/log"
 	"xwj/mydocker/namespace"
+	"xwj/mydocker/network"
 )
 
 const EnvExecPid = "mydocker_pid"
@@ -42,4 +43,12 @@ var execContainerCMD = &cobra.Command{
 	},
 }
 
-
+var proxyCMD = &cobra.Command{
+	Use:    "proxy",
+	Long:   "Userland proxy for port mapping.Do not call it outside.",
+	Hidden: true,
+	Args:   cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return network.RunUserlandProxy(proxyProto, proxyHostIP, proxyHostPort, proxyContainerIP, proxyContainerPort)
+	},
+}
@@ -3,6 +3,8 @@ package cmd
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
 	"xwj/mydocker/network"
 )
 
@@ -21,8 +23,32 @@ var networkCreateCMD = &cobra.Command{
 		if err := network.Init(); err != nil {
 			return err
 		}
+		// 解析驱动选项
+		options, err := parseNetworkOptions(networkOpts)
+		if err != nil {
+			return err
+		}
+		if parent != "" {
+			options["parent"] = parent
+		}
+		if cniConfig != "" {
+			options["config"] = cniConfig
+		}
+		if !icc {
+			options["icc"] = "false"
+		}
+		if internal {
+			options["internal"] = "true"
+		}
+		if mtu > 0 {
+			options["mtu"] = strconv.Itoa(mtu)
+		}
+		// 解析保留的辅助地址
+		if ipamCfg.AuxAddress, err = parseNetworkOptions(auxAddress); err != nil {
+			return err
+		}
 		// 创建网络
-		if err := network.CreateNetwork(driver, subnet, args[0]); err != nil {
+		if err := network.CreateNetwork(driver, ipamCfg, ipv6, args[0], options); err != nil {
 			return fmt.Errorf("create network error: %+v", err)
 		}
 		return nil
@@ -58,3 +84,93 @@ var networkRemoveCMD = &cobra.Command{
 	},
 }
 
+// parseNetworkOptions 解析key=value格式的网络驱动选项
+func parseNetworkOptions(opts []string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf(" invalid network option: %s", opt)
+		}
+		options[kv[0]] = kv[1]
+	}
+	return options, nil
+}
+
+var networkReconcileCMD = &cobra.Command{
+	Use:   "reconcile",
+	Short: "restore container networks from stored state",
+	Long:  "recreate missing bridges, release addresses of removed containers and rebuild myDocker firewall rules (iptables or nftables) from stored networks and endpoints",
+	Args:  cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := network.Init(); err != nil {
+			return err
+		}
+		return network.Reconcile()
+	},
+}
+
+var networkPeerCMD = &cobra.Command{
+	Use:   "peer",
+	Short: "manage peers of overlay network",
+	Long:  "manage VTEP peers (other hosts) of overlay network",
+}
+
+var networkPeerAddCMD = &cobra.Command{
+	Use:   "add [network_name] [peer_ip]...",
+	Short: "add peers to overlay network",
+	Long:  "add peers to overlay network",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := network.Init(); err != nil {
+			return err
+		}
+		return network.UpdateOverlayPeers(args[0], args[1:], nil, false)
+	},
+}
+
+var networkPeerRemoveCMD = &cobra.Command{
+	Use:   "rm [network_name] [peer_ip]...",
+	Short: "remove peers from overlay network",
+	Long:  "remove peers from overlay network",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := network.Init(); err != nil {
+			return err
+		}
+		return network.UpdateOverlayPeers(args[0], nil, args[1:], false)
+	},
+}
+
+var networkPeerReloadCMD = &cobra.Command{
+	Use:   "reload [network_name]",
+	Short: "reload peers of overlay network from its peers file",
+	Long:  "reload peers of overlay network from its peers file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := network.Init(); err != nil {
+			return err
+		}
+		return network.UpdateOverlayPeers(args[0], nil, nil, true)
+	},
+}
+
+var networkPeerListCMD = &cobra.Command{
+	Use:   "ls [network_name]",
+	Short: "list peers of overlay network",
+	Long:  "list peers of overlay network",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := network.Init(); err != nil {
+			return err
+		}
+		peers, err := network.ListOverlayPeers(args[0])
+		if err != nil {
+			return err
+		}
+		for _, peer := range peers {
+			fmt.Println(peer)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"xwj/mydocker/container"
+)
+
+var systemSubCMD = &cobra.Command{
+	Use:   "system",
+	Short: "manage mydocker",
+	Long:  "manage the data of mydocker under /var/lib/mydocker and /var/run/mydocker",
+}
+
+var systemPruneCMD = &cobra.Command{
+	Use:   "prune",
+	Short: "remove unused data",
+	Long:  "remove stopped containers, orphaned mount points and write layers, networks not used by any container, dangling images and unreferenced layers",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return container.SystemPrune(pruneAll)
+	},
+}
+
+var systemDiskUsageCMD = &cobra.Command{
+	Use:   "df",
+	Short: "show disk usage",
+	Long:  "show the space used by images, container write layers, volumes and container logs, and how much of it can be reclaimed by prune",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return container.SystemDiskUsage(verbose)
+	},
+}
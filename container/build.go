@@ -0,0 +1,437 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"xwj/mydocker/cgroups/subsystems"
+	"xwj/mydocker/image"
+	"xwj/mydocker/log"
+	"xwj/mydocker/record"
+	"xwj/mydocker/utils"
+)
+
+const buildCgroupName = "myDocker_build"
+
+// Build
+// @Description: 按照Dockerfile构建镜像，每一步生成一个镜像层，父镜像与指令相同的步骤使用缓存
+// @param dockerfile Dockerfile的路径，为空时使用上下文目录中的Dockerfile
+// @param contextDir 构建上下文目录，COPY/ADD的源文件都在这个目录中
+// @param ref 构建出的镜像的name:tag，为空时不打标签
+// @return *image.Image
+// @return error
+func Build(dockerfile, contextDir, ref string) (*image.Image, error) {
+	if ref != "" {
+		if _, err := image.ParseReference(ref); err != nil {
+			return nil, err
+		}
+	}
+	if dockerfile == "" {
+		dockerfile = filepath.Join(contextDir, "Dockerfile")
+	}
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	instructions, err := image.ParseDockerfile(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var current *image.Image
+	// 当前阶段中是否已经设置过CMD，ENTRYPOINT只清空从父镜像继承的CMD
+	cmdSet := false
+	for i, inst := range instructions {
+		fmt.Printf("Step %d/%d : %s\n", i+1, len(instructions), inst.Original)
+		if inst.Command == "FROM" {
+			// 只支持本地的镜像，不支持--platform等选项与FROM ... AS的多阶段构建
+			flags, rest := image.SplitFlags(inst.Args)
+			if len(flags) > 0 {
+				return nil, fmt.Errorf(" line %d: FROM options are not supported: %s", inst.Line, inst.Args)
+			}
+			args := strings.Fields(rest)
+			if len(args) == 0 {
+				return nil, fmt.Errorf(" line %d: FROM requires an image", inst.Line)
+			}
+			if len(args) > 1 {
+				return nil, fmt.Errorf(" line %d: multi-stage builds (FROM ... AS name) are not supported", inst.Line)
+			}
+			base := args[0]
+			cmdSet = false
+			if base == "scratch" {
+				current = nil
+				continue
+			}
+			if current, err = image.Get(base); err != nil {
+				return nil, fmt.Errorf(" line %d: FROM %s: %v", inst.Line, base, err)
+			}
+		} else if current, err = buildStep(current, inst, contextDir, cmdSet); err != nil {
+			return nil, fmt.Errorf(" line %d: %s: %v", inst.Line, inst.Command, err)
+		}
+		if inst.Command == "CMD" {
+			cmdSet = true
+		}
+		fmt.Printf(" ---> %s\n", image.ShortID(current.ID))
+	}
+	if current == nil {
+		return nil, fmt.Errorf(" no image was built")
+	}
+	if ref != "" {
+		if err := image.Tag(current.ID, ref); err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
+
+// buildStep
+// @Description: 在父镜像上执行一条指令，得到新的镜像
+// @param parent 父镜像，FROM scratch时为nil
+// @param inst
+// @param contextDir
+// @param cmdSet 当前阶段中是否已经设置过CMD
+// @return *image.Image
+// @return error
+func buildStep(parent *image.Image, inst *image.Instruction, contextDir string, cmdSet bool) (*image.Image, error) {
+	parentID := ""
+	if parent != nil {
+		parentID = parent.ID
+	}
+	key := inst.Command + " " + inst.Args
+	var sources []string
+	var dest string
+	var chown string
+	switch inst.Command {
+	case "RUN":
+		if parent == nil {
+			return nil, fmt.Errorf(" RUN requires a base image")
+		}
+	case "COPY", "ADD":
+		flags, args := image.SplitFlags(inst.Args)
+		// --from等选项没有实现，忽略会从上下文中复制错误的文件
+		for name := range flags {
+			if name != "chown" {
+				return nil, fmt.Errorf(" --%s is not supported", name)
+			}
+		}
+		chown = flags["chown"]
+		srcs, dst, err := image.ParseSourcesDest(args)
+		if err != nil {
+			return nil, err
+		}
+		if sources, err = resolveSources(contextDir, srcs); err != nil {
+			return nil, err
+		}
+		dest = dst
+		// COPY/ADD的缓存还需要比较源文件的内容
+		sum, err := hashSources(sources)
+		if err != nil {
+			return nil, err
+		}
+		key += " " + sum
+	case "ENTRYPOINT":
+		// 保留CMD与清空CMD得到的镜像不同
+		if cmdSet {
+			key += " (keep cmd)"
+		}
+	case "ENV", "WORKDIR", "USER", "CMD", "EXPOSE", "LABEL":
+	default:
+		return nil, fmt.Errorf(" unsupported instruction")
+	}
+	if img, ok := image.CacheGet(parentID, key); ok {
+		fmt.Println(" ---> Using cache")
+		return img, nil
+	}
+	var img *image.Image
+	var err error
+	switch inst.Command {
+	case "RUN":
+		img, err = runBuildStep(parent, inst)
+	case "COPY", "ADD":
+		img, err = copyBuildStep(parent, inst, sources, dest, chown)
+	default:
+		// 只修改镜像配置的指令不增加层
+		img, err = image.Commit(parentID, "", "", &image.CommitOptions{
+			CreatedBy: inst.Original,
+			Changes:   []string{inst.Command + " " + inst.Args},
+			KeepCmd:   cmdSet,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := image.CachePut(parentID, key, img.ID); err != nil {
+		log.LogErrorFrom("buildStep", "CachePut", err)
+	}
+	return img, nil
+}
+
+// runBuildStep
+// @Description: 在父镜像的临时容器中执行RUN指令，不连接网络，将容器的读写层提交为新的一层
+// @param parent
+// @param inst
+// @return *image.Image
+// @return error
+func runBuildStep(parent *image.Image, inst *image.Instruction) (*image.Image, error) {
+	cId := RandStringContainerID(10)
+	cmdArray := image.ParseCommand(inst.Args)
+	netCfg := &record.NetworkConfig{}
+	process, containerInfo, containerCM, err := startContainer(true, cmdArray, &subsystems.ResourceConfig{}, buildCgroupName,
+		"", "", parent.ID, parent, cId, parent.Config.Config.Env, netCfg)
+	mntUrl := filepath.Join(ROOTURL, "mnt", cId)
+	defer func() {
+		DeleteWriteLayer(ROOTURL, cId)
+		DeleteContainerInfo(cId)
+		if err := image.Release(cId); err != nil {
+			log.LogErrorFrom("runBuildStep", "Release", err)
+		}
+	}()
+	if err != nil {
+		DeleteMountPoint(mntUrl)
+		return nil, err
+	}
+	waitErr := process.Wait()
+	containerCM.Destroy()
+	// 先卸载容器的挂载点再提交读写层
+	DeleteMountPoint(mntUrl)
+	if waitErr != nil {
+		return nil, fmt.Errorf(" %s returned %v", containerInfo.Command, waitErr)
+	}
+	return image.Commit(parent.ID, filepath.Join(ROOTURL, "diff", cId+"_writeLayer"), "", &image.CommitOptions{CreatedBy: inst.Original})
+}
+
+// copyBuildStep
+// @Description: 将上下文中的源文件复制到新的一层中，ADD会解压本地的tar包
+// @param parent
+// @param inst
+// @param sources 上下文中的源文件
+// @param dest 目标路径，相对路径基于镜像的工作目录
+// @param chown 复制的文件的属主uid[:gid]，为空时复制的文件属于root
+// @return *image.Image
+// @return error
+func copyBuildStep(parent *image.Image, inst *image.Instruction, sources []string, dest, chown string) (*image.Image, error) {
+	uid, gid := -1, -1
+	if chown != "" {
+		var err error
+		if uid, gid, err = parseChown(chown); err != nil {
+			return nil, err
+		}
+	}
+	parentID, workDir := "", "/"
+	if parent != nil {
+		parentID = parent.ID
+		if parent.Config.Config.WorkingDir != "" {
+			workDir = parent.Config.Config.WorkingDir
+		}
+	}
+	// 目标以/或者/.结尾、有多个源文件或者在镜像中已经是目录时，目标是目录
+	destIsDir := strings.HasSuffix(dest, "/") || dest == "." || strings.HasSuffix(dest, "/.") || len(sources) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join(workDir, dest)
+	}
+	if parent != nil && !destIsDir {
+		for _, layer := range parent.LayerPaths() {
+			if p, err := utils.SecureJoin(layer, dest); err == nil {
+				if info, err := os.Lstat(p); err == nil {
+					destIsDir = info.IsDir()
+					break
+				}
+			}
+		}
+	}
+	layerDir, err := ioutil.TempDir("", "mydocker-build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(layerDir)
+	target := filepath.Join(layerDir, filepath.Clean("/"+dest))
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case inst.Command == "ADD" && info.Mode().IsRegular() && image.IsArchive(source):
+			err = untarFile(source, target)
+		case info.IsDir():
+			// 目录复制的是其中的内容
+			err = copyTree(source, target, uid, gid)
+		case destIsDir:
+			err = copyTree(source, filepath.Join(target, filepath.Base(source)), uid, gid)
+		default:
+			err = copyTree(source, target, uid, gid)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return image.Commit(parentID, layerDir, "", &image.CommitOptions{CreatedBy: inst.Original})
+}
+
+// resolveSources 解析COPY/ADD的源路径，支持通配符，源路径中的符号链接都在上下文目录内解析
+func resolveSources(contextDir string, srcs []string) ([]string, error) {
+	var sources []string
+	for _, src := range srcs {
+		if strings.Contains(src, "://") {
+			return nil, fmt.Errorf(" remote source %s is not supported", src)
+		}
+		matches, err := filepath.Glob(filepath.Join(contextDir, filepath.Clean("/"+src)))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf(" %s: no such file or directory in the build context", src)
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(contextDir, match)
+			if err != nil {
+				return nil, err
+			}
+			source, err := utils.SecureJoin(contextDir, rel)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+// hashSources 计算源文件的路径、权限与内容的摘要，作为COPY/ADD构建缓存的一部分
+func hashSources(sources []string) (string, error) {
+	hash := sha256.New()
+	for _, source := range sources {
+		err := filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(source, p)
+			fmt.Fprintf(hash, "%s\x00%s\x00%o\x00", filepath.Base(source), rel, info.Mode())
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				io.WriteString(hash, link)
+			case info.Mode().IsRegular():
+				f, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(hash, f)
+				f.Close()
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyTree 递归复制文件或目录，保留权限、符号链接与修改时间；uid/gid为-1时不修改属主，新建的文件属于执行构建的用户(root)，与Docker不指定--chown时相同
+func copyTree(src, dst string, uid, gid int) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(p, target, mode.Perm()); err != nil {
+				return err
+			}
+		default:
+			// 设备、管道与socket不复制
+			return nil
+		}
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink == 0 {
+			if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+}
+
+// copyFile 复制一个普通文件
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// untarFile 将tar包解压到目标目录
+func untarFile(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	return image.Untar(f, dst)
+}
+
+// parseChown 解析数字形式的uid[:gid]，没有gid时与uid相同
+func parseChown(chown string) (int, int, error) {
+	parts := strings.SplitN(chown, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf(" --chown only supports numeric uid[:gid]: %s", chown)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf(" --chown only supports numeric uid[:gid]: %s", chown)
+		}
+	}
+	return uid, gid, nil
+}
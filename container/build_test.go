@@ -0,0 +1,60 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// COPY/ADD构建缓存的摘要随源文件的内容、权限、符号链接与文件名变化
+func TestHashSources(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "sub", "a.txt")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	hash := func() string {
+		sum, err := hashSources([]string{src})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	seen := map[string]string{hash(): "initial"}
+	if again := hash(); seen[again] != "initial" {
+		t.Fatal("hashSources is not stable")
+	}
+	changes := []struct {
+		name   string
+		modify func() error
+	}{
+		{"content", func() error { return ioutil.WriteFile(file, []byte("world"), 0644) }},
+		{"mode", func() error { return os.Chmod(file, 0755) }},
+		{"symlink target", func() error {
+			if err := os.Remove(filepath.Join(src, "link")); err != nil {
+				return err
+			}
+			return os.Symlink("sub", filepath.Join(src, "link"))
+		}},
+		{"file name", func() error { return os.Rename(file, filepath.Join(src, "sub", "b.txt")) }},
+		{"new file", func() error { return ioutil.WriteFile(filepath.Join(src, "c.txt"), nil, 0644) }},
+	}
+	for _, c := range changes {
+		if err := c.modify(); err != nil {
+			t.Fatal(err)
+		}
+		sum := hash()
+		if prev, ok := seen[sum]; ok {
+			t.Fatalf("changing %s keeps the hash of %s", c.name, prev)
+		}
+		seen[sum] = c.name
+	}
+}
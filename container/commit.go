@@ -1,18 +1,35 @@
 package container
 
 import (
-	"os/exec"
+	"fmt"
 	"path/filepath"
+	"xwj/mydocker/image"
 	"xwj/mydocker/log"
 )
 
 // CommitContainer
-// @Description: 打包一个容器
-// @param imageName
-func CommitContainer(containerID, imageName string) {
-	mntUrl := filepath.Join(ROOTURL, "mnt", containerID)
-	imageTarUrl := "./" + imageName + ".tar"
-	if _, err := exec.Command("tar", "-czf", imageTarUrl, "-C", mntUrl, ".").CombinedOutput(); err != nil {
-		log.LogErrorFrom("CommitContainer", "tar", err)
+// @Description: 将容器的读写层作为新的一层提交到镜像存储，叠加在容器使用的镜像之上
+// @param containerID
+// @param ref 新镜像的name:tag，为空时生成没有名称的镜像
+// @param opts 提交说明、作者以及对镜像配置的修改
+// @return *image.Image
+// @return error
+func CommitContainer(containerID, ref string, opts *image.CommitOptions) (*image.Image, error) {
+	containerInfo, err := getContainerByID(containerID)
+	if err != nil {
+		return nil, err
 	}
+	if containerInfo.ImageID == "" {
+		return nil, fmt.Errorf(" container %s is not created from an image in the image store", containerID)
+	}
+	if opts.CreatedBy == "" {
+		opts.CreatedBy = containerInfo.Command
+	}
+	writeLayer := filepath.Join(ROOTURL, "diff", containerID+"_writeLayer")
+	img, err := image.Commit(containerInfo.ImageID, writeLayer, ref, opts)
+	if err != nil {
+		log.LogErrorFrom("CommitContainer", "Commit", err)
+		return nil, err
+	}
+	return img, nil
 }
@@ -0,0 +1,175 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"xwj/mydocker/image"
+	"xwj/mydocker/utils"
+)
+
+// CopyFiles
+// @Description: 在容器与宿主机之间复制文件，src与dst中有且只有一个为<container>:<path>的形式，
+// 宿主机一侧为-时从标准输入读取tar包或者向标准输出写入tar包
+// @param src
+// @param dst
+// @return error
+func CopyFiles(src, dst string) error {
+	srcContainer, srcPath := splitCopyArg(src)
+	dstContainer, dstPath := splitCopyArg(dst)
+	switch {
+	case srcContainer != "" && dstContainer != "":
+		return fmt.Errorf(" copying between containers is not supported")
+	case srcContainer != "":
+		return CopyFromContainer(srcContainer, srcPath, dstPath)
+	case dstContainer != "":
+		return CopyToContainer(srcPath, dstContainer, dstPath)
+	}
+	return fmt.Errorf(" one of the paths must be in the form <container>:<path>")
+}
+
+// splitCopyArg 拆分<container>:<path>，以/或者.开头的是宿主机的路径
+func splitCopyArg(arg string) (string, string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	i := strings.Index(arg, ":")
+	if i <= 0 {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// CopyFromContainer
+// @Description: 将容器中的文件或者目录复制到宿主机，保留属主与权限；dst为-时以tar包写入标准输出
+// 容器没有运行时临时挂载容器的文件系统，容器中的符号链接都在容器的根目录内解析
+// @param containerID
+// @param srcPath 容器中的路径，最后一个部分是符号链接时复制链接本身
+// @param dst 宿主机的路径，已经存在的目录时复制到其中
+// @return error
+func CopyFromContainer(containerID, srcPath, dst string) error {
+	containerInfo, err := getContainerByID(containerID)
+	if err != nil {
+		return err
+	}
+	rootfs, cleanup, err := containerRootfs(containerInfo)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	src, err := pathInRoot(rootfs, srcPath)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf(" no such file %s in container %s", srcPath, containerID)
+	}
+	name := filepath.Base(filepath.Clean("/" + srcPath))
+	if dst == "-" {
+		return image.TarPath(os.Stdout, src, name)
+	}
+	dir, name, err := copyDest(dst, name, srcInfo.IsDir(), func(path string) (string, error) { return path, nil })
+	if err != nil {
+		return err
+	}
+	return pipeCopy(src, name, func(r io.Reader) error {
+		return image.Untar(r, dir)
+	})
+}
+
+// CopyToContainer
+// @Description: 将宿主机的文件或者目录复制到容器中，保留属主与权限；src为-时从标准输入读取tar包解压到容器的目录中
+// 容器没有运行时临时挂载容器的文件系统，写入的内容保存在容器的读写层中
+// @param src 宿主机的路径
+// @param containerID
+// @param dstPath 容器中的路径，已经存在的目录时复制到其中
+// @return error
+func CopyToContainer(src, containerID, dstPath string) error {
+	containerInfo, err := getContainerByID(containerID)
+	if err != nil {
+		return err
+	}
+	rootfs, cleanup, err := containerRootfs(containerInfo)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	dstPath = filepath.Clean("/" + dstPath)
+	inRoot := func(path string) (string, error) { return utils.SecureJoin(rootfs, path) }
+	if src == "-" {
+		dir, err := inRoot(dstPath)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf(" %s is not a directory in container %s", dstPath, containerID)
+		}
+		return image.UntarInRoot(os.Stdin, rootfs, dstPath)
+	}
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	dir, name, err := copyDest(dstPath, filepath.Base(filepath.Clean(src)), srcInfo.IsDir(), inRoot)
+	if err != nil {
+		return err
+	}
+	return pipeCopy(src, name, func(r io.Reader) error {
+		return image.UntarInRoot(r, rootfs, dir)
+	})
+}
+
+// pathInRoot 获取容器中的路径在根目录中的位置，父目录中的符号链接在根目录内解析，最后一个部分本身不解析
+func pathInRoot(rootfs, path string) (string, error) {
+	clean := filepath.Clean("/" + path)
+	if clean == "/" {
+		return rootfs, nil
+	}
+	parent, err := utils.SecureJoin(rootfs, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
+
+// copyDest 确定复制的目标：dst是已经存在的目录时复制到其中并保留原来的名称，否则复制为dst
+// resolve用于获取dst在文件系统中的实际位置，返回的目录仍然是dst所在的路径
+func copyDest(dst, name string, srcIsDir bool, resolve func(string) (string, error)) (string, string, error) {
+	resolved, err := resolve(dst)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(resolved)
+	if err == nil && info.IsDir() {
+		return dst, name, nil
+	}
+	if err == nil && srcIsDir {
+		return "", "", fmt.Errorf(" cannot copy a directory to file %s", dst)
+	}
+	if err != nil && strings.HasSuffix(dst, "/") {
+		return "", "", fmt.Errorf(" directory %s does not exist", dst)
+	}
+	parent, err := resolve(filepath.Dir(filepath.Clean(dst)))
+	if err != nil {
+		return "", "", err
+	}
+	if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+		return "", "", fmt.Errorf(" directory %s does not exist", filepath.Dir(filepath.Clean(dst)))
+	}
+	return filepath.Dir(filepath.Clean(dst)), filepath.Base(filepath.Clean(dst)), nil
+}
+
+// pipeCopy 将src打包后交给extract解压，打包与解压同时进行
+func pipeCopy(src, name string, extract func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(image.TarPath(pw, src, name))
+	}()
+	err := extract(pr)
+	// 解压失败时结束打包
+	pr.CloseWithError(err)
+	return err
+}
@@ -0,0 +1,124 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"xwj/mydocker/utils"
+)
+
+func TestSplitCopyArg(t *testing.T) {
+	tests := []struct {
+		arg       string
+		container string
+		path      string
+	}{
+		{"c1:/etc/hosts", "c1", "/etc/hosts"},
+		{"c1:", "c1", ""},
+		{"c1:a:b", "c1", "a:b"},
+		// 以/或者.开头的是宿主机的路径，即使其中有:
+		{"/tmp/a:b", "", "/tmp/a:b"},
+		{"./a:b", "", "./a:b"},
+		{"a.txt", "", "a.txt"},
+		{":a", "", ":a"},
+		{"-", "", "-"},
+	}
+	for _, tt := range tests {
+		container, path := splitCopyArg(tt.arg)
+		if container != tt.container || path != tt.path {
+			t.Errorf("splitCopyArg(%q) = %q, %q, want %q, %q", tt.arg, container, path, tt.container, tt.path)
+		}
+	}
+}
+
+// newTestRootfs 创建容器的根目录，escape指向宿主机上存在的目录，在根目录内解析时不存在
+func newTestRootfs(t *testing.T) string {
+	tmp := t.TempDir()
+	rootfs, hostDir := filepath.Join(tmp, "rootfs"), filepath.Join(tmp, "host")
+	for _, d := range []string{filepath.Join(rootfs, "etc"), filepath.Join(rootfs, "app"), hostDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/hosts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"abslink":   "/etc",
+		"uplink":    "../../../../etc",
+		"escape":    hostDir,
+		"etc/hlink": "/etc/hosts",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(rootfs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestPathInRoot(t *testing.T) {
+	rootfs := newTestRootfs(t)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", ""},
+		{"", ""},
+		{"etc/hosts", "etc/hosts"},
+		{"/abslink/hosts", "etc/hosts"},
+		{"/uplink/hosts", "etc/hosts"},
+		{"../../etc/hosts", "etc/hosts"},
+		// 最后一个部分是符号链接时不解析
+		{"/abslink", "abslink"},
+		{"/etc/hlink", "etc/hlink"},
+		{"/escape", "escape"},
+	}
+	for _, tt := range tests {
+		got, err := pathInRoot(rootfs, tt.path)
+		if want := filepath.Join(rootfs, tt.want); err != nil || got != want {
+			t.Errorf("pathInRoot(%q) = %q, %v, want %q", tt.path, got, err, want)
+		}
+	}
+}
+
+func TestCopyDest(t *testing.T) {
+	rootfs := newTestRootfs(t)
+	inRoot := func(path string) (string, error) { return utils.SecureJoin(rootfs, path) }
+	tests := []struct {
+		dst      string
+		srcIsDir bool
+		dir      string
+		name     string
+		err      bool
+	}{
+		// 已经存在的目录时复制到其中
+		{dst: "/app", dir: "/app", name: "src"},
+		{dst: "/app/", srcIsDir: true, dir: "/app/", name: "src"},
+		{dst: "/abslink", dir: "/abslink", name: "src"},
+		{dst: "/uplink", dir: "/uplink", name: "src"},
+		// 不存在时复制为dst
+		{dst: "/app/new", dir: "/app", name: "new"},
+		{dst: "/uplink/new", srcIsDir: true, dir: "/uplink", name: "new"},
+		{dst: "/etc/hosts", dir: "/etc", name: "hosts"},
+		{dst: "/etc/hosts", srcIsDir: true, err: true},
+		{dst: "/missing/", err: true},
+		{dst: "/missing/new", err: true},
+		// 指向宿主机目录的符号链接在根目录内解析，宿主机上的目录不是复制的目标
+		{dst: "/escape", dir: "/", name: "escape"},
+		{dst: "/escape/new", err: true},
+	}
+	for _, tt := range tests {
+		dir, name, err := copyDest(tt.dst, "src", tt.srcIsDir, inRoot)
+		if tt.err {
+			if err == nil {
+				t.Errorf("copyDest(%q, %v) = %q, %q, want error", tt.dst, tt.srcIsDir, dir, name)
+			}
+			continue
+		}
+		if err != nil || dir != tt.dir || name != tt.name {
+			t.Errorf("copyDest(%q, %v) = %q, %q, %v, want %q, %q", tt.dst, tt.srcIsDir, dir, name, err, tt.dir, tt.name)
+		}
+	}
+}
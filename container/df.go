@@ -0,0 +1,140 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"xwj/mydocker/image"
+	"xwj/mydocker/record"
+	"xwj/mydocker/utils"
+)
+
+// containerUsage 一个容器占用的空间
+type containerUsage struct {
+	info      *record.ContainerInfo
+	layerSize int64 // 读写层的大小
+	logSize   int64 // 日志文件的大小
+}
+
+// volumeUsage 一个数据卷占用的空间
+type volumeUsage struct {
+	path       string   // 宿主机上的目录
+	containers []string // 使用数据卷的容器
+	size       int64
+}
+
+// SystemDiskUsage
+// @Description: 统计镜像、容器读写层、数据卷与容器日志占用的空间以及可以通过prune释放的空间
+// 镜像层的大小来自镜像存储中的层记录，共享的层只统计一次；停止的容器的读写层与日志可以释放，数据卷不会被清理
+// @param verbose 为true时输出每个镜像、容器与数据卷的详细信息
+// @return error
+func SystemDiskUsage(verbose bool) error {
+	inUse := ImagesInUse()
+	images, err := image.Usage(inUse)
+	if err != nil {
+		return err
+	}
+	var containers []*containerUsage
+	volumes := make(map[string]*volumeUsage)
+	var layersSize, layersReclaimable, logsSize, logsReclaimable int64
+	activeContainers := 0
+	for _, containerInfo := range allContainers() {
+		cu := &containerUsage{
+			info:      containerInfo,
+			layerSize: utils.DirSize(filepath.Join(ROOTURL, "diff", containerInfo.Id+writeLayerSuffix)),
+		}
+		if info, err := os.Stat(filepath.Join(DefaultInfoLocation, containerInfo.Id, LogFileName)); err == nil {
+			cu.logSize = info.Size()
+		}
+		layersSize += cu.layerSize
+		logsSize += cu.logSize
+		if containerInfo.Status == RUNNING {
+			activeContainers++
+		} else {
+			layersReclaimable += cu.layerSize
+			logsReclaimable += cu.logSize
+		}
+		containers = append(containers, cu)
+		if volumeUrls, err := volumeUrlExtract(containerInfo.Volume); err == nil {
+			vu, ok := volumes[volumeUrls[0]]
+			if !ok {
+				vu = &volumeUsage{path: volumeUrls[0], size: utils.DirSize(volumeUrls[0])}
+				volumes[volumeUrls[0]] = vu
+			}
+			vu.containers = append(vu.containers, containerInfo.Id)
+		}
+	}
+	var volumesSize int64
+	for _, vu := range volumes {
+		volumesSize += vu.size
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE\n")
+	fmt.Fprintf(w, "Images\t%d\t%d\t%s\t%s\n", len(images.Images), images.Active, image.HumanSize(images.Size), reclaimable(images.Reclaimable, images.Size))
+	fmt.Fprintf(w, "Containers\t%d\t%d\t%s\t%s\n", len(containers), activeContainers, image.HumanSize(layersSize), reclaimable(layersReclaimable, layersSize))
+	fmt.Fprintf(w, "Local Volumes\t%d\t%d\t%s\t%s\n", len(volumes), len(volumes), image.HumanSize(volumesSize), reclaimable(0, volumesSize))
+	fmt.Fprintf(w, "Container Logs\t%d\t%d\t%s\t%s\n", len(containers), activeContainers, image.HumanSize(logsSize), reclaimable(logsReclaimable, logsSize))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\nTotal reclaimable: %s\n", image.HumanSize(images.Reclaimable+layersReclaimable+logsReclaimable))
+	if !verbose {
+		return nil
+	}
+
+	fmt.Println("\nImages space usage:")
+	w = tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tSIZE\tSHARED SIZE\tUNIQUE SIZE\tCONTAINERS\n")
+	for _, iu := range images.Images {
+		tags := iu.RepoTags
+		if len(tags) == 0 {
+			tags = []string{"<none>:<none>"}
+		}
+		for _, ref := range tags {
+			name, tag := image.SplitReference(ref)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", name, tag, image.ShortID(iu.ID),
+				image.HumanSize(iu.Size), image.HumanSize(iu.SharedSize), image.HumanSize(iu.UniqueSize), iu.Containers)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nContainers space usage:")
+	sort.Slice(containers, func(i, j int) bool { return containers[i].layerSize > containers[j].layerSize })
+	w = tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "CONTAINER ID\tNAME\tIMAGE\tSTATUS\tSIZE\tLOG SIZE\n")
+	for _, cu := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", cu.info.Id, cu.info.Name, cu.info.Image, cu.info.Status,
+			image.HumanSize(cu.layerSize), image.HumanSize(cu.logSize))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nLocal Volumes space usage:")
+	paths := make([]string, 0, len(volumes))
+	for path := range volumes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	w = tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "VOLUME\tCONTAINERS\tSIZE\n")
+	for _, path := range paths {
+		vu := volumes[path]
+		fmt.Fprintf(w, "%s\t%d\t%s\n", vu.path, len(vu.containers), image.HumanSize(vu.size))
+	}
+	return w.Flush()
+}
+
+// reclaimable 可以释放的空间以及所占的比例
+func reclaimable(size, total int64) string {
+	if total == 0 {
+		return image.HumanSize(size)
+	}
+	return image.HumanSize(size) + " (" + strconv.Itoa(int(size*100/total)) + "%)"
+}
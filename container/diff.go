@@ -0,0 +1,150 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"xwj/mydocker/image"
+)
+
+// 文件系统改动的类型
+const (
+	ChangeAdd    = "A"
+	ChangeModify = "C"
+	ChangeDelete = "D"
+)
+
+// Change 容器读写层中的一个改动
+type Change struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// ContainerChanges
+// @Description: 遍历容器的读写层，与镜像的只读层比较得到新增、修改与删除的文件
+// aufs的.wh.<name>与overlay的0/0字符设备表示删除，下层存在的文件是修改，否则是新增
+// @param containerID
+// @return []Change 按照路径排序的改动
+// @return error
+func ContainerChanges(containerID string) ([]Change, error) {
+	containerInfo, err := getContainerByID(containerID)
+	if err != nil {
+		return nil, err
+	}
+	var lowers []string
+	if containerInfo.ImageID != "" {
+		img, err := image.Get(containerInfo.ImageID)
+		if err != nil {
+			return nil, err
+		}
+		lowers = img.LayerPaths()
+	}
+	return layerChanges(filepath.Join(ROOTURL, "diff", containerID+writeLayerSuffix), lowers)
+}
+
+// layerChanges
+// @Description: 比较读写层与只读层得到改动，不透明目录中的文件不与只读层比较，都是新增
+// @param writeLayer 读写层目录
+// @param lowers 只读层目录，从最上层开始
+// @return []Change 按照路径排序的改动
+// @return error
+func layerChanges(writeLayer string, lowers []string) ([]Change, error) {
+	var changes []Change
+	// 读写层中的不透明目录
+	opaque := make(map[string]bool)
+	err := filepath.Walk(writeLayer, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(writeLayer, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := "/" + rel
+		base := info.Name()
+		switch {
+		case base == image.WhiteoutOpaqueDir:
+			// 不透明目录本身作为修改记录，在遍历目录时已经处理
+			return nil
+		case strings.HasPrefix(base, image.WhiteoutMetaPrefix):
+			// aufs内部使用的文件
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(base, image.WhiteoutPrefix):
+			changes = append(changes, Change{Path: filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, image.WhiteoutPrefix)), Kind: ChangeDelete})
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0 {
+			changes = append(changes, Change{Path: name, Kind: ChangeDelete})
+			return nil
+		}
+		kind := ChangeAdd
+		if !opaque[filepath.Dir(name)] && lowerExists(lowers, name) {
+			kind = ChangeModify
+		}
+		changes = append(changes, Change{Path: name, Kind: kind})
+		// 不透明目录及其子目录中的文件都看不到只读层
+		if info.IsDir() && (opaque[filepath.Dir(name)] || image.IsOpaqueDir(path)) {
+			opaque[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// lowerExists 判断路径是否存在于镜像的只读层中，从最上层开始查找，遇到whiteout或者不透明目录时停止
+func lowerExists(lowers []string, name string) bool {
+	for _, layer := range lowers {
+		if _, err := os.Lstat(filepath.Join(layer, name)); err == nil {
+			return true
+		}
+		// 路径或者某个父目录在这一层被删除，或者父目录在这一层是不透明的，下层的文件都不可见
+		for p := name; p != "/"; p = filepath.Dir(p) {
+			dir := filepath.Join(layer, filepath.Dir(p))
+			if _, err := os.Lstat(filepath.Join(dir, image.WhiteoutPrefix+filepath.Base(p))); err == nil {
+				return false
+			}
+			if _, err := os.Lstat(filepath.Join(dir, image.WhiteoutOpaqueDir)); err == nil {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// DiffContainer
+// @Description: 输出容器文件系统的改动
+// @param containerID
+// @param jsonOutput 以json格式输出
+// @return error
+func DiffContainer(containerID string, jsonOutput bool) error {
+	changes, err := ContainerChanges(containerID)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		if changes == nil {
+			changes = []Change{}
+		}
+		jsonBytes, err := json.MarshalIndent(changes, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonBytes))
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", change.Kind, change.Path)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"xwj/mydocker/image"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeTree 在root下创建文件，以/结尾的是目录
+func makeTree(t *testing.T, root string, paths ...string) {
+	for _, p := range paths {
+		full := filepath.Join(root, p)
+		if strings.HasSuffix(p, "/") {
+			if err := os.MkdirAll(full, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(full, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 读写层中的文件与只读层比较：下层存在的是修改，不存在或者被下层删除、在不透明目录中的是新增，whiteout是删除
+func TestLayerChanges(t *testing.T) {
+	tmp := t.TempDir()
+	upper, lower1, lower2 := filepath.Join(tmp, "upper"), filepath.Join(tmp, "lower1"), filepath.Join(tmp, "lower2")
+	makeTree(t, lower2, "etc/passwd", "etc/hosts", "var/cache/a", "old/x")
+	// 上面的只读层删除了old目录
+	makeTree(t, lower1, "etc/hosts", image.WhiteoutPrefix+"old")
+	makeTree(t, upper,
+		"etc/passwd",
+		"etc/new",
+		"etc/"+image.WhiteoutPrefix+"hosts",
+		"old/x",
+		"var/cache/"+image.WhiteoutOpaqueDir,
+		"var/cache/a",
+		"var/cache/sub/b",
+		image.WhiteoutMetaPrefix+"plnk/123",
+		image.WhiteoutMetaPrefix+"aufs",
+	)
+	want := []Change{
+		{"/etc", ChangeModify},
+		{"/etc/hosts", ChangeDelete},
+		{"/etc/new", ChangeAdd},
+		{"/etc/passwd", ChangeModify},
+		{"/old", ChangeAdd},
+		{"/old/x", ChangeAdd},
+		{"/var", ChangeModify},
+		{"/var/cache", ChangeModify},
+		{"/var/cache/a", ChangeAdd},
+		{"/var/cache/sub", ChangeAdd},
+		{"/var/cache/sub/b", ChangeAdd},
+	}
+	got, err := layerChanges(upper, []string{lower1, lower2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("layerChanges =\n%v\nwant\n%v", got, want)
+	}
+}
+
+// overlay读写层中0/0字符设备表示删除，trusted.overlay.opaque=y的目录是不透明目录
+func TestLayerChangesOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	tmp := t.TempDir()
+	upper, lower := filepath.Join(tmp, "upper"), filepath.Join(tmp, "lower")
+	makeTree(t, lower, "etc/shadow", "var/lib/a")
+	makeTree(t, upper, "etc/", "var/lib/a")
+	if err := unix.Mknod(filepath.Join(upper, "etc/shadow"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("create whiteout device: %v", err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(upper, "var/lib"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("set overlay opaque xattr: %v", err)
+	}
+	want := []Change{
+		{"/etc", ChangeModify},
+		{"/etc/shadow", ChangeDelete},
+		{"/var", ChangeModify},
+		{"/var/lib", ChangeModify},
+		{"/var/lib/a", ChangeAdd},
+	}
+	got, err := layerChanges(upper, []string{lower})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("layerChanges =\n%v\nwant\n%v", got, want)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"syscall"
 	"xwj/mydocker/log"
+	"xwj/mydocker/network"
 	"xwj/mydocker/record"
 )
 
@@ -124,6 +125,8 @@ func StopContainer(containerID string) {
 		log.LogErrorFrom("StopContainer", "getContainerByID", err)
 		return
 	}
+	// 在容器进程退出之前断开网络，此时容器的Net Namespace还存在
+	disconnectNetwork(containerInfo)
 	// 系统调用kill可以发送信号给进程，通过传递syscall.SIGTERM信号，去杀掉容器主进程
 	pid, _ := strconv.Atoi(containerInfo.Pid)
 	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
@@ -166,3 +169,19 @@ func RemoveContainer(containerID string) {
 		log.Log.Warnf("Please stop container first.")
 	}
 }
+
+// disconnectNetwork
+// @Description: 断开容器连接的网络，释放网络端点占用的资源
+// @param containerInfo
+func disconnectNetwork(containerInfo *record.ContainerInfo) {
+	if containerInfo.Network == "" {
+		return
+	}
+	if err := network.Init(); err != nil {
+		log.LogErrorFrom("disconnectNetwork", "network.Init", err)
+		return
+	}
+	if err := network.Disconnect(containerInfo.Network, containerInfo); err != nil {
+		log.LogErrorFrom("disconnectNetwork", "network.Disconnect", err)
+	}
+}
@@ -0,0 +1,29 @@
+package container
+
+import (
+	"io"
+	"strings"
+	"xwj/mydocker/image"
+)
+
+// ExportContainer
+// @Description: 将容器合并后的根文件系统打包为未压缩的tar包，数据卷中的内容不打包
+// @param containerID
+// @param w
+// @return error
+func ExportContainer(containerID string, w io.Writer) error {
+	containerInfo, err := getContainerByID(containerID)
+	if err != nil {
+		return err
+	}
+	rootfs, cleanup, err := containerRootfs(containerInfo)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	var exclude []string
+	if volumeUrls, err := volumeUrlExtract(containerInfo.Volume); err == nil {
+		exclude = append(exclude, strings.TrimPrefix(volumeUrls[1], "/"))
+	}
+	return image.Tar(w, rootfs, exclude...)
+}
@@ -22,6 +22,23 @@ func RunContainerInitProcess() error {
 	}
 	// 设置挂载与pivot_root
 	setUpMount()
+	// 镜像配置的工作目录与用户通过环境变量传入，不能泄露到用户进程中
+	workDir, user := os.Getenv(ENV_INIT_WORKDIR), os.Getenv(ENV_INIT_USER)
+	os.Unsetenv(ENV_INIT_WORKDIR)
+	os.Unsetenv(ENV_INIT_USER)
+	if workDir != "" {
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			return fmt.Errorf(" Create working dir %s error : %v", workDir, err)
+		}
+		if err := syscall.Chdir(workDir); err != nil {
+			return fmt.Errorf(" Chdir %s error : %v", workDir, err)
+		}
+	}
+	if user != "" {
+		if err := setUser(user); err != nil {
+			return fmt.Errorf(" Set user %s error : %v", user, err)
+		}
+	}
 	// 寻找在系统PATH下该命令的绝对路径  cmdArray[0]就是命令，后面的都是flag或其他参数
 	path, err := exec.LookPath(cmdArray[0])
 	if err != nil {
@@ -48,8 +65,8 @@ func readUserCommand() []string {
 		return nil
 	}
 	cmdStrs := string(cmds)
-	// 按空格分割命令
-	return strings.Split(cmdStrs, " ")
+	// 按\0分割命令，参数中可以带有空格
+	return strings.Split(cmdStrs, "\x00")
 }
 
 // pivotRoot
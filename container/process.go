@@ -10,14 +10,20 @@ import (
 
 const (
 	ROOTURL = "/var/lib/mydocker/aufs/"
+	// 传给init进程的工作目录与用户
+	ENV_INIT_WORKDIR = "mydocker_workdir"
+	ENV_INIT_USER    = "mydocker_user"
 )
 
 // NewParentProcess
 // @Description: 创建新的命令进程(并未执行)
 // @param tty
+// @param layers 镜像各层的只读目录，从最上层开始
+// @param workDir 容器进程的工作目录，为空时是根目录
+// @param user 容器进程的用户user[:group]，为空时是root
 // @return *exec.Cmd
 // @return *os.File   管道写入端
-func NewParentProcess(tty bool, volume, ImageTarPath, cId string, EnvSlice []string) (*exec.Cmd, *os.File) {
+func NewParentProcess(tty bool, volume string, layers []string, cId string, EnvSlice []string, workDir, user string) (*exec.Cmd, *os.File) {
 	// 创建匿名管道
 	readPipe, writePipe, err := NewPipe()
 	if err != nil {
@@ -43,7 +49,7 @@ func NewParentProcess(tty bool, volume, ImageTarPath, cId string, EnvSlice []str
 	}
 	// 创建新的工作空间
 	mntUrl := filepath.Join(ROOTURL, "mnt", cId)          // 容器运行空间
-	NewWorkSpace(ROOTURL, ImageTarPath, mntUrl, volume, cId)
+	NewWorkSpace(ROOTURL, layers, mntUrl, volume, cId)
 	cmd.Dir = mntUrl 					 				  // 设置进程启动的路径
 	// 在这里传入管道文件读取端的句柄
 	// ExtraFiles指定要由新进程继承的其他打开文件。它不包括标准输入、标准输出或标准错误。
@@ -51,6 +57,12 @@ func NewParentProcess(tty bool, volume, ImageTarPath, cId string, EnvSlice []str
 	// 添加环境变量
 	// os.Environ()就是系统默认的配置（宿主机的环境变量）,默认新启动进程都是默认继承父进程的环境变量
 	cmd.Env = append(os.Environ(), EnvSlice...)
+	if workDir != "" {
+		cmd.Env = append(cmd.Env, ENV_INIT_WORKDIR+"="+workDir)
+	}
+	if user != "" {
+		cmd.Env = append(cmd.Env, ENV_INIT_USER+"="+user)
+	}
 	return cmd, writePipe
 }
 
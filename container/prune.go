@@ -0,0 +1,210 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"xwj/mydocker/image"
+	"xwj/mydocker/log"
+	"xwj/mydocker/network"
+	"xwj/mydocker/utils"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// writeLayerSuffix 容器读写层目录名的后缀
+	writeLayerSuffix = "_writeLayer"
+	// workspaceGracePeriod 新创建的挂载点与读写层在这段时间内不会被清理，
+	// 避免删除正在启动、还没有记录容器信息的容器的工作空间
+	workspaceGracePeriod = 10 * time.Minute
+)
+
+// PruneImages
+// @Description: 删除没有name:tag的镜像以及不再被引用的层，all为true时删除所有没有被容器使用的镜像
+// @param all
+// @return error
+func PruneImages(all bool) error {
+	removed, reclaimed, err := image.Prune(all, ImagesInUse())
+	for _, line := range removed {
+		fmt.Println(line)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Total reclaimed space: %s\n", image.HumanSize(reclaimed))
+	return nil
+}
+
+// SystemPrune
+// @Description: 删除停止的容器、容器已经不存在的挂载点与读写层、没有容器使用的网络，再清理镜像与不再被引用的层
+// @param all 为true时删除所有没有被容器使用的镜像，否则只删除没有name:tag的镜像
+// @return error
+func SystemPrune(all bool) error {
+	var reclaimed int64
+	containers, size := pruneContainers()
+	reclaimed += size
+	printPruned("Deleted Containers:", containers)
+	mounts, size := pruneMountPoints()
+	reclaimed += size
+	printPruned("Deleted Mount Points:", mounts)
+	if err := network.Init(); err != nil {
+		return err
+	}
+	// 剩下的容器记录中引用的网络保留
+	keep := make(map[string]bool)
+	for _, containerInfo := range allContainers() {
+		if containerInfo.Network != "" {
+			keep[containerInfo.Network] = true
+		}
+	}
+	networks, err := network.PruneNetworks(keep)
+	printPruned("Deleted Networks:", networks)
+	if err != nil {
+		return err
+	}
+	images, size, err := image.Prune(all, ImagesInUse())
+	reclaimed += size
+	printPruned("Deleted Images:", images)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Total reclaimed space: %s\n", image.HumanSize(reclaimed))
+	return nil
+}
+
+// printPruned 输出一类被删除的对象
+func printPruned(title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Println(title)
+	for _, item := range items {
+		fmt.Println(item)
+	}
+	fmt.Println()
+}
+
+// pruneContainers
+// @Description: 删除所有停止的容器
+// @return []string 删除的容器ID
+// @return int64 释放的读写层与日志的空间
+func pruneContainers() ([]string, int64) {
+	var removed []string
+	var reclaimed int64
+	for _, containerInfo := range allContainers() {
+		if containerInfo.Status != STOP {
+			continue
+		}
+		size := utils.DirSize(filepath.Join(ROOTURL, "diff", containerInfo.Id+writeLayerSuffix)) +
+			utils.DirSize(filepath.Join(DefaultInfoLocation, containerInfo.Id))
+		RemoveContainer(containerInfo.Id)
+		if has, err := utils.DirOrFileExist(filepath.Join(DefaultInfoLocation, containerInfo.Id)); err == nil && !has {
+			removed = append(removed, containerInfo.Id)
+			reclaimed += size
+		}
+	}
+	return removed, reclaimed
+}
+
+// pruneMountPoints
+// @Description: 清理容器已经不存在的挂载点与读写层，释放这些容器对镜像层的引用，宽限期内新创建的不清理
+// @return []string 删除的目录
+// @return int64 释放的空间
+func pruneMountPoints() ([]string, int64) {
+	exists := make(map[string]bool)
+	for _, containerInfo := range allContainers() {
+		exists[containerInfo.Id] = true
+	}
+	var removed []string
+	var reclaimed int64
+	orphans := make(map[string]bool)
+	mntRoot := filepath.Join(ROOTURL, "mnt")
+	if entries, err := os.ReadDir(mntRoot); err == nil {
+		for _, entry := range entries {
+			if exists[entry.Name()] || recentWorkspace(entry.Name()) {
+				continue
+			}
+			mntUrl := filepath.Join(mntRoot, entry.Name())
+			if err := unmountAll(mntUrl); err != nil {
+				log.LogErrorFrom("pruneMountPoints", "unmountAll", err)
+				continue
+			}
+			if err := os.RemoveAll(mntUrl); err != nil {
+				log.LogErrorFrom("pruneMountPoints", "RemoveAll", err)
+				continue
+			}
+			orphans[entry.Name()] = true
+			removed = append(removed, mntUrl)
+		}
+	}
+	// 镜像层与读写层在同一个目录下，只处理读写层
+	diffRoot := filepath.Join(ROOTURL, "diff")
+	if entries, err := os.ReadDir(diffRoot); err == nil {
+		for _, entry := range entries {
+			cId := strings.TrimSuffix(entry.Name(), writeLayerSuffix)
+			if cId == entry.Name() || exists[cId] || recentWorkspace(cId) {
+				continue
+			}
+			writeLayer := filepath.Join(diffRoot, entry.Name())
+			size := utils.DirSize(writeLayer)
+			if err := os.RemoveAll(writeLayer); err != nil {
+				log.LogErrorFrom("pruneMountPoints", "RemoveAll", err)
+				continue
+			}
+			orphans[cId] = true
+			reclaimed += size
+			removed = append(removed, writeLayer)
+		}
+	}
+	for cId := range orphans {
+		if err := image.Release(cId); err != nil {
+			log.LogErrorFrom("pruneMountPoints", "Release", err)
+		}
+	}
+	return removed, reclaimed
+}
+
+// recentWorkspace
+// @Description: 容器的读写层或者挂载点是否在宽限期内创建或者修改过，读写层在挂载点之前创建
+// @param cId
+// @return bool
+func recentWorkspace(cId string) bool {
+	for _, path := range []string{
+		filepath.Join(ROOTURL, "diff", cId+writeLayerSuffix),
+		filepath.Join(ROOTURL, "mnt", cId),
+	} {
+		if info, err := os.Lstat(path); err == nil && time.Since(info.ModTime()) < workspaceGracePeriod {
+			return true
+		}
+	}
+	return false
+}
+
+// unmountAll 卸载path以及其中所有的挂载点(例如数据卷)，先卸载内层的挂载点
+// 避免删除目录时删除了数据卷在宿主机上的内容
+func unmountAll(path string) error {
+	content, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	var mounts []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && (fields[1] == path || strings.HasPrefix(fields[1], path+"/")) {
+			mounts = append(mounts, fields[1])
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i]) > len(mounts[j]) })
+	for _, mount := range mounts {
+		if err := unix.Unmount(mount, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			return fmt.Errorf(" umount %s: %v", mount, err)
+		}
+	}
+	return nil
+}
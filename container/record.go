@@ -13,6 +13,7 @@ import (
 	"text/tabwriter"
 	"time"
 	"xwj/mydocker/log"
+	"xwj/mydocker/network"
 	"xwj/mydocker/record"
 	"xwj/mydocker/utils"
 )
@@ -37,7 +38,7 @@ func RandStringContainerID(n int) string {
 }
 
 // RecordContainerInfo 记录一个容器的信息
-func RecordContainerInfo(id string, cPID int, commandArray []string, cName, volume string, port []string) (*record.ContainerInfo, error) {
+func RecordContainerInfo(id string, cPID int, commandArray []string, cName, volume, imageRef, imageID string, netCfg *record.NetworkConfig) (*record.ContainerInfo, error) {
 	// 以当前时间为容器的创建时间
 	createTime := time.Now().Format("2006-01-02 15:04:05")
 	// 如果用户没有指定容器名就用容器ID做为容器名
@@ -45,14 +46,16 @@ func RecordContainerInfo(id string, cPID int, commandArray []string, cName, volu
 		cName = id
 	}
 	containerInfo := record.ContainerInfo{
-		Pid:         strconv.Itoa(cPID),
-		Id:          id,
-		Name:        cName,
-		Command:     strings.Join(commandArray, ""),
-		Volume:      volume,
-		CreatedTime: createTime,
-		Status:      RUNNING,
-		PortMapping: port,
+		Pid:           strconv.Itoa(cPID),
+		Id:            id,
+		Name:          cName,
+		Command:       strings.Join(commandArray, ""),
+		Volume:        volume,
+		Image:         imageRef,
+		ImageID:       imageID,
+		CreatedTime:   createTime,
+		Status:        RUNNING,
+		NetworkConfig: *netCfg,
 	}
 	// 序列为json
 	jsonBytes, err := json.Marshal(containerInfo)
@@ -82,6 +85,16 @@ func RecordContainerInfo(id string, cPID int, commandArray []string, cName, volu
 	return &containerInfo, nil
 }
 
+// updateContainerInfo 将修改后的容器信息写回文件
+func updateContainerInfo(containerInfo *record.ContainerInfo) error {
+	jsonBytes, err := json.Marshal(containerInfo)
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(DefaultInfoLocation, containerInfo.Id, ConfigName)
+	return ioutil.WriteFile(configPath, jsonBytes, 0622)
+}
+
 // recordContainerLog 创建容器进程的日志文件并将其标准输出重定向到此文件
 func recordContainerLog(id string, cmdOut *io.Writer) {
 	dirUrl := filepath.Join(DefaultInfoLocation, id)
@@ -193,3 +206,64 @@ func LogContainer(containerId string) {
 		return
 	}
 }
+
+// containerInspect inspect命令输出的容器详细信息
+type containerInspect struct {
+	*record.ContainerInfo
+	Endpoint *network.Endpoint `json:"endpoint,omitempty"` // 容器的网络端点，包括地址与带宽限制
+}
+
+// InspectContainer 以json格式输出一个容器的详细信息
+func InspectContainer(containerID string) error {
+	containerInfo, err := getContainerByID(containerID)
+	if err != nil {
+		return err
+	}
+	inspect := containerInspect{ContainerInfo: containerInfo}
+	// 容器停止后网络端点已经删除
+	if containerInfo.Network != "" {
+		if ep, err := network.LoadEndpoint(containerInfo.Network, containerInfo.Id); err == nil {
+			inspect.Endpoint = ep
+		} else if !os.IsNotExist(err) {
+			log.LogErrorFrom("InspectContainer", "LoadEndpoint", err)
+		}
+	}
+	jsonBytes, err := json.MarshalIndent(inspect, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jsonBytes))
+	return nil
+}
+
+// ImagesInUse 获取所有容器使用的镜像，返回镜像ID到容器ID的映射
+func ImagesInUse() map[string][]string {
+	inUse := make(map[string][]string)
+	for _, containerInfo := range allContainers() {
+		if containerInfo.ImageID == "" {
+			continue
+		}
+		inUse[containerInfo.ImageID] = append(inUse[containerInfo.ImageID], containerInfo.Id)
+	}
+	return inUse
+}
+
+// allContainers 读取所有容器的信息，读取失败的容器被忽略
+func allContainers() []*record.ContainerInfo {
+	var containers []*record.ContainerInfo
+	files, err := ioutil.ReadDir(DefaultInfoLocation)
+	if err != nil {
+		return containers
+	}
+	for _, file := range files {
+		if file.Name() == "network" || !file.IsDir() {
+			continue
+		}
+		containerInfo, err := getContainerInfo(file)
+		if err != nil {
+			continue
+		}
+		containers = append(containers, containerInfo)
+	}
+	return containers
+}
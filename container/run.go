@@ -3,45 +3,106 @@ package container
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"xwj/mydocker/cgroups"
 	"xwj/mydocker/cgroups/subsystems"
+	"xwj/mydocker/image"
 	"xwj/mydocker/log"
 	"xwj/mydocker/network"
+	"xwj/mydocker/record"
 )
 
-// Run 运行容器
-func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, cgroupName string, volume, cName, ImageTarPath, cId string, EnvSlice, port []string, NetWorkName string){
+// Run 运行容器，cmdArray为空时使用镜像配置的命令
+func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, cgroupName string, volume, cName, imageRef, cId string, EnvSlice []string, netCfg *record.NetworkConfig){
+	// 从镜像存储中获取镜像，兼容旧版本的镜像tar包路径
+	img, err := image.Resolve(imageRef)
+	if err != nil {
+		log.LogErrorFrom("Run", "Resolve", err)
+		return
+	}
+	// 镜像配置的Entrypoint、Cmd、Env作为默认值，用户的命令替换Cmd，用户的环境变量覆盖镜像的环境变量
+	cmdArray = img.Command(cmdArray)
+	if len(cmdArray) == 0 {
+		log.LogErrorFrom("Run", "Command", fmt.Errorf(" no command specified and image %s has no default command", imageRef))
+		return
+	}
+	EnvSlice = append(append([]string{}, img.Config.Config.Env...), EnvSlice...)
+	// 镜像EXPOSE的端口与--expose指定的端口一起由-P发布
+	netCfg.Expose = append(img.ExposedPorts(), netCfg.Expose...)
+	parent, containerInfo, containerCM, err := startContainer(tty, cmdArray, res, cgroupName, volume, cName, imageRef, img, cId, EnvSlice, netCfg)
+	if err != nil {
+		log.LogErrorFrom("Run", "startContainer", err)
+		return
+	}
+	// 等待结束
+	if tty {
+		// 如果是detach模式的话就父进程不需要等待子进程结束，而是启动子进程后自行结束就可以了
+		if err := parent.Wait(); err != nil {
+			log.Log.Error(err)
+		}
+		containerCM.Destroy()
+		// 断开容器的网络连接
+		disconnectNetwork(containerInfo)
+		// 删除设置的AUFS工作目录
+		mntUrl := filepath.Join(ROOTURL, "mnt", cId)
+		DeleteWorkSpace(ROOTURL, mntUrl, volume, cId)
+		DeleteContainerInfo(containerInfo.Pid)
+		os.Exit(1)
+	}else {
+		// 返回容器的ID
+		fmt.Printf("\033[1;32;40m%s\033[0m\n", "[" + cId + "]")
+	}
+}
+
+// startContainer
+// @Description: 创建容器的工作空间并启动容器进程，记录容器信息、连接网络、发送命令并加入cgroup，不等待容器结束
+// @param cmdArray 容器进程最终执行的命令
+// @param img 容器使用的镜像
+// @param EnvSlice 容器进程最终的环境变量
+// @return *exec.Cmd 容器进程
+// @return *record.ContainerInfo
+// @return *cgroups.CgroupManager
+// @return error
+func startContainer(tty bool, cmdArray []string, res *subsystems.ResourceConfig, cgroupName string, volume, cName, imageRef string,
+	img *image.Image, cId string, EnvSlice []string, netCfg *record.NetworkConfig) (*exec.Cmd, *record.ContainerInfo, *cgroups.CgroupManager, error) {
+	// 记录容器对镜像各层的引用，缺失的层在这里重新解压
+	if err := image.Acquire(cId, img); err != nil {
+		return nil, nil, nil, err
+	}
 	// 获取到管道写端
-	parent, pipeWriter := NewParentProcess(tty, volume, ImageTarPath, cId, EnvSlice)
+	parent, pipeWriter := NewParentProcess(tty, volume, img.LayerPaths(), cId, EnvSlice, img.Config.Config.WorkingDir, img.Config.Config.User)
 	if parent == nil {
-		log.LogErrorFrom("Run", "NewParentProcess", fmt.Errorf(" parent process is nil"))
-		return
+		return nil, nil, nil, fmt.Errorf(" parent process is nil")
 	}
 	// 执行命令但是并不等待其结束
 	// 执行后会clone出一个namespace隔离的进程，然后在子进程中调用/proc/self/exe即自己，
 	// 发送init参数调用init方法初始化一些资源
 	if err := parent.Start(); err != nil {
-		log.Log.Error(err)
+		return nil, nil, nil, err
 	}
 	// 记录容器信息
-	containerInfo, err := RecordContainerInfo(cId, parent.Process.Pid, cmdArray, cName, volume, port)
+	containerInfo, err := RecordContainerInfo(cId, parent.Process.Pid, cmdArray, cName, volume, imageRef, img.ID, netCfg)
 	if err != nil {
-		log.LogErrorFrom("Run", "recordContainerInfo", err)
-		return
+		cleanupFailedStart(parent, pipeWriter, volume, cId)
+		return nil, nil, nil, fmt.Errorf(" record container info: %v", err)
 	}
 	// 如果需要则连接网络
-	if NetWorkName != "" {
+	if netCfg.Network != "" {
 		// 初始化网络
 		if err := network.Init(); err != nil {
-			log.Log.Error(err)
-			return
+			cleanupFailedStart(parent, pipeWriter, volume, cId)
+			return nil, nil, nil, err
 		}
 		// 将容器连接到目标网络
-		if err := network.Connect(NetWorkName, containerInfo); err != nil {
-			log.Log.Errorf("Error Connect Network %v", err)
-			return
+		if err := network.Connect(netCfg.Network, containerInfo); err != nil {
+			cleanupFailedStart(parent, pipeWriter, volume, cId)
+			return nil, nil, nil, fmt.Errorf(" Connect Network %v", err)
+		}
+		// 保存网络连接后确定下来的端口映射
+		if err := updateContainerInfo(containerInfo); err != nil {
+			log.LogErrorFrom("startContainer", "updateContainerInfo", err)
 		}
 	}
 	// 发送用户的命令
@@ -52,21 +113,27 @@ func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, cgroupName
 	containerCM.Set(res)
 	// 将容器进程加入到各个子系统中
 	containerCM.Apply(parent.Process.Pid)
-	// 等待结束
-	if tty {
-		// 如果是detach模式的话就父进程不需要等待子进程结束，而是启动子进程后自行结束就可以了
-		if err := parent.Wait(); err != nil {
-			log.Log.Error(err)
-		}
-		containerCM.Destroy()
-		// 删除设置的AUFS工作目录
-		mntUrl := filepath.Join(ROOTURL, "mnt", cId)
-		DeleteWorkSpace(ROOTURL, mntUrl, volume, cId)
-		DeleteContainerInfo(containerInfo.Pid)
-		os.Exit(1)
-	}else {
-		// 返回容器的ID
-		fmt.Printf("\033[1;32;40m%s\033[0m\n", "[" + cId + "]")
+	return parent, containerInfo, containerCM, nil
+}
+
+// cleanupFailedStart
+// @Description: 容器进程启动后记录容器信息或者连接网络失败时，结束容器进程并删除工作空间、容器信息以及对镜像层的引用
+// @param parent 容器进程
+// @param pipeWriter 发送命令的管道写端
+// @param volume
+// @param cId
+func cleanupFailedStart(parent *exec.Cmd, pipeWriter *os.File, volume, cId string) {
+	pipeWriter.Close()
+	if err := parent.Process.Kill(); err != nil {
+		log.LogErrorFrom("cleanupFailedStart", "Kill", err)
+	}
+	// 回收容器进程，之后才能卸载挂载点
+	_ = parent.Wait()
+	mntUrl := filepath.Join(ROOTURL, "mnt", cId)
+	DeleteWorkSpace(ROOTURL, mntUrl, volume, cId)
+	DeleteContainerInfo(cId)
+	if err := image.Release(cId); err != nil {
+		log.LogErrorFrom("cleanupFailedStart", "Release", err)
 	}
 }
 
@@ -75,9 +142,8 @@ func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, cgroupName
 // @param cmdArray
 // @param pipeWriter
 func sendUserCommand(cmdArray []string, pipeWriter *os.File) {
-	command := strings.Join(cmdArray, " ")
-	log.Log.Infof("First execute cmd is %s", command)
-	if _, err := pipeWriter.WriteString(command); err != nil {
+	log.Log.Infof("First execute cmd is %s", strings.Join(cmdArray, " "))
+	if _, err := pipeWriter.WriteString(strings.Join(cmdArray, "\x00")); err != nil {
 		log.LogErrorFrom("sendUserCommand", "WriteString", err)
 		return
 	}
@@ -0,0 +1,124 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// execUser 容器进程运行时的用户
+type execUser struct {
+	Uid    int
+	Gid    int
+	Groups []int
+}
+
+// lookupUser 在容器的/etc/passwd与/etc/group中解析user[:group]，用户与组都可以是名称或者数字ID
+// 需要在pivot_root之后调用
+func lookupUser(spec string) (*execUser, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+	passwd, _ := readColonFile("/etc/passwd")
+	groups, _ := readColonFile("/etc/group")
+	u := &execUser{}
+	userName := ""
+	found := false
+	for _, entry := range passwd {
+		if len(entry) < 4 || (entry[0] != userSpec && entry[2] != userSpec) {
+			continue
+		}
+		uid, err1 := strconv.Atoi(entry[2])
+		gid, err2 := strconv.Atoi(entry[3])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		u.Uid, u.Gid, userName, found = uid, gid, entry[0], true
+		break
+	}
+	if !found {
+		uid, err := strconv.Atoi(userSpec)
+		if err != nil {
+			return nil, fmt.Errorf(" unable to find user %s: no matching entries in passwd file", userSpec)
+		}
+		u.Uid, u.Gid = uid, uid
+	}
+	if groupSpec != "" {
+		found = false
+		for _, entry := range groups {
+			if len(entry) < 3 || (entry[0] != groupSpec && entry[2] != groupSpec) {
+				continue
+			}
+			if gid, err := strconv.Atoi(entry[2]); err == nil {
+				u.Gid, found = gid, true
+				break
+			}
+		}
+		if !found {
+			gid, err := strconv.Atoi(groupSpec)
+			if err != nil {
+				return nil, fmt.Errorf(" unable to find group %s: no matching entries in group file", groupSpec)
+			}
+			u.Gid = gid
+		}
+		return u, nil
+	}
+	// 没有指定组时加上用户所属的附加组
+	if userName != "" {
+		for _, entry := range groups {
+			if len(entry) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(entry[3], ",") {
+				if member != userName {
+					continue
+				}
+				if gid, err := strconv.Atoi(entry[2]); err == nil && gid != u.Gid {
+					u.Groups = append(u.Groups, gid)
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// readColonFile 读取以冒号分隔的/etc/passwd、/etc/group格式的文件
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
+
+// setUser 切换容器进程的用户，先设置组再设置用户，否则没有权限修改组
+func setUser(spec string) error {
+	u, err := lookupUser(spec)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Setgroups(u.Groups); err != nil {
+		return fmt.Errorf(" setgroups: %v", err)
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf(" setgid: %v", err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf(" setuid: %v", err)
+	}
+	return nil
+}
@@ -2,28 +2,26 @@ package container
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"xwj/mydocker/image"
 	"xwj/mydocker/log"
+	"xwj/mydocker/record"
 	"xwj/mydocker/utils"
 )
 
 // NewWorkSpace
 // @Description: 创建新的文件工作空间
 // @param rootURL
+// @param layers 镜像各层的只读目录，从最上层开始
 // @param mntURL
 // @param volume 是否使用数据卷
-func NewWorkSpace(rootURL, ImageTarPath, mntURL, volume, cId string) {
-	// 验证tar包路径的合法性并返回镜像包名称
-	imageName := VerifyImageTar(ImageTarPath)
-	if imageName == "" {
-		return
-	}
-	CreateReadOnlyLayer(rootURL, ImageTarPath, imageName)      // 创建init只读层
+func NewWorkSpace(rootURL string, layers []string, mntURL, volume, cId string) {
 	CreateWriteLayer(rootURL, cId)                    			// 创建读写层
-	CreateMountPoint(rootURL, imageName, mntURL, cId) 			// 创建mnt文件夹并挂载
+	CreateMountPoint(rootURL, layers, mntURL, cId) 			// 创建mnt文件夹并挂载
 	if volume != "" {
 		// 数据卷操作
 		volumeUrls, err := volumeUrlExtract(volume)
@@ -88,43 +86,6 @@ func MountVolume(mntUrl string, volumeUrl []string)  {
 }
 
 
-// CreateReadOnlyLayer
-// @Description: 通过镜像的压缩包解压并创建镜像文件夹作为只读层
-// @param rootURL
-// @param ImageTarPath
-func CreateReadOnlyLayer(rootURL, ImageTarPath, imageName string) {
-	imageDir := filepath.Join(rootURL, "diff", imageName)
-	if has, err := utils.DirOrFileExist(imageDir); err == nil && !has {
-		// 如果不存在就循环的创建文件夹
-		if err := os.MkdirAll(imageDir, 0777); err != nil {
-			log.LogErrorFrom("createReadOnlyLayer", "Mkdir", err)
-		}
-	}
-	if _, err := exec.Command("tar", "-xvf", ImageTarPath, "-C", imageDir).CombinedOutput(); err != nil {
-		log.LogErrorFrom("createReadOnlyLayer", "tar", err)
-	}
-}
-
-// VerifyImageTar
-// @Description:  验证tar包路径的合法性并返回镜像包名称
-// @param ImageTarPath
-// @return string
-func VerifyImageTar(ImageTarPath string) string {
-	if has, err := utils.DirOrFileExist(ImageTarPath); err != nil {
-		log.LogErrorFrom("VerifyImageTar", "dirOrFileExist", err)
-		return ""
-	}else if err == nil && !has {
-		log.LogErrorFrom("VerifyImageTar", "dirOrFileExist", fmt.Errorf(" Not found this image tar!"))
-		return ""
-	}
-	paths := strings.Split(ImageTarPath, "/")
-	tarFileName := paths[len(paths)-1]
-	if !strings.HasSuffix(tarFileName, "tar") {
-		log.LogErrorFrom("VerifyImageTar", "HasPrefix", fmt.Errorf(" not a tar file!"))
-	}
-	return strings.Split(tarFileName, ".")[0]
-}
-
 // CreateWriteLayer
 // @Description: 创建读写层
 // @param rootURL
@@ -143,9 +104,9 @@ func CreateWriteLayer(rootURL, cId string) {
 // CreateMountPoint
 // @Description: 挂载到容器目录mnt
 // @param rootURL
-// @param imageName
+// @param layers 镜像各层的只读目录，从最上层开始
 // @param mntURL
-func CreateMountPoint(rootURL, imageName, mntURL, cId string) {
+func CreateMountPoint(rootURL string, layers []string, mntURL, cId string) {
 	if has, err := utils.DirOrFileExist(mntURL); err == nil && has {
 		log.Log.Info("mnt dir already exist. Delete and create new one.")
 		DeleteMountPoint(mntURL)
@@ -153,10 +114,13 @@ func CreateMountPoint(rootURL, imageName, mntURL, cId string) {
 	if err := os.MkdirAll(mntURL, 0777); err != nil {
 		log.LogErrorFrom("CreateMountPoint", "Mkdir", err)
 	}
-	// 将读写层目录与镜像只读层目录mount到mnt目录下
+	// 将读写层目录与镜像的只读层目录mount到mnt目录下，第一个分支可写，其余的分支只读
+	// 只读分支使用ro+wh，层中的whiteout文件会隐藏下层被删除的文件
 	writerPath := filepath.Join(rootURL, "diff", cId + "_writeLayer")
-	imageDir := filepath.Join(rootURL, "diff", imageName)
-	dirs := "dirs=" + writerPath + ":" + imageDir
+	dirs := "dirs=" + writerPath
+	for _, layer := range layers {
+		dirs += ":" + layer + "=ro+wh"
+	}
 	cmd := exec.Command("mount", "-t", "aufs", "-o", dirs, "mnt_" + cId[:4], mntURL)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -184,6 +148,10 @@ func DeleteWorkSpace(rootURL, mntURL, volume, cId string) {
 		DeleteMountPoint(mntURL)
 	}
 	DeleteWriteLayer(rootURL, cId)
+	// 释放容器对镜像层的引用
+	if err := image.Release(cId); err != nil {
+		log.LogErrorFrom("DeleteWorkSpace", "Release", err)
+	}
 }
 
 // DeleteMountPoint
@@ -228,3 +196,51 @@ func DeleteMountPointWithVolume(mntURL string, volumeUrls []string)  {
 	}
 	DeleteMountPoint(mntURL)
 }
+
+// containerRootfs
+// @Description: 获取容器合并后的根文件系统，容器停止后挂载点已经卸载时临时重新挂载
+// @param containerInfo
+// @return string 根文件系统的路径
+// @return func() 使用完后的清理函数，临时挂载时会卸载挂载点
+// @return error
+func containerRootfs(containerInfo *record.ContainerInfo) (string, func(), error) {
+	mntUrl := filepath.Join(ROOTURL, "mnt", containerInfo.Id)
+	if isMountPoint(mntUrl) {
+		return mntUrl, func() {}, nil
+	}
+	writeLayer := filepath.Join(ROOTURL, "diff", containerInfo.Id+"_writeLayer")
+	if has, err := utils.DirOrFileExist(writeLayer); err != nil || !has {
+		return "", nil, fmt.Errorf(" container %s has no write layer", containerInfo.Id)
+	}
+	if containerInfo.ImageID == "" {
+		return "", nil, fmt.Errorf(" container %s is not created from an image in the image store", containerInfo.Id)
+	}
+	img, err := image.Get(containerInfo.ImageID)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := image.Acquire(containerInfo.Id, img); err != nil {
+		return "", nil, err
+	}
+	CreateMountPoint(ROOTURL, img.LayerPaths(), mntUrl, containerInfo.Id)
+	if !isMountPoint(mntUrl) {
+		return "", nil, fmt.Errorf(" mount the filesystem of container %s failed", containerInfo.Id)
+	}
+	return mntUrl, func() { DeleteMountPoint(mntUrl) }, nil
+}
+
+// isMountPoint 判断目录是否为挂载点
+func isMountPoint(path string) bool {
+	content, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,340 @@
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"xwj/mydocker/utils"
+)
+
+// OCI image-layout中镜像名的注解
+const (
+	annotationRefName       = "org.opencontainers.image.ref.name"
+	annotationContainerdRef = "io.containerd.image.name"
+)
+
+// dockerManifestEntry docker save生成的manifest.json中的一项
+type dockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Index OCI image-layout的index.json
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []IndexDescriptor `json:"manifests"`
+}
+
+// IndexDescriptor index中指向manifest的描述，多平台镜像带有平台信息
+type IndexDescriptor struct {
+	Descriptor
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// Platform 镜像的平台
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// archiveFormat 识别镜像tar包的格式：docker save生成的docker-archive、OCI image-layout，否则是根文件系统的tar包
+func archiveFormat(tarPath string) (string, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, _, err := decompress(f)
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(r)
+	format := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch filepath.Clean("/" + hdr.Name) {
+		case "/manifest.json":
+			// 新版本的docker save同时包含manifest.json与OCI image-layout，优先使用manifest.json
+			return formatDockerArchive, nil
+		case "/oci-layout":
+			format = formatOCI
+		}
+	}
+	return format, nil
+}
+
+// loadArchive 加载docker-archive或者OCI image-layout格式的镜像包，包中可以有多个镜像
+// ref不为空时作为第一个镜像额外的name:tag
+func loadArchive(tarPath, format, ref string) ([]*Image, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, _, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	// 先把镜像包解压到临时目录中，再按照manifest依次导入每一层
+	tmpRoot := filepath.Join(store.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(tmpRoot, "load-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractTar(r, dir); err != nil {
+		return nil, err
+	}
+	var images []*Image
+	if format == formatDockerArchive {
+		images, err = loadDockerArchive(dir)
+	} else {
+		images, err = loadOCILayout(dir, strings.Split(filepath.Base(tarPath), ".")[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf(" no image found in %s", tarPath)
+	}
+	if ref != "" {
+		if err := Tag(images[0].ID, ref); err != nil {
+			return nil, err
+		}
+		if images[0], err = store.Get(images[0].ID); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// loadDockerArchive 按照manifest.json导入docker save生成的镜像
+func loadDockerArchive(dir string) ([]*Image, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []dockerManifestEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf(" invalid manifest.json: %v", err)
+	}
+	var images []*Image
+	for _, entry := range entries {
+		configPath, err := utils.SecureJoin(dir, entry.Config)
+		if err != nil {
+			return nil, err
+		}
+		var layerPaths []string
+		for _, layer := range entry.Layers {
+			layerPath, err := utils.SecureJoin(dir, layer)
+			if err != nil {
+				return nil, err
+			}
+			layerPaths = append(layerPaths, layerPath)
+		}
+		var refs []string
+		for _, tag := range entry.RepoTags {
+			if ref, err := ParseReference(tag); err == nil {
+				refs = append(refs, ref)
+			}
+		}
+		img, err := importImage(configPath, layerPaths, refs)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// loadOCILayout 按照index.json导入OCI image-layout中的镜像，多平台的镜像只导入当前平台
+// 注解中只有tag的镜像使用defaultName作为镜像名
+func loadOCILayout(dir, defaultName string) ([]*Image, error) {
+	index := &Index{}
+	if err := readLayoutJSON(dir, "index.json", index); err != nil {
+		return nil, err
+	}
+	var images []*Image
+	for _, desc := range index.Manifests {
+		manifestDesc, err := selectPlatform(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		manifest := &Manifest{}
+		if err := readLayoutJSON(dir, layoutBlob(manifestDesc.Digest), manifest); err != nil {
+			return nil, err
+		}
+		configPath, err := utils.SecureJoin(dir, layoutBlob(manifest.Config.Digest))
+		if err != nil {
+			return nil, err
+		}
+		var layerPaths []string
+		for _, layer := range manifest.Layers {
+			layerPath, err := utils.SecureJoin(dir, layoutBlob(layer.Digest))
+			if err != nil {
+				return nil, err
+			}
+			layerPaths = append(layerPaths, layerPath)
+		}
+		var refs []string
+		if ref := ociRefName(desc.Annotations, defaultName); ref != "" {
+			refs = append(refs, ref)
+		}
+		img, err := importImage(configPath, layerPaths, refs)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// selectPlatform 如果描述指向的是多平台的index，选出当前平台的manifest
+func selectPlatform(dir string, desc IndexDescriptor) (IndexDescriptor, error) {
+	for desc.MediaType == MediaTypeImageIndex || desc.MediaType == MediaTypeDockerManifestList {
+		index := &Index{}
+		if err := readLayoutJSON(dir, layoutBlob(desc.Digest), index); err != nil {
+			return desc, err
+		}
+		annotations := desc.Annotations
+		var err error
+		if desc, err = pickPlatform(index); err != nil {
+			return desc, err
+		}
+		// 镜像名的注解在外层的描述上
+		if desc.Annotations == nil {
+			desc.Annotations = annotations
+		}
+	}
+	return desc, nil
+}
+
+// pickPlatform 从多平台的index中选出linux/当前架构的manifest，没有时使用第一个
+func pickPlatform(index *Index) (IndexDescriptor, error) {
+	if len(index.Manifests) == 0 {
+		return IndexDescriptor{}, fmt.Errorf(" image index is empty")
+	}
+	for _, m := range index.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return m, nil
+		}
+	}
+	return index.Manifests[0], nil
+}
+
+// ociRefName 从注解中获取镜像的name:tag
+func ociRefName(annotations map[string]string, defaultName string) string {
+	if name, err := ParseReference(annotations[annotationContainerdRef]); err == nil {
+		return name
+	}
+	refName := annotations[annotationRefName]
+	if refName == "" {
+		return ""
+	}
+	// ref.name只有tag时加上默认的镜像名
+	if tagRegexp.MatchString(refName) && !strings.Contains(refName, ":") {
+		if name, err := ParseReference(defaultName + ":" + refName); err == nil {
+			return name
+		}
+	}
+	if name, err := ParseReference(refName); err == nil {
+		return name
+	}
+	return ""
+}
+
+// layoutBlob blob在OCI image-layout中的路径
+func layoutBlob(digest string) string {
+	return filepath.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// readLayoutJSON 读取镜像包中的json文件
+func readLayoutJSON(dir, name string, v interface{}) error {
+	path, err := utils.SecureJoin(dir, name)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf(" invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// importImage 将镜像配置与各层的tar包导入镜像存储
+func importImage(configPath string, layerPaths []string, refs []string) (*Image, error) {
+	configDigest, configSize, err := putFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var layers []Descriptor
+	for _, layerPath := range layerPaths {
+		blobDigest, size, err := putFile(layerPath)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, Descriptor{Digest: blobDigest, Size: size})
+	}
+	return store.addImageFromBlobs(Descriptor{Digest: configDigest, Size: configSize}, layers, refs)
+}
+
+// addImageFromBlobs 根据已经在blob存储中的配置与层生成镜像，层按照配置中的diff_id校验后解压
+func (s *Store) addImageFromBlobs(configDesc Descriptor, layers []Descriptor, refs []string) (*Image, error) {
+	config := &Config{}
+	if err := s.readJSON(configDesc.Digest, config); err != nil {
+		return nil, err
+	}
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return nil, fmt.Errorf(" image config has %d layers, but the manifest has %d", len(config.RootFS.DiffIDs), len(layers))
+	}
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        Descriptor{MediaType: MediaTypeConfig, Digest: configDesc.Digest, Size: configDesc.Size},
+	}
+	for i, layer := range layers {
+		if _, err := s.unpackLayer(layer.Digest, config.RootFS.DiffIDs[i]); err != nil {
+			return nil, err
+		}
+		mediaType := MediaTypeLayer
+		if layer.Digest != config.RootFS.DiffIDs[i] {
+			mediaType = MediaTypeLayerGzip
+		}
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: mediaType, Digest: layer.Digest, Size: layer.Size})
+	}
+	id, err := s.addImage(manifest, refs...)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+// putFile 将文件写入blob存储
+func putFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return store.putBlob(f)
+}
@@ -0,0 +1,38 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+var errCacheMiss = errors.New(" build cache miss")
+
+// cacheKey 构建缓存的key：父镜像ID加上指令，COPY/ADD的指令中还包含源文件内容的摘要
+func cacheKey(parentID, instruction string) string {
+	sum := sha256.Sum256([]byte(parentID + "\n" + instruction))
+	return hex.EncodeToString(sum[:])
+}
+
+// CacheGet 查找在父镜像上执行过相同指令得到的镜像
+func CacheGet(parentID, instruction string) (*Image, bool) {
+	var img *Image
+	err := store.view(func() error {
+		id, ok := store.Cache[cacheKey(parentID, instruction)]
+		if !ok {
+			return errCacheMiss
+		}
+		var err error
+		img, err = store.image(id)
+		return err
+	})
+	return img, err == nil
+}
+
+// CachePut 记录在父镜像上执行指令得到的镜像
+func CachePut(parentID, instruction, id string) error {
+	return store.update(func() error {
+		store.Cache[cacheKey(parentID, instruction)] = id
+		return nil
+	})
+}
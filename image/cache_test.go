@@ -0,0 +1,30 @@
+package image
+
+import "testing"
+
+// 缓存只在父镜像与指令都相同时命中
+func TestBuildCache(t *testing.T) {
+	useTempStore(t)
+	img, err := Commit("", "", "", &CommitOptions{Changes: []string{"CMD echo hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := CacheGet("", "CMD echo hi"); ok {
+		t.Fatal("CacheGet before CachePut, want miss")
+	}
+	if err := CachePut("", "CMD echo hi", img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := CacheGet("", "CMD echo hi"); !ok || got.ID != img.ID {
+		t.Fatalf("CacheGet = %v, %v, want %s", got, ok, img.ID)
+	}
+	for _, miss := range [][2]string{{"", "CMD echo bye"}, {img.ID, "CMD echo hi"}, {"", "CMD echo hi (keep cmd)"}} {
+		if _, ok := CacheGet(miss[0], miss[1]); ok {
+			t.Errorf("CacheGet(%q, %q) hit, want miss", miss[0], miss[1])
+		}
+	}
+	// 父镜像ID与指令的拼接不会产生相同的key
+	if cacheKey("a", "b c") == cacheKey("a b", "c") {
+		t.Error("cacheKey(a, b c) == cacheKey(a b, c)")
+	}
+}
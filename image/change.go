@@ -0,0 +1,161 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ApplyChange 将Dockerfile格式的一条配置指令应用到镜像配置上，
+// 支持ENV、CMD、ENTRYPOINT、WORKDIR、USER、EXPOSE与LABEL
+func ApplyChange(cfg *ContainerConfig, change string) error {
+	instruction, args := SplitInstruction(change)
+	if args == "" {
+		return fmt.Errorf(" %s requires at least one argument", instruction)
+	}
+	switch instruction {
+	case "ENV":
+		pairs, err := parseKeyValues(args)
+		if err != nil {
+			return err
+		}
+		for _, kv := range pairs {
+			cfg.Env = setEnv(cfg.Env, kv[0], kv[1])
+		}
+	case "LABEL":
+		pairs, err := parseKeyValues(args)
+		if err != nil {
+			return err
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for _, kv := range pairs {
+			cfg.Labels[kv[0]] = kv[1]
+		}
+	case "CMD":
+		cfg.Cmd = ParseCommand(args)
+	case "ENTRYPOINT":
+		cfg.Entrypoint = ParseCommand(args)
+		// 与docker相同，修改ENTRYPOINT会清空之前的CMD，构建时只清空从父镜像继承的CMD(见CommitOptions.KeepCmd)
+		cfg.Cmd = nil
+	case "WORKDIR":
+		if !path.IsAbs(args) {
+			args = path.Join("/", cfg.WorkingDir, args)
+		}
+		cfg.WorkingDir = path.Clean(args)
+	case "USER":
+		cfg.User = args
+	case "EXPOSE":
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			cfg.ExposedPorts[port] = struct{}{}
+		}
+	default:
+		return fmt.Errorf(" unsupported change instruction: %s", instruction)
+	}
+	return nil
+}
+
+// SplitInstruction 将一行指令分为大写的指令名与参数
+func SplitInstruction(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return strings.ToUpper(line), ""
+	}
+	return strings.ToUpper(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// ParseCommand 解析exec格式(json数组)或shell格式的命令，shell格式使用/bin/sh -c执行
+func ParseCommand(args string) []string {
+	var cmd []string
+	if strings.HasPrefix(args, "[") && json.Unmarshal([]byte(args), &cmd) == nil {
+		return cmd
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// parseKeyValues 解析key=value形式的多个键值对，值可以用引号包含空格；
+// 也兼容只有一个键值对的旧格式key value
+func parseKeyValues(args string) ([][2]string, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) > 0 && !strings.Contains(words[0], "=") {
+		fields := strings.SplitN(args, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf(" %s must have two arguments", args)
+		}
+		return [][2]string{{fields[0], strings.TrimSpace(fields[1])}}, nil
+	}
+	var pairs [][2]string
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf(" invalid key=value: %s", word)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// splitWords 按空白分割参数，支持单引号、双引号与反斜杠转义
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf(" unmatched quote in %s", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// setEnv 设置环境变量，已经存在时替换
+func setEnv(env []string, key, value string) []string {
+	for i, kv := range env {
+		if strings.SplitN(kv, "=", 2)[0] == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
@@ -0,0 +1,95 @@
+package image
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyChange(t *testing.T) {
+	base := func() *ContainerConfig {
+		return &ContainerConfig{
+			Env:        []string{"PATH=/usr/bin", "A=old"},
+			Cmd:        []string{"sh"},
+			WorkingDir: "/app",
+		}
+	}
+	tests := []struct {
+		change string
+		check  func(cfg *ContainerConfig) bool
+		err    bool
+	}{
+		{change: "ENV A=1 B=\"two words\"", check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Env, []string{"PATH=/usr/bin", "A=1", "B=two words"})
+		}},
+		{change: "env B hello world", check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Env, []string{"PATH=/usr/bin", "A=old", "B=hello world"})
+		}},
+		{change: "LABEL version=1.0 \"maintainer\"=me", check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Labels, map[string]string{"version": "1.0", "maintainer": "me"})
+		}},
+		// exec格式与shell格式
+		{change: `CMD ["echo", "hi"]`, check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Cmd, []string{"echo", "hi"})
+		}},
+		{change: "CMD echo $HOME", check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Cmd, []string{"/bin/sh", "-c", "echo $HOME"})
+		}},
+		{change: `CMD [echo hi]`, check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Cmd, []string{"/bin/sh", "-c", "[echo hi]"})
+		}},
+		// 修改ENTRYPOINT时清空CMD
+		{change: `ENTRYPOINT ["/entry.sh"]`, check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.Entrypoint, []string{"/entry.sh"}) && cfg.Cmd == nil
+		}},
+		{change: "WORKDIR sub/../src", check: func(cfg *ContainerConfig) bool { return cfg.WorkingDir == "/app/src" }},
+		{change: "WORKDIR /srv/", check: func(cfg *ContainerConfig) bool { return cfg.WorkingDir == "/srv" }},
+		{change: "USER app:app", check: func(cfg *ContainerConfig) bool { return cfg.User == "app:app" }},
+		{change: "EXPOSE 80 53/udp", check: func(cfg *ContainerConfig) bool {
+			return reflect.DeepEqual(cfg.ExposedPorts, map[string]struct{}{"80/tcp": {}, "53/udp": {}})
+		}},
+		{change: "ENV", err: true},
+		{change: "ENV A=1 =2", err: true},
+		{change: "ENV A=\"unterminated", err: true},
+		{change: "RUN echo hi", err: true},
+		{change: "VOLUME /data", err: true},
+	}
+	for _, tt := range tests {
+		cfg := base()
+		err := ApplyChange(cfg, tt.change)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ApplyChange(%q) = nil, want error", tt.change)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ApplyChange(%q): %v", tt.change, err)
+			continue
+		}
+		if !tt.check(cfg) {
+			t.Errorf("ApplyChange(%q) = %+v", tt.change, cfg)
+		}
+	}
+}
+
+// 构建时ENTRYPOINT保留当前阶段设置的CMD，commit --change时清空CMD
+func TestCommitEntrypointKeepCmd(t *testing.T) {
+	useTempStore(t)
+	parent, err := Commit("", "", "", &CommitOptions{Changes: []string{"CMD [\"sh\"]"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keepCmd := range []bool{false, true} {
+		img, err := Commit(parent.ID, "", "", &CommitOptions{Changes: []string{"ENTRYPOINT [\"/entry.sh\"]"}, KeepCmd: keepCmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		if keepCmd {
+			want = []string{"sh"}
+		}
+		if got := img.Config.Config.Cmd; !reflect.DeepEqual(got, want) {
+			t.Errorf("KeepCmd=%v: Cmd = %q, want %q", keepCmd, got, want)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CommitOptions 提交新镜像时的附加信息
+type CommitOptions struct {
+	Author    string   // 镜像作者
+	Message   string   // 提交说明，记录在历史中
+	CreatedBy string   // 生成这一层的命令，记录在历史中
+	Changes   []string // 应用到镜像配置上的Dockerfile指令
+	KeepCmd   bool     // ENTRYPOINT不清空CMD，构建时CMD已经在当前阶段中设置
+}
+
+// Commit 将layerDir中的文件作为新的一层叠加到父镜像之上生成新镜像，ref不为空时作为新镜像的name:tag
+// layerDir为空时只修改镜像配置，不增加层；parentRef为空时没有父镜像
+func Commit(parentRef, layerDir, ref string, opts *CommitOptions) (*Image, error) {
+	// 写入的内容在加入镜像记录之前由lease保护，不会被同时进行的清理删除
+	release, err := store.acquireLease()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var refs []string
+	if ref != "" {
+		name, err := ParseReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, name)
+	}
+	// 父镜像为空时从空的根文件系统开始(FROM scratch)
+	parent := &Image{
+		Manifest: &Manifest{},
+		Config:   &Config{Architecture: runtime.GOARCH, OS: "linux", RootFS: RootFS{Type: "layers"}},
+	}
+	if parentRef != "" {
+		var err error
+		if parent, err = store.Get(parentRef); err != nil {
+			return nil, err
+		}
+	}
+	// 深拷贝父镜像的配置，避免修改影响到父镜像
+	config := &Config{}
+	content, err := json.Marshal(parent.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	for _, change := range opts.Changes {
+		cmd := config.Config.Cmd
+		if err := ApplyChange(&config.Config, change); err != nil {
+			return nil, err
+		}
+		if instruction, _ := SplitInstruction(change); opts.KeepCmd && instruction == "ENTRYPOINT" {
+			config.Config.Cmd = cmd
+		}
+	}
+	created := time.Now().UTC()
+	config.Created = &created
+	if opts.Author != "" {
+		config.Author = opts.Author
+	}
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Layers:        append([]Descriptor{}, parent.Manifest.Layers...),
+	}
+	if layerDir != "" {
+		layer, diffID, err := store.putLayer(layerDir)
+		if err != nil {
+			return nil, err
+		}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	config.History = append(config.History, History{
+		Created:    &created,
+		CreatedBy:  opts.CreatedBy,
+		Author:     opts.Author,
+		Comment:    opts.Message,
+		EmptyLayer: layerDir == "",
+	})
+	configDigest, configSize, err := store.putJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Config = Descriptor{MediaType: MediaTypeConfig, Digest: configDigest, Size: configSize}
+	id, err := store.addImage(manifest, refs...)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(id)
+}
+
+// putLayer 将目录打包为gzip压缩的层写入blob存储并解压到层目录，返回层的描述与diff_id
+func (s *Store) putLayer(dir string) (Descriptor, string, error) {
+	tmpRoot := filepath.Join(s.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return Descriptor{}, "", err
+	}
+	tmp, err := ioutil.TempFile(tmpRoot, "layer-")
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// 一次打包同时计算未压缩内容的diff_id
+	hash := sha256.New()
+	gz := gzip.NewWriter(tmp)
+	if err := tarLayer(io.MultiWriter(hash, gz), dir); err != nil {
+		return Descriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return Descriptor{}, "", err
+	}
+	diffID := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return Descriptor{}, "", err
+	}
+	blobDigest, size, err := s.putBlob(tmp)
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	if _, err := s.unpackLayer(blobDigest, diffID); err != nil {
+		return Descriptor{}, "", err
+	}
+	return Descriptor{MediaType: MediaTypeLayerGzip, Digest: blobDigest, Size: size}, diffID, nil
+}
+
+// Tar 将目录打包为未压缩的tar包，保留属主、权限与扩展属性，exclude中的路径(相对dir)不打包
+func Tar(w io.Writer, dir string, exclude ...string) error {
+	return tarTree(w, dir, "", exclude...)
+}
+
+// TarPath 将一个文件或者目录打包为tar包，在包中以name命名，目录中的文件放在name/下
+func TarPath(w io.Writer, path, name string) error {
+	return tarTree(w, path, name)
+}
+
+// tarLayer 将读写层目录打包为OCI格式的层
+func tarLayer(w io.Writer, dir string) error {
+	return tarTree(w, dir, "")
+}
+
+// tarTree 打包dir，包中的路径以prefix开头，prefix为空时不包括dir本身
+// aufs的whiteout与OCI格式相同，aufs内部使用的.wh..wh.文件被忽略；
+// overlay的whiteout(0/0字符设备)转换为.wh.<name>，不透明目录(trusted.overlay.opaque=y)转换为.wh..wh..opq
+func tarTree(w io.Writer, dir, prefix string, exclude ...string) error {
+	skip := make(map[string]bool)
+	for _, p := range exclude {
+		skip[filepath.Clean("/" + p)[1:]] = true
+	}
+	tw := tar.NewWriter(w)
+	// 硬链接只打包一次，之后的作为链接
+	type inode struct{ dev, ino uint64 }
+	links := make(map[inode]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || (rel == "." && prefix == "") {
+			return err
+		}
+		name := filepath.Join(prefix, rel)
+		if skip[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		base := info.Name()
+		if strings.HasPrefix(base, WhiteoutMetaPrefix) && base != WhiteoutOpaqueDir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		if info.Mode()&os.ModeCharDevice != 0 && stat != nil && stat.Rdev == 0 {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(name), WhiteoutPrefix+base),
+				Mode:     0644,
+				ModTime:  info.ModTime(),
+			})
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := readXattrs(path, hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && stat != nil && stat.Nlink > 1 {
+			key := inode{uint64(stat.Dev), stat.Ino}
+			if target, ok := links[key]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, target, 0
+			} else {
+				links[key] = name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if info.IsDir() && isOverlayOpaque(path) {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(name, WhiteoutOpaqueDir),
+				Mode:     0644,
+				ModTime:  info.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readXattrs 将文件的扩展属性记录到tar包的PAX头中，overlay内部使用的属性除外
+func readXattrs(path string, hdr *tar.Header) error {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		// 文件系统不支持扩展属性时忽略
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, name, value); err != nil {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = string(value[:vsize])
+	}
+	return nil
+}
+
+// IsOpaqueDir 读写层中的目录是否为不透明目录：aufs的目录中有.wh..wh..opq，overlay的目录有trusted.overlay.opaque=y
+func IsOpaqueDir(path string) bool {
+	if _, err := os.Lstat(filepath.Join(path, WhiteoutOpaqueDir)); err == nil {
+		return true
+	}
+	return isOverlayOpaque(path)
+}
+
+// isOverlayOpaque 目录是否为overlay的不透明目录
+func isOverlayOpaque(path string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, "trusted.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
@@ -0,0 +1,129 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tarEntries 打包目录，返回tar包中的条目
+func tarEntries(t *testing.T, dir string) map[string]*tar.Header {
+	var buf bytes.Buffer
+	if err := tarLayer(&buf, dir); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = hdr
+	}
+	return entries
+}
+
+// entryNames 条目名排序后的列表
+func entryNames(entries map[string]*tar.Header) []string {
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// aufs读写层中的whiteout与不透明目录原样打包，aufs内部使用的.wh..wh.文件与目录被忽略
+func TestTarLayerAufsWhiteouts(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"etc", "opq", WhiteoutMetaPrefix + "plnk", WhiteoutMetaPrefix + "orph"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{
+		"etc/hosts",
+		"etc/" + WhiteoutPrefix + "passwd",
+		"opq/" + WhiteoutOpaqueDir,
+		"opq/new",
+		WhiteoutMetaPrefix + "aufs",
+		WhiteoutMetaPrefix + "plnk/123.456",
+		WhiteoutMetaPrefix + "orph/file",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"etc/",
+		"etc/" + WhiteoutPrefix + "passwd",
+		"etc/hosts",
+		"opq/",
+		"opq/" + WhiteoutOpaqueDir,
+		"opq/new",
+	}
+	if got := entryNames(tarEntries(t, dir)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tar entries = %q, want %q", got, want)
+	}
+}
+
+// overlay读写层中0/0字符设备表示的whiteout转换为.wh.<name>，trusted.overlay.opaque=y的目录转换为.wh..wh..opq
+func TestTarLayerOverlayWhiteouts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	for _, d := range []string{"etc", "var", "var/lib"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "var/lib/new"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(dir, "etc/passwd"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("create whiteout device: %v", err)
+	}
+	// 不是0/0的字符设备不是whiteout
+	if err := unix.Mknod(filepath.Join(dir, "etc/null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(dir, "var/lib"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("set overlay opaque xattr: %v", err)
+	}
+	entries := tarEntries(t, dir)
+	want := []string{
+		"etc/",
+		"etc/" + WhiteoutPrefix + "passwd",
+		"etc/null",
+		"var/",
+		"var/lib/",
+		"var/lib/" + WhiteoutOpaqueDir,
+		"var/lib/new",
+	}
+	if got := entryNames(entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tar entries = %q, want %q", got, want)
+	}
+	if hdr := entries["etc/"+WhiteoutPrefix+"passwd"]; hdr.Typeflag != tar.TypeReg || hdr.Size != 0 {
+		t.Errorf("whiteout entry = %+v, want empty regular file", hdr)
+	}
+	if hdr := entries["etc/null"]; hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 1 || hdr.Devminor != 3 {
+		t.Errorf("char device entry = %+v, want 1/3 char device", hdr)
+	}
+	// overlay内部使用的扩展属性不打包
+	if _, ok := entries["var/lib/"].PAXRecords[paxXattrPrefix+"trusted.overlay.opaque"]; ok {
+		t.Errorf("trusted.overlay.opaque is in the tar entry")
+	}
+}
@@ -0,0 +1,96 @@
+package image
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction Dockerfile中的一条指令
+type Instruction struct {
+	Command  string // 大写的指令名
+	Args     string // 指令的参数
+	Original string // 合并续行后的原始内容
+	Line     int    // 指令开始的行号
+}
+
+// ParseDockerfile 解析Dockerfile，去掉注释与空行并合并以\结尾的续行
+func ParseDockerfile(r io.Reader) ([]*Instruction, error) {
+	var instructions []*Instruction
+	scanner := bufio.NewScanner(r)
+	lineNum, start := 0, 0
+	var current strings.Builder
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		// 续行中间的注释与空行被忽略
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			start = lineNum
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+		instructions = append(instructions, newInstruction(current.String(), start))
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		instructions = append(instructions, newInstruction(current.String(), start))
+	}
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf(" the Dockerfile is empty")
+	}
+	if instructions[0].Command != "FROM" {
+		return nil, fmt.Errorf(" line %d: the first instruction must be FROM", instructions[0].Line)
+	}
+	return instructions, nil
+}
+
+func newInstruction(original string, line int) *Instruction {
+	command, args := SplitInstruction(original)
+	return &Instruction{Command: command, Args: args, Original: strings.TrimSpace(original), Line: line}
+}
+
+// SplitFlags 分离指令参数开头的--key=value选项，例如COPY --chown=1000:1000
+func SplitFlags(args string) (map[string]string, string) {
+	flags := make(map[string]string)
+	for strings.HasPrefix(args, "--") {
+		i := strings.IndexAny(args, " \t")
+		if i < 0 {
+			i = len(args)
+		}
+		kv := strings.SplitN(args[2:i], "=", 2)
+		if len(kv) == 2 {
+			flags[kv[0]] = kv[1]
+		} else {
+			flags[kv[0]] = ""
+		}
+		args = strings.TrimSpace(args[i:])
+	}
+	return flags, args
+}
+
+// ParseSourcesDest 解析COPY/ADD的参数，支持json数组与空白分隔两种格式，最后一个是目标路径
+func ParseSourcesDest(args string) ([]string, string, error) {
+	var words []string
+	if !strings.HasPrefix(args, "[") || json.Unmarshal([]byte(args), &words) != nil {
+		var err error
+		if words, err = splitWords(args); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(words) < 2 {
+		return nil, "", fmt.Errorf(" requires at least two arguments: %s", args)
+	}
+	return words[:len(words)-1], words[len(words)-1], nil
+}
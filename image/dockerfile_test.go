@@ -0,0 +1,126 @@
+package image
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		want       []Instruction
+		err        string
+	}{
+		{
+			name:       "comments and empty lines",
+			dockerfile: "# syntax comment\n\nfrom demo:v1\n  # indented comment\nrun echo hi\n",
+			want: []Instruction{
+				{Command: "FROM", Args: "demo:v1", Original: "from demo:v1", Line: 3},
+				{Command: "RUN", Args: "echo hi", Original: "run echo hi", Line: 5},
+			},
+		},
+		{
+			name:       "line continuations",
+			dockerfile: "FROM demo:v1\nRUN apt-get update && \\\n    # comment inside continuation\n\n    apt-get install -y curl\nENV A=1 \\\n    B=2\n",
+			want: []Instruction{
+				{Command: "FROM", Args: "demo:v1", Original: "FROM demo:v1", Line: 1},
+				{Command: "RUN", Args: "apt-get update &&  apt-get install -y curl", Original: "RUN apt-get update &&  apt-get install -y curl", Line: 2},
+				{Command: "ENV", Args: "A=1  B=2", Original: "ENV A=1  B=2", Line: 6},
+			},
+		},
+		{
+			name:       "continuation at end of file",
+			dockerfile: "FROM demo:v1\nCMD echo \\",
+			want: []Instruction{
+				{Command: "FROM", Args: "demo:v1", Original: "FROM demo:v1", Line: 1},
+				{Command: "CMD", Args: "echo", Original: "CMD echo", Line: 2},
+			},
+		},
+		{
+			name:       "empty",
+			dockerfile: "# only comments\n\n",
+			err:        "empty",
+		},
+		{
+			name:       "first instruction is not FROM",
+			dockerfile: "\nRUN echo hi\nFROM demo:v1\n",
+			err:        "line 2: the first instruction must be FROM",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instructions, err := ParseDockerfile(strings.NewReader(tt.dockerfile))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseDockerfile error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []Instruction
+			for _, inst := range instructions {
+				got = append(got, *inst)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseDockerfile =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitFlags(t *testing.T) {
+	tests := []struct {
+		args  string
+		flags map[string]string
+		rest  string
+	}{
+		{"src dst", map[string]string{}, "src dst"},
+		{"--chown=1000:1000 src dst", map[string]string{"chown": "1000:1000"}, "src dst"},
+		{"--from=builder --chown=app\tsrc dst", map[string]string{"from": "builder", "chown": "app"}, "src dst"},
+		{"--platform=linux/amd64 demo:v1 AS build", map[string]string{"platform": "linux/amd64"}, "demo:v1 AS build"},
+		{"--link", map[string]string{"link": ""}, ""},
+		{"src --chown=1 dst", map[string]string{}, "src --chown=1 dst"},
+	}
+	for _, tt := range tests {
+		flags, rest := SplitFlags(tt.args)
+		if !reflect.DeepEqual(flags, tt.flags) || rest != tt.rest {
+			t.Errorf("SplitFlags(%q) = %v, %q, want %v, %q", tt.args, flags, rest, tt.flags, tt.rest)
+		}
+	}
+}
+
+func TestParseSourcesDest(t *testing.T) {
+	tests := []struct {
+		args    string
+		sources []string
+		dest    string
+		err     bool
+	}{
+		{args: "a.txt /app/", sources: []string{"a.txt"}, dest: "/app/"},
+		{args: "a b  c\t/app", sources: []string{"a", "b", "c"}, dest: "/app"},
+		{args: `["my file", "other"  , "/app dir/"]`, sources: []string{"my file", "other"}, dest: "/app dir/"},
+		{args: `"my file" '/app dir'`, sources: []string{"my file"}, dest: "/app dir"},
+		{args: `my\ file /app`, sources: []string{"my file"}, dest: "/app"},
+		// 不是合法的json数组时按照空白分隔解析
+		{args: `[a.txt /app`, sources: []string{"[a.txt"}, dest: "/app"},
+		{args: "/app", err: true},
+		{args: `["/app"]`, err: true},
+		{args: `"a.txt /app`, err: true},
+	}
+	for _, tt := range tests {
+		sources, dest, err := ParseSourcesDest(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseSourcesDest(%q) = %q, %q, want error", tt.args, sources, dest)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(sources, tt.sources) || dest != tt.dest {
+			t.Errorf("ParseSourcesDest(%q) = %q, %q, %v, want %q, %q", tt.args, sources, dest, err, tt.sources, tt.dest)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+	"xwj/mydocker/utils"
+)
+
+// layerRecord 解压后的层的记录
+type layerRecord struct {
+	Size       int64    `json:"size"`                 // 解压后占用的空间
+	Containers []string `json:"containers,omitempty"` // 挂载了这个层的容器
+}
+
+// leaseRecord 正在写入内容的操作，写入的blob与层在镜像记录引用它们之前由lease保护
+type leaseRecord struct {
+	Pid     int       `json:"pid"`               // 写入内容的进程，进程退出后lease失效
+	Created time.Time `json:"created"`           // 创建时间
+	Content []string  `json:"content,omitempty"` // 已经写入的blob digest与层的diff_id
+}
+
+// acquireLease 在写入blob与层之前创建lease，返回释放lease的函数
+// 当前进程已经持有lease时复用，由最外层的调用释放
+func (s *Store) acquireLease() (func(), error) {
+	if s.leaseID != "" {
+		return func() {}, nil
+	}
+	id := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	err := s.update(func() error {
+		s.Leases[id] = &leaseRecord{Pid: os.Getpid(), Created: time.Now()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.leaseID = id
+	return func() {
+		s.leaseID = ""
+		_ = s.update(func() error {
+			delete(s.Leases, id)
+			return nil
+		})
+	}, nil
+}
+
+// leaseContent 将写入的内容记录到当前的lease中，调用前需要持有文件锁
+func (s *Store) leaseContent(digest string) {
+	if rec, ok := s.Leases[s.leaseID]; ok && !containsString(rec.Content, digest) {
+		rec.Content = append(rec.Content, digest)
+	}
+}
+
+// leaseBlob 判断blob是否已经在存储中，存在时记录到当前的lease中，之后不会被清理
+func (s *Store) leaseBlob(digest string) bool {
+	exists := false
+	_ = s.withLock(func() error {
+		if _, err := os.Stat(s.blobPath(digest)); err == nil {
+			s.leaseContent(digest)
+			exists = true
+		}
+		return nil
+	})
+	return exists
+}
+
+// leasedContent 仍然有效的lease保护的内容，进程已经退出的lease被删除，调用前需要已经加载镜像记录
+func (s *Store) leasedContent() map[string]bool {
+	leased := make(map[string]bool)
+	for id, rec := range s.Leases {
+		if !processAlive(rec.Pid) {
+			delete(s.Leases, id)
+			continue
+		}
+		for _, digest := range rec.Content {
+			leased[digest] = true
+		}
+	}
+	return leased
+}
+
+// withLock 在文件锁的保护下执行修改，已经持有文件锁时直接执行，由外层负责写回
+func (s *Store) withLock(fn func() error) error {
+	if s.locked {
+		return fn()
+	}
+	return s.update(fn)
+}
+
+// processAlive 判断进程是否存在
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// recordLayer 获取层的记录，没有记录时统计层目录的大小并加入记录，调用前需要已经加载镜像记录
+func (s *Store) recordLayer(diffID string) *layerRecord {
+	rec, ok := s.Layers[diffID]
+	if !ok {
+		rec = &layerRecord{Size: utils.DirSize(s.LayerPath(diffID))}
+		s.Layers[diffID] = rec
+	}
+	return rec
+}
+
+// Acquire 容器挂载镜像前调用，记录容器对镜像各层的引用，被引用的层不会被清理
+// 层目录不存在时(例如被手动删除)从blob存储中重新解压并校验digest与diff_id，已经存在的层不会重复解压
+func Acquire(containerID string, img *Image) error {
+	return store.update(func() error {
+		for i, diffID := range img.Config.RootFS.DiffIDs {
+			if _, err := os.Stat(store.LayerPath(diffID)); os.IsNotExist(err) {
+				if _, err := store.unpackLayer(img.Manifest.Layers[i].Digest, diffID); err != nil {
+					return err
+				}
+				// 只更新层的大小，保留其他容器对这一层的引用
+				if rec, ok := store.Layers[diffID]; ok {
+					rec.Size = utils.DirSize(store.LayerPath(diffID))
+				}
+			}
+			rec := store.recordLayer(diffID)
+			if !containsString(rec.Containers, containerID) {
+				rec.Containers = append(rec.Containers, containerID)
+			}
+		}
+		return nil
+	})
+}
+
+// Release 容器删除后调用，释放容器对层的引用，层本身由prune清理
+func Release(containerID string) error {
+	return store.update(func() error {
+		store.release(containerID)
+		return nil
+	})
+}
+
+// release 释放容器对层的引用，调用前需要已经加载镜像记录
+func (s *Store) release(containerID string) {
+	for _, rec := range s.Layers {
+		for i, id := range rec.Containers {
+			if id == containerID {
+				rec.Containers = append(rec.Containers[:i], rec.Containers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Prune 删除没有name:tag的镜像，all为true时删除所有没有被容器使用的镜像，并清理不再被引用的blob与层
+// inUse为镜像ID到使用它的容器的映射，需要包含所有存在的容器，不在其中的容器对层的引用会被释放
+// 返回删除的镜像与释放的空间
+func Prune(all bool, inUse map[string][]string) ([]string, int64, error) {
+	var removed []string
+	var reclaimed int64
+	err := store.update(func() error {
+		containers := make(map[string]bool)
+		for _, ids := range inUse {
+			for _, id := range ids {
+				containers[id] = true
+			}
+		}
+		for _, rec := range store.Layers {
+			for _, id := range append([]string{}, rec.Containers...) {
+				if !containers[id] {
+					store.release(id)
+				}
+			}
+		}
+		tagged := make(map[string]bool)
+		for _, id := range store.Refs {
+			tagged[id] = true
+		}
+		var ids []string
+		for id := range store.Images {
+			if len(inUse[id]) == 0 && (all || !tagged[id]) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			for tag, refID := range store.Refs {
+				if refID == id {
+					delete(store.Refs, tag)
+					removed = append(removed, "Untagged: "+tag)
+				}
+			}
+			delete(store.Images, id)
+			removed = append(removed, "Deleted: "+id)
+		}
+		var err error
+		reclaimed, err = store.removeUnreferenced()
+		return err
+	})
+	return removed, reclaimed, err
+}
+
+// containsString 判断切片中是否包含字符串
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lease保护的blob在加入镜像记录之前不会被清理，lease释放后才被清理
+func TestRemoveUnreferencedSkipsLeasedContent(t *testing.T) {
+	useTempStore(t)
+	release, err := store.acquireLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _, err := store.putBlob(strings.NewReader("layer content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := func() {
+		if err := store.update(func() error {
+			_, err := store.removeUnreferenced()
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gc()
+	if _, err := os.Stat(store.blobPath(digest)); err != nil {
+		t.Fatalf("leased blob was removed: %v", err)
+	}
+	release()
+	gc()
+	if _, err := os.Stat(store.blobPath(digest)); !os.IsNotExist(err) {
+		t.Fatalf("unreferenced blob should be removed after the lease is released")
+	}
+}
+
+// 层目录被删除后重新解压时保留其他容器对层的引用
+func TestAcquireReunpackKeepsReferences(t *testing.T) {
+	useTempStore(t)
+	layerDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(layerDir, "file"), []byte("layer content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Commit("", layerDir, "", &CommitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID := img.Config.RootFS.DiffIDs[0]
+	if err := Acquire("c1", img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(store.LayerPath(diffID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Acquire("c2", img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(store.LayerPath(diffID), "file")); err != nil {
+		t.Fatalf("layer was not unpacked again: %v", err)
+	}
+	var rec layerRecord
+	if err := store.view(func() error {
+		rec = *store.Layers[diffID]
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rec.Containers, []string{"c1", "c2"}) || rec.Size <= 0 {
+		t.Fatalf("layer record = %+v, want containers c1 and c2", rec)
+	}
+}
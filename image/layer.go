@@ -0,0 +1,273 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"xwj/mydocker/utils"
+
+	"golang.org/x/sys/unix"
+)
+
+// 层中的whiteout文件，OCI与aufs使用相同的格式：.wh.<name>表示删除下层的文件，.wh..wh..opq表示目录不透明
+const (
+	WhiteoutPrefix     = ".wh."
+	WhiteoutMetaPrefix = ".wh..wh."
+	WhiteoutOpaqueDir  = ".wh..wh..opq"
+	paxXattrPrefix     = "SCHILY.xattr."
+)
+
+// decompress 自动识别gzip压缩的tar包，返回未压缩的数据流
+func decompress(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, false, err
+		}
+		return gz, true, nil
+	}
+	return br, false, nil
+}
+
+// unpackLayer 将blob存储中的层解压到LayerRoot/<diff_id>，返回层的diff_id(未压缩tar包的sha256)
+// 已知diff_id并且层已经解压过时直接返回；expectDiffID不为空时校验解压出的内容
+func (s *Store) unpackLayer(blobDigest, expectDiffID string) (string, error) {
+	if expectDiffID != "" {
+		exists := false
+		if err := s.withLock(func() error {
+			s.leaseContent(expectDiffID)
+			_, err := os.Stat(s.LayerPath(expectDiffID))
+			exists = err == nil
+			return nil
+		}); err != nil {
+			return "", err
+		}
+		if exists {
+			return expectDiffID, nil
+		}
+	}
+	f, err := os.Open(s.blobPath(blobDigest))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// 同时校验blob本身的digest，blob损坏时不会解压出错误的层
+	blobHash := sha256.New()
+	r, _, err := decompress(io.TeeReader(f, blobHash))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.LayerRoot, 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := ioutil.TempDir(s.LayerRoot, ".tmp-layer-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	hash := sha256.New()
+	if err := extractTar(io.TeeReader(r, hash), tmpDir); err != nil {
+		return "", err
+	}
+	// tar包结尾可能有填充的数据，也要计入diff_id
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(ioutil.Discard, io.TeeReader(f, blobHash)); err != nil {
+		return "", err
+	}
+	if digest := "sha256:" + hex.EncodeToString(blobHash.Sum(nil)); digest != blobDigest {
+		return "", fmt.Errorf(" layer %s: digest mismatch, got %s", blobDigest, digest)
+	}
+	diffID := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if expectDiffID != "" && diffID != expectDiffID {
+		return "", fmt.Errorf(" layer %s: diff id mismatch, expect %s, got %s", blobDigest, expectDiffID, diffID)
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	return diffID, s.withLock(func() error {
+		s.leaseContent(diffID)
+		if _, err := os.Stat(s.LayerPath(diffID)); err == nil {
+			return nil
+		}
+		return os.Rename(tmpDir, s.LayerPath(diffID))
+	})
+}
+
+// Untar 将tar包(可以是gzip压缩的)解压到dir中，所有的路径都限制在dir内
+func Untar(r io.Reader, dir string) error {
+	r, _, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	return extractTar(r, dir)
+}
+
+// UntarInRoot 将tar包(可以是gzip压缩的)解压到root中的dir目录下，dir与包中的路径都在root内解析，
+// 符号链接不会指向root之外
+func UntarInRoot(r io.Reader, root, dir string) error {
+	r, _, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	return extractTarAt(r, root, dir)
+}
+
+// IsArchive 判断文件是否为tar包(可以是gzip压缩的)
+func IsArchive(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r, _, err := decompress(f)
+	if err != nil {
+		return false
+	}
+	_, err = tar.NewReader(r).Next()
+	return err == nil
+}
+
+// extractTar 将tar包解压到dir中，所有的路径都限制在dir内
+func extractTar(r io.Reader, dir string) error {
+	return extractTarAt(r, dir, "")
+}
+
+// extractTarAt 将tar包解压到root中的prefix目录下，所有的路径都限制在root内
+func extractTarAt(r io.Reader, root, prefix string) error {
+	tr := tar.NewReader(r)
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirTimes []dirTime
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Clean("/"+hdr.Name) == "/" {
+			continue
+		}
+		// whiteout文件原样保留，由aufs挂载时处理；aufs内部使用的.wh..wh.文件不属于层的内容
+		if base := filepath.Base(hdr.Name); strings.HasPrefix(base, WhiteoutMetaPrefix) && base != WhiteoutOpaqueDir {
+			continue
+		}
+		target, err := layerPath(root, filepath.Join("/", prefix, filepath.Clean("/"+hdr.Name)))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// 同名的文件已经存在时先删除，目录保留以便合并内容
+		if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirTimes = append(dirTimes, dirTime{target, hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := layerPath(root, filepath.Join("/", prefix, filepath.Clean("/"+hdr.Linkname)))
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devMode := uint32(unix.S_IFIFO)
+			if hdr.Typeflag == tar.TypeChar {
+				devMode = unix.S_IFCHR
+			} else if hdr.Typeflag == tar.TypeBlock {
+				devMode = unix.S_IFBLK
+			}
+			dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+			if err := unix.Mknod(target, devMode|uint32(mode.Perm()), dev); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			// 其他类型(例如GNU稀疏文件的扩展头)不影响文件系统的内容
+			continue
+		}
+		// 先修改属主再修改权限，否则setuid位会被chown清除
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+		// 恢复扩展属性，文件系统不支持或者没有权限时忽略
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				_ = unix.Lsetxattr(target, strings.TrimPrefix(key, paxXattrPrefix), []byte(value), 0)
+			}
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	// 目录的修改时间在其中的文件都解压完成后再设置
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirTimes[i].path, dirTimes[i].mtime, dirTimes[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layerPath 获取tar包中的路径在层目录中的位置，父目录中的符号链接都在层目录内解析，最后一个部分本身不解析
+func layerPath(dir, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	parent, err := utils.SecureJoin(dir, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
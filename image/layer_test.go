@@ -0,0 +1,50 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 层中的符号链接经过不存在的目录与..指向宿主机的目录时，解压的文件仍然在层目录内
+func TestExtractTarSymlinkEscape(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []*tar.Header{
+		{Typeflag: tar.TypeSymlink, Name: "b", Linkname: "../escape-target"},
+		{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "nonexist/../b"},
+		{Typeflag: tar.TypeReg, Name: "a/passwd", Mode: 0644, Size: 5},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("owned")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 层目录之外的escape-target模拟宿主机上的目录
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "layer")
+	for _, d := range []string{dir, filepath.Join(tmp, "escape-target")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := extractTar(bytes.NewReader(buf.Bytes()), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape-target", "passwd")); err != nil {
+		t.Errorf("file should be extracted inside the layer: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "escape-target", "passwd")); !os.IsNotExist(err) {
+		t.Errorf("file escaped the layer directory")
+	}
+}
@@ -0,0 +1,131 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 镜像tar包的格式
+const (
+	formatRootfs        = ""
+	formatDockerArchive = "docker-archive"
+	formatOCI           = "oci"
+)
+
+// Load 加载镜像tar包，支持docker save生成的tar包、OCI image-layout以及根文件系统的tar包
+// ref不为空时作为加载的第一个镜像的name:tag
+func Load(tarPath, ref string) ([]*Image, error) {
+	// 写入的内容在加入镜像记录之前由lease保护，不会被同时进行的清理删除
+	release, err := store.acquireLease()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	format, err := archiveFormat(tarPath)
+	if err != nil {
+		return nil, fmt.Errorf(" read %s: %v", tarPath, err)
+	}
+	if format != formatRootfs {
+		return loadArchive(tarPath, format, ref)
+	}
+	img, err := loadRootfs(tarPath, ref)
+	if err != nil {
+		return nil, err
+	}
+	return []*Image{img}, nil
+}
+
+// loadRootfs 将根文件系统的tar包加载为只有一层的镜像，ref为空时使用tar包文件名中第一个.之前的部分作为镜像名
+// 相同内容的tar包得到相同的镜像ID，层只会解压一次
+func loadRootfs(tarPath, ref string) (*Image, error) {
+	if ref == "" {
+		ref = strings.Split(filepath.Base(tarPath), ".")[0]
+	}
+	name, err := ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 使用tar包的修改时间作为创建时间，保证相同的tar包得到相同的镜像ID
+	img, err := importRootfs(f, []string{name}, info.ModTime().UTC(), "load "+filepath.Base(tarPath), nil)
+	if err != nil {
+		return nil, fmt.Errorf(" load %s: %v", tarPath, err)
+	}
+	return img, nil
+}
+
+// Import 将扁平的根文件系统tar包导入为只有一层的镜像，changes是应用到镜像配置上的Dockerfile指令
+// ref为空时生成没有名称的镜像
+func Import(r io.Reader, ref string, changes []string) (*Image, error) {
+	// 写入的内容在加入镜像记录之前由lease保护，不会被同时进行的清理删除
+	release, err := store.acquireLease()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var refs []string
+	if ref != "" {
+		name, err := ParseReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, name)
+	}
+	return importRootfs(r, refs, time.Now().UTC(), "import", changes)
+}
+
+// importRootfs 将根文件系统的tar包作为一层写入存储并生成镜像
+func importRootfs(r io.Reader, refs []string, created time.Time, createdBy string, changes []string) (*Image, error) {
+	blobDigest, size, err := store.putBlob(r)
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := store.unpackLayer(blobDigest, "")
+	if err != nil {
+		return nil, err
+	}
+	mediaType := MediaTypeLayer
+	if blobDigest != diffID {
+		mediaType = MediaTypeLayerGzip
+	}
+	config := &Config{
+		Created:      &created,
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       RootFS{Type: "layers", DiffIDs: []string{diffID}},
+		History:      []History{{Created: &created, CreatedBy: createdBy}},
+	}
+	for _, change := range changes {
+		if err := ApplyChange(&config.Config, change); err != nil {
+			return nil, err
+		}
+	}
+	configDigest, configSize, err := store.putJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        Descriptor{MediaType: MediaTypeConfig, Digest: configDigest, Size: configSize},
+		Layers:        []Descriptor{{MediaType: mediaType, Digest: blobDigest, Size: size}},
+	}
+	id, err := store.addImage(manifest, refs...)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(id)
+}
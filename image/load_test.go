@@ -0,0 +1,78 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// rootfsTar 只包含一个文件的根文件系统tar包
+func rootfsTar(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	content := []byte("hello")
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./etc/motd", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// 扁平的tar包导入为只有一层的镜像，压缩与未压缩的tar包得到相同的diff_id
+func TestImport(t *testing.T) {
+	useTempStore(t)
+	plain, err := Import(bytes.NewReader(rootfsTar(t, false)), "imported:v1", []string{`CMD ["cat", "/etc/motd"]`, "ENV A=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.Config.RootFS.DiffIDs) != 1 || len(plain.Manifest.Layers) != 1 || plain.Manifest.Layers[0].MediaType != MediaTypeLayer {
+		t.Fatalf("imported image layers = %+v, want one uncompressed layer", plain.Manifest.Layers)
+	}
+	if !reflect.DeepEqual(plain.RepoTags, []string{"imported:v1"}) {
+		t.Errorf("RepoTags = %v, want imported:v1", plain.RepoTags)
+	}
+	if cfg := plain.Config.Config; !reflect.DeepEqual(cfg.Cmd, []string{"cat", "/etc/motd"}) || !reflect.DeepEqual(cfg.Env, []string{"A=1"}) {
+		t.Errorf("config = %+v, want changes applied", cfg)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(store.LayerPath(plain.Config.RootFS.DiffIDs[0]), "etc/motd"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("etc/motd = %q, %v", content, err)
+	}
+
+	gzipped, err := Import(bytes.NewReader(rootfsTar(t, true)), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gzipped.Manifest.Layers[0].MediaType != MediaTypeLayerGzip {
+		t.Errorf("media type = %s, want %s", gzipped.Manifest.Layers[0].MediaType, MediaTypeLayerGzip)
+	}
+	if gzipped.Config.RootFS.DiffIDs[0] != plain.Config.RootFS.DiffIDs[0] {
+		t.Errorf("diff id of gzipped tar = %s, want %s", gzipped.Config.RootFS.DiffIDs[0], plain.Config.RootFS.DiffIDs[0])
+	}
+	if len(gzipped.RepoTags) != 0 {
+		t.Errorf("image imported without ref has tags %v", gzipped.RepoTags)
+	}
+
+	if _, err := Import(bytes.NewReader(rootfsTar(t, false)), "", []string{"RUN echo hi"}); err == nil {
+		t.Error("Import with RUN change, want error")
+	}
+}
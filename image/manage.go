@@ -0,0 +1,227 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"xwj/mydocker/utils"
+)
+
+// List 列出本地存储中的所有镜像
+func List() ([]*Image, error) {
+	var images []*Image
+	err := store.view(func() error {
+		for id := range store.Images {
+			img, err := store.image(id)
+			if err != nil {
+				return fmt.Errorf(" image %s: %v", ShortID(id), err)
+			}
+			images = append(images, img)
+		}
+		return nil
+	})
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].created().After(images[j].created())
+	})
+	return images, err
+}
+
+// Tag 为镜像添加一个新的name:tag
+func Tag(source, target string) error {
+	name, err := ParseReference(target)
+	if err != nil {
+		return err
+	}
+	return store.update(func() error {
+		id, err := store.lookup(source)
+		if err != nil {
+			return err
+		}
+		store.Refs[name] = id
+		return nil
+	})
+}
+
+// Remove 删除镜像，inUse为镜像ID到使用它的容器的映射
+// ref是name:tag并且镜像还有其他的name:tag时只删除这个name:tag
+// 镜像正在被容器使用时拒绝删除，force为true时只删除镜像的所有name:tag，镜像本身与层保留给容器使用
+// 返回删除的name:tag与镜像ID
+func Remove(ref string, force bool, inUse map[string][]string) ([]string, error) {
+	var removed []string
+	err := store.update(func() error {
+		id, err := store.lookup(ref)
+		if err != nil {
+			return err
+		}
+		var tags []string
+		for tag, refID := range store.Refs {
+			if refID == id {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		if name, err := ParseReference(ref); err == nil && store.Refs[name] == id && len(tags) > 1 {
+			delete(store.Refs, name)
+			removed = append(removed, "Untagged: "+name)
+			return nil
+		}
+		if containers := inUse[id]; len(containers) > 0 && !force {
+			return fmt.Errorf(" image %s is being used by container %s, use --force to untag it", ref, strings.Join(containers, ", "))
+		}
+		for _, tag := range tags {
+			delete(store.Refs, tag)
+			removed = append(removed, "Untagged: "+tag)
+		}
+		if len(inUse[id]) > 0 {
+			return nil
+		}
+		delete(store.Images, id)
+		removed = append(removed, "Deleted: "+id)
+		_, err = store.removeUnreferenced()
+		return err
+	})
+	return removed, err
+}
+
+// removeUnreferenced 删除不再被任何镜像、容器或者lease引用的blob与解压后的层以及指向已删除镜像的构建缓存，
+// 返回释放的空间，调用前需要已经加载镜像记录
+func (s *Store) removeUnreferenced() (int64, error) {
+	for key, id := range s.Cache {
+		if _, ok := s.Images[id]; !ok {
+			delete(s.Cache, key)
+		}
+	}
+	// 正在写入还没有被镜像引用的内容不删除
+	leased := s.leasedContent()
+	blobs := make(map[string]bool)
+	layers := make(map[string]bool)
+	for digest := range leased {
+		blobs[digest] = true
+		layers[strings.TrimPrefix(digest, "sha256:")] = true
+	}
+	for id, rec := range s.Images {
+		img, err := s.image(id)
+		if err != nil {
+			return 0, err
+		}
+		blobs[id] = true
+		blobs[rec.Manifest] = true
+		for _, layer := range img.Manifest.Layers {
+			blobs[layer.Digest] = true
+		}
+		for _, diffID := range img.Config.RootFS.DiffIDs {
+			layers[strings.TrimPrefix(diffID, "sha256:")] = true
+		}
+	}
+	// 镜像删除后仍然被容器挂载的层保留到容器删除
+	for diffID, rec := range s.Layers {
+		if len(rec.Containers) > 0 {
+			layers[strings.TrimPrefix(diffID, "sha256:")] = true
+		} else if !layers[strings.TrimPrefix(diffID, "sha256:")] {
+			delete(s.Layers, diffID)
+		}
+	}
+	var reclaimed int64
+	blobDir := filepath.Dir(s.blobPath("sha256:0"))
+	entries, err := os.ReadDir(blobDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if !blobs["sha256:"+entry.Name()] && !strings.HasPrefix(entry.Name(), ".tmp-") {
+			if info, err := entry.Info(); err == nil {
+				reclaimed += info.Size()
+			}
+			if err := os.Remove(filepath.Join(blobDir, entry.Name())); err != nil {
+				return reclaimed, err
+			}
+		}
+	}
+	// 层目录与容器的读写层在同一个目录下，只删除sha256命名的层目录
+	entries, err = os.ReadDir(s.LayerRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return reclaimed, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && digestRegexp.MatchString("sha256:"+name) && !layers[name] {
+			reclaimed += utils.DirSize(filepath.Join(s.LayerRoot, name))
+			if err := os.RemoveAll(filepath.Join(s.LayerRoot, name)); err != nil {
+				return reclaimed, err
+			}
+		}
+	}
+	return reclaimed, nil
+}
+
+// created 镜像的创建时间
+func (img *Image) created() (t time.Time) {
+	if img.Config.Created != nil {
+		t = *img.Config.Created
+	}
+	return t
+}
+
+// Size 镜像所有层解压后占用的空间
+func (img *Image) Size() int64 {
+	var size int64
+	for _, layer := range img.LayerPaths() {
+		_ = filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// Inspect inspect命令输出的镜像详细信息
+type Inspect struct {
+	ID           string          `json:"Id"`
+	RepoTags     []string        `json:"RepoTags"`
+	Created      *time.Time      `json:"Created,omitempty"`
+	Author       string          `json:"Author,omitempty"`
+	Architecture string          `json:"Architecture"`
+	OS           string          `json:"Os"`
+	Size         int64           `json:"Size"`
+	Config       ContainerConfig `json:"Config"`
+	RootFS       RootFS          `json:"RootFS"`
+	Layers       []Descriptor    `json:"Layers"`
+	History      []History       `json:"History,omitempty"`
+}
+
+// Inspect 获取镜像的详细信息
+func (img *Image) Inspect() *Inspect {
+	return &Inspect{
+		ID:           img.ID,
+		RepoTags:     img.RepoTags,
+		Created:      img.Config.Created,
+		Author:       img.Config.Author,
+		Architecture: img.Config.Architecture,
+		OS:           img.Config.OS,
+		Size:         img.Size(),
+		Config:       img.Config.Config,
+		RootFS:       img.Config.RootFS,
+		Layers:       img.Manifest.Layers,
+		History:      img.Config.History,
+	}
+}
+
+// HumanSize 以可读的方式展示大小
+func HumanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
@@ -0,0 +1,45 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const defaultTag = "latest"
+
+var (
+	// 镜像名由小写字母、数字与分隔符组成，可以带有registry地址(host[:port]/)
+	nameRegexp = regexp.MustCompile(`^([a-zA-Z0-9.-]+(:[0-9]+)?/)?[a-z0-9]+([._-]+[a-z0-9]+)*(/[a-z0-9]+([._-]+[a-z0-9]+)*)*$`)
+	tagRegexp  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// ParseReference 解析name[:tag]格式的镜像引用，没有tag时使用latest，返回规范化的name:tag
+func ParseReference(ref string) (string, error) {
+	name, tag := SplitReference(ref)
+	if !nameRegexp.MatchString(name) {
+		return "", fmt.Errorf(" invalid image name: %s", ref)
+	}
+	if !tagRegexp.MatchString(tag) {
+		return "", fmt.Errorf(" invalid image tag: %s", ref)
+	}
+	return name + ":" + tag, nil
+}
+
+// SplitReference 将镜像引用分为name与tag，registry地址中的端口号不会被当作tag
+func SplitReference(ref string) (name, tag string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i+1:], "/") {
+		return ref, defaultTag
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// ShortID 镜像ID的前12位，用于展示
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,522 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"xwj/mydocker/log"
+)
+
+const (
+	defaultRegistry  = "registry-1.docker.io" // 镜像名中没有registry地址时使用Docker Hub
+	DefaultChunkSize = 5 << 20                // 大于这个大小的blob分块上传
+)
+
+// 拉取manifest时接受的媒体类型
+var manifestAccept = []string{MediaTypeManifest, MediaTypeImageIndex, MediaTypeDockerManifest, MediaTypeDockerManifestList}
+
+// RegistryOptions 访问registry的选项
+type RegistryOptions struct {
+	Username  string // basic认证或者获取bearer token使用的用户名
+	Password  string // 密码
+	Insecure  bool   // 使用http而不是https
+	ChunkSize int64  // 分块上传的块大小，小于等于0时总是整体上传
+}
+
+// registry Docker Registry HTTP API v2的客户端，一个客户端对应一个仓库
+type registry struct {
+	base   *url.URL
+	repo   string
+	opts   *RegistryOptions
+	client *http.Client
+	auth   string // 认证后的Authorization头
+}
+
+// registryError registry返回的错误
+type registryError struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// newRegistry 根据镜像名创建客户端，镜像名第一部分带有.或:或者是localhost时作为registry地址
+func newRegistry(ref string, opts *RegistryOptions) (*registry, string, error) {
+	name, err := ParseReference(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	repo, tag := SplitReference(name)
+	host := defaultRegistry
+	if i := strings.Index(repo, "/"); i > 0 && (strings.ContainsAny(repo[:i], ".:") || repo[:i] == "localhost") {
+		host, repo = repo[:i], repo[i+1:]
+	} else if !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	scheme := "https"
+	if opts.Insecure {
+		scheme = "http"
+	}
+	return &registry{
+		base:   &url.URL{Scheme: scheme, Host: host},
+		repo:   repo,
+		opts:   opts,
+		client: &http.Client{Timeout: 30 * time.Minute},
+	}, tag, nil
+}
+
+// url 仓库下的API地址
+func (r *registry) url(format string, args ...interface{}) string {
+	return r.base.String() + "/v2/" + r.repo + fmt.Sprintf(format, args...)
+}
+
+// do 发送请求，收到401时按照WWW-Authenticate的要求认证后重试一次
+// newReq每次都创建新的请求，保证重试时请求体可以重新读取
+func (r *registry) do(newReq func() (*http.Request, error)) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		if r.auth != "" {
+			req.Header.Set("Authorization", r.auth)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || retry > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authenticate(challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate 处理basic与bearer两种认证方式
+func (r *registry) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.opts.Username == "" {
+			return fmt.Errorf(" %s requires authentication, use --username and --password", r.base.Host)
+		}
+		r.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(r.opts.Username+":"+r.opts.Password))
+	case "bearer":
+		token, err := r.fetchToken(params)
+		if err != nil {
+			return err
+		}
+		r.auth = "Bearer " + token
+	default:
+		return fmt.Errorf(" unsupported authentication challenge from %s: %q", r.base.Host, challenge)
+	}
+	return nil
+}
+
+// fetchToken 从认证服务获取bearer token，有用户名时使用basic认证
+func (r *registry) fetchToken(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf(" invalid bearer realm: %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.opts.Username != "" {
+		req.SetBasicAuth(r.opts.Username, r.opts.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return "", fmt.Errorf(" fetch token: %v", err)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf(" empty token from %s", realm.Host)
+	}
+	return token.Token, nil
+}
+
+// parseChallenge 解析WWW-Authenticate头，例如Bearer realm="...",service="...",scope="..."
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	challenge = strings.TrimSpace(challenge)
+	i := strings.Index(challenge, " ")
+	if i < 0 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if end := strings.Index(rest, ","); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// checkResponse 检查响应码，出错时带上registry返回的错误信息
+func checkResponse(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	regErr := &registryError{}
+	if json.Unmarshal(body, regErr) == nil && len(regErr.Errors) > 0 {
+		var msgs []string
+		for _, e := range regErr.Errors {
+			msgs = append(msgs, e.Code+": "+e.Message)
+		}
+		return fmt.Errorf(" %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.Join(msgs, "; "))
+	}
+	return fmt.Errorf(" %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+// getManifest 获取manifest或者多平台的index，校验内容的digest，返回内容与媒体类型
+func (r *registry) getManifest(reference string) ([]byte, string, error) {
+	resp, err := r.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, r.url("/manifests/%s", reference), nil)
+		if err == nil {
+			req.Header.Set("Accept", strings.Join(manifestAccept, ", "))
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	expect := resp.Header.Get("Docker-Content-Digest")
+	if strings.HasPrefix(reference, "sha256:") {
+		expect = reference
+	}
+	if expect != "" && expect != digest {
+		return nil, "", fmt.Errorf(" manifest %s: digest mismatch, expect %s, got %s", reference, expect, digest)
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	// 有些registry不返回准确的Content-Type，以内容中的mediaType为准
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(content, &probe) == nil && probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+	return content, mediaType, nil
+}
+
+// fetchBlob 下载blob到本地存储并校验digest，本地已经存在时跳过
+func (r *registry) fetchBlob(desc Descriptor) error {
+	if store.leaseBlob(desc.Digest) {
+		return nil
+	}
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, r.url("/blobs/%s", desc.Digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return err
+	}
+	digest, size, err := store.putBlob(resp.Body)
+	if err != nil {
+		return err
+	}
+	if digest != desc.Digest {
+		// 内容不对的blob不能留在存储中
+		os.Remove(store.blobPath(digest))
+		return fmt.Errorf(" blob %s: digest mismatch, got %s", desc.Digest, digest)
+	}
+	if desc.Size > 0 && size != desc.Size {
+		return fmt.Errorf(" blob %s: size mismatch, expect %d, got %d", desc.Digest, desc.Size, size)
+	}
+	return nil
+}
+
+// Pull 从registry拉取镜像到本地存储，多平台镜像只拉取linux/当前架构
+func Pull(ref string, opts *RegistryOptions) (*Image, error) {
+	// 写入的内容在加入镜像记录之前由lease保护，不会被同时进行的清理删除
+	release, err := store.acquireLease()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	r, tag, err := newRegistry(ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := ParseReference(ref)
+	content, mediaType, err := r.getManifest(tag)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList {
+		index := &Index{}
+		if err := json.Unmarshal(content, index); err != nil {
+			return nil, fmt.Errorf(" invalid image index: %v", err)
+		}
+		desc, err := pickPlatform(index)
+		if err != nil {
+			return nil, err
+		}
+		if content, mediaType, err = r.getManifest(desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if mediaType != MediaTypeManifest && mediaType != MediaTypeDockerManifest {
+		return nil, fmt.Errorf(" unsupported manifest media type: %s", mediaType)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf(" invalid manifest: %v", err)
+	}
+	if err := r.fetchBlob(manifest.Config); err != nil {
+		return nil, err
+	}
+	for _, layer := range manifest.Layers {
+		log.Log.Infof("pulling layer %s", ShortID(layer.Digest))
+		if err := r.fetchBlob(layer); err != nil {
+			return nil, err
+		}
+	}
+	return store.addImageFromBlobs(manifest.Config, manifest.Layers, []string{name})
+}
+
+// Push 将本地镜像推送到registry，registry中已经存在的blob不再上传
+func Push(ref string, opts *RegistryOptions) error {
+	r, tag, err := newRegistry(ref, opts)
+	if err != nil {
+		return err
+	}
+	img, err := store.Get(ref)
+	if err != nil {
+		return err
+	}
+	for _, desc := range append(append([]Descriptor{}, img.Manifest.Layers...), img.Manifest.Config) {
+		exists, err := r.blobExists(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Printf("%s: Layer already exists\n", ShortID(desc.Digest))
+			continue
+		}
+		if err := r.uploadBlob(desc); err != nil {
+			return err
+		}
+		fmt.Printf("%s: Pushed\n", ShortID(desc.Digest))
+	}
+	// 推送本地保存的manifest原文，保证digest不变
+	var manifestDigest string
+	if err := store.view(func() error {
+		manifestDigest = store.Images[img.ID].Manifest
+		return nil
+	}); err != nil {
+		return err
+	}
+	content, err := store.readBlob(manifestDigest)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, r.url("/manifests/%s", tag), bytes.NewReader(content))
+		if err == nil {
+			req.Header.Set("Content-Type", MediaTypeManifest)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusCreated, http.StatusOK, http.StatusAccepted); err != nil {
+		return err
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != manifestDigest {
+		return fmt.Errorf(" manifest digest mismatch, expect %s, registry returned %s", manifestDigest, digest)
+	}
+	fmt.Printf("%s: digest: %s size: %d\n", tag, manifestDigest, len(content))
+	return nil
+}
+
+// blobExists 使用HEAD请求检查registry中是否已经有这个blob
+func (r *registry) blobExists(digest string) (bool, error) {
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, r.url("/blobs/%s", digest), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf(" HEAD blob %s: %s", digest, resp.Status)
+}
+
+// uploadBlob 上传blob，不超过块大小时一次PUT整体上传，否则使用PATCH分块上传后再PUT完成
+func (r *registry) uploadBlob(desc Descriptor) error {
+	f, err := os.Open(store.blobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	// 开始上传，得到上传地址
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, r.url("/blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if err := checkResponse(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	location, err := r.location(resp)
+	if err != nil {
+		return err
+	}
+	chunkSize := r.opts.ChunkSize
+	var offset int64
+	if chunkSize > 0 && size > chunkSize {
+		for offset < size {
+			n := chunkSize
+			if offset+n > size {
+				n = size - offset
+			}
+			start, uploadURL := offset, location
+			resp, err := r.do(func() (*http.Request, error) {
+				req, err := http.NewRequest(http.MethodPatch, uploadURL, io.NewSectionReader(f, start, n))
+				if err == nil {
+					req.ContentLength = n
+					req.Header.Set("Content-Type", "application/octet-stream")
+					req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, start+n-1))
+				}
+				return req, err
+			})
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if err := checkResponse(resp, http.StatusAccepted, http.StatusNoContent); err != nil {
+				return err
+			}
+			if location, err = r.location(resp); err != nil {
+				return err
+			}
+			offset += n
+		}
+	}
+	// 完成上传，剩余的内容(整体上传时是全部内容)放在PUT的请求体中
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", desc.Digest)
+	u.RawQuery = query.Encode()
+	start, n := offset, size-offset
+	resp, err = r.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, u.String(), io.NewSectionReader(f, start, n))
+		if err == nil {
+			req.ContentLength = n
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return err
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != desc.Digest {
+		return fmt.Errorf(" blob %s: registry returned digest %s", desc.Digest, digest)
+	}
+	return nil
+}
+
+// location 解析上传响应中的Location，相对地址基于registry地址
+func (r *registry) location(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf(" %s %s: missing Location header", resp.Request.Method, resp.Request.URL.Path)
+	}
+	u, err := r.base.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,287 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testRepo     = "library/demo"
+	testUser     = "user"
+	testPassword = "secret"
+	testToken    = "test-token"
+	testService  = "test-registry"
+)
+
+// testRegistry 实现Registry HTTP API v2中拉取与推送用到的部分，用于测试客户端
+type testRegistry struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	auth      string            // 认证方式：空、basic或者bearer
+	blobs     map[string][]byte // digest到内容
+	manifests map[string][]byte // tag或者digest到manifest
+	badDigest bool              // 为true时manifest响应中返回错误的Docker-Content-Digest
+	uploads   map[string][]byte // 进行中的上传
+	patches   int               // 收到的PATCH请求数
+}
+
+// newTestRegistry 启动测试registry并创建访问它的客户端
+func newTestRegistry(t *testing.T, auth string, opts *RegistryOptions) (*testRegistry, *registry) {
+	tr := &testRegistry{
+		auth:      auth,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		uploads:   make(map[string][]byte),
+	}
+	tr.server = httptest.NewServer(tr)
+	t.Cleanup(tr.server.Close)
+	base, _ := url.Parse(tr.server.URL)
+	return tr, &registry{base: base, repo: testRepo, opts: opts, client: tr.server.Client()}
+}
+
+// useTempStore 让默认的镜像存储指向临时目录
+func useTempStore(t *testing.T) {
+	old := store
+	root := t.TempDir()
+	store = &Store{Root: root + "/image", LayerRoot: root + "/diff"}
+	t.Cleanup(func() { store = old })
+}
+
+// digestOf 内容的sha256 digest
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (tr *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if req.URL.Path == "/token" {
+		tr.serveToken(w, req)
+		return
+	}
+	if !tr.authorized(w, req) {
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/"+testRepo)
+	body, _ := ioutil.ReadAll(req.Body)
+	switch {
+	case strings.HasPrefix(path, "/blobs/uploads/"):
+		id := strings.TrimPrefix(path, "/blobs/uploads/")
+		location := "/v2/" + testRepo + "/blobs/uploads/"
+		switch req.Method {
+		case http.MethodPost:
+			id = strconv.Itoa(len(tr.uploads) + 1)
+			tr.uploads[id] = nil
+			w.Header().Set("Location", location+id)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPatch:
+			if want := fmt.Sprintf("%d-%d", len(tr.uploads[id]), len(tr.uploads[id])+len(body)-1); req.Header.Get("Content-Range") != want {
+				http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			tr.patches++
+			tr.uploads[id] = append(tr.uploads[id], body...)
+			w.Header().Set("Location", location+id)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			content := append(tr.uploads[id], body...)
+			digest := req.URL.Query().Get("digest")
+			if digestOf(content) != digest {
+				http.Error(w, "digest invalid", http.StatusBadRequest)
+				return
+			}
+			delete(tr.uploads, id)
+			tr.blobs[digest] = content
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.HasPrefix(path, "/blobs/"):
+		content, ok := tr.blobs[strings.TrimPrefix(path, "/blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	case strings.HasPrefix(path, "/manifests/"):
+		content, ok := tr.manifests[strings.TrimPrefix(path, "/manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		digest := digestOf(content)
+		if tr.badDigest {
+			digest = digestOf(append(content, '\n'))
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Type", MediaTypeManifest)
+		w.Write(content)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// authorized 检查请求的认证信息，没有通过时返回401与对应的challenge
+func (tr *testRegistry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	switch tr.auth {
+	case "basic":
+		if user, password, ok := req.BasicAuth(); ok && user == testUser && password == testPassword {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+	case "bearer":
+		if req.Header.Get("Authorization") == "Bearer "+testToken {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="%s",scope="repository:%s:pull,push"`,
+			tr.server.URL, testService, testRepo))
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// serveToken 认证服务，校验service与scope以及用户名密码后返回token
+func (tr *testRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("service") != testService || query.Get("scope") != "repository:"+testRepo+":pull,push" {
+		http.Error(w, "bad scope", http.StatusBadRequest)
+		return
+	}
+	if user, password, ok := req.BasicAuth(); !ok || user != testUser || password != testPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": testToken})
+}
+
+// HEAD请求区分存在与不存在的blob
+func TestBlobExists(t *testing.T) {
+	tr, r := newTestRegistry(t, "", &RegistryOptions{})
+	content := []byte("blob content")
+	tr.blobs[digestOf(content)] = content
+	exists, err := r.blobExists(digestOf(content))
+	if err != nil || !exists {
+		t.Fatalf("blobExists(existing) = %v, %v, want true", exists, err)
+	}
+	exists, err = r.blobExists(digestOf([]byte("missing")))
+	if err != nil || exists {
+		t.Fatalf("blobExists(missing) = %v, %v, want false", exists, err)
+	}
+}
+
+// 不超过块大小的blob只用一次PUT上传，超过时按块PATCH上传后PUT完成
+func TestUploadBlob(t *testing.T) {
+	useTempStore(t)
+	digest, size, err := store.putBlob(strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		chunkSize int64
+		patches   int
+	}{
+		{0, 0},
+		{size, 0},
+		{4, 3},
+	}
+	for _, tt := range tests {
+		tr, r := newTestRegistry(t, "", &RegistryOptions{ChunkSize: tt.chunkSize})
+		if err := r.uploadBlob(Descriptor{Digest: digest, Size: size}); err != nil {
+			t.Fatalf("chunk size %d: %v", tt.chunkSize, err)
+		}
+		if string(tr.blobs[digest]) != "0123456789" {
+			t.Fatalf("chunk size %d: registry has %q", tt.chunkSize, tr.blobs[digest])
+		}
+		if tr.patches != tt.patches {
+			t.Fatalf("chunk size %d: %d PATCH requests, want %d", tt.chunkSize, tr.patches, tt.patches)
+		}
+	}
+}
+
+// manifest的内容与Docker-Content-Digest或者请求的digest不一致时拒绝
+func TestGetManifestDigestMismatch(t *testing.T) {
+	tr, r := newTestRegistry(t, "", &RegistryOptions{})
+	content := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `"}`)
+	tr.manifests["v1"] = content
+	tr.manifests[digestOf([]byte("other"))] = content
+	got, mediaType, err := r.getManifest("v1")
+	if err != nil || string(got) != string(content) || mediaType != MediaTypeManifest {
+		t.Fatalf("getManifest(v1) = %q, %q, %v", got, mediaType, err)
+	}
+	if _, _, err := r.getManifest(digestOf([]byte("other"))); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("getManifest by wrong digest: %v, want digest mismatch", err)
+	}
+	tr.badDigest = true
+	if _, _, err := r.getManifest("v1"); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("getManifest with wrong Docker-Content-Digest: %v, want digest mismatch", err)
+	}
+}
+
+// 下载的blob内容与digest不一致时拒绝，并且不留在存储中
+func TestFetchBlobDigestMismatch(t *testing.T) {
+	useTempStore(t)
+	tr, r := newTestRegistry(t, "", &RegistryOptions{})
+	good := []byte("good content")
+	tr.blobs[digestOf(good)] = good
+	if err := r.fetchBlob(Descriptor{Digest: digestOf(good), Size: int64(len(good))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.blobPath(digestOf(good))); err != nil {
+		t.Fatalf("fetched blob is not in store: %v", err)
+	}
+	bad := []byte("tampered content")
+	expect := digestOf([]byte("expected content"))
+	tr.blobs[expect] = bad
+	if err := r.fetchBlob(Descriptor{Digest: expect}); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("fetchBlob tampered: %v, want digest mismatch", err)
+	}
+	for _, digest := range []string{expect, digestOf(bad)} {
+		if _, err := os.Stat(store.blobPath(digest)); !os.IsNotExist(err) {
+			t.Fatalf("tampered blob %s left in store: %v", digest, err)
+		}
+	}
+}
+
+// 收到401后按照Basic与Bearer的challenge认证并重试
+func TestAuthenticate(t *testing.T) {
+	for _, auth := range []string{"basic", "bearer"} {
+		tr, r := newTestRegistry(t, auth, &RegistryOptions{Username: testUser, Password: testPassword})
+		content := []byte("blob content")
+		tr.blobs[digestOf(content)] = content
+		exists, err := r.blobExists(digestOf(content))
+		if err != nil || !exists {
+			t.Fatalf("%s: blobExists = %v, %v, want true", auth, exists, err)
+		}
+		want := "Bearer " + testToken
+		if auth == "basic" {
+			want = "Basic " + "dXNlcjpzZWNyZXQ="
+		}
+		if r.auth != want {
+			t.Fatalf("%s: Authorization = %q, want %q", auth, r.auth, want)
+		}
+
+		// 用户名密码错误时认证失败
+		_, r = newTestRegistry(t, auth, &RegistryOptions{Username: testUser, Password: "wrong"})
+		if exists, err := r.blobExists(digestOf(content)); err == nil {
+			t.Fatalf("%s with wrong password: blobExists = %v, want error", auth, exists)
+		}
+	}
+	_, r := newTestRegistry(t, "basic", &RegistryOptions{})
+	if _, err := r.blobExists(digestOf([]byte("x"))); err == nil || !strings.Contains(err.Error(), "requires authentication") {
+		t.Fatalf("basic without username: %v, want requires authentication", err)
+	}
+}
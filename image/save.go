@@ -0,0 +1,324 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 镜像包的格式
+const (
+	FormatDockerArchive = formatDockerArchive
+	FormatOCI           = formatOCI
+)
+
+// archiveWriter 向镜像包中写入blob，相同的blob只写一次
+type archiveWriter struct {
+	tw      *tar.Writer
+	written map[string]bool
+	dirs    map[string]bool
+	tmpDir  string
+	gzipped map[string]Descriptor // 未压缩的层对应的压缩后的描述
+}
+
+// Save 将镜像写入OCI image-layout或者docker-archive格式的tar包，未压缩的层在写入时压缩
+// refs可以是name:tag或者镜像ID，使用镜像ID时包中不记录镜像名
+func Save(w io.Writer, refs []string, format string) error {
+	if format != FormatOCI && format != FormatDockerArchive {
+		return fmt.Errorf(" unsupported format %s, use %s or %s", format, FormatOCI, FormatDockerArchive)
+	}
+	tmpRoot := filepath.Join(store.Root, "tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(tmpRoot, "save-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	aw := &archiveWriter{
+		tw:      tar.NewWriter(w),
+		written: make(map[string]bool),
+		dirs:    make(map[string]bool),
+		tmpDir:  tmpDir,
+		gzipped: make(map[string]Descriptor),
+	}
+	index := &Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	var entries []dockerManifestEntry
+	repositories := make(map[string]map[string]string)
+	for _, ref := range refs {
+		img, err := store.Get(ref)
+		if err != nil {
+			return err
+		}
+		// 按照name:tag引用时只记录这个名称，按照ID引用时不记录名称
+		name := ""
+		if parsed, err := ParseReference(ref); err == nil {
+			for _, tag := range img.RepoTags {
+				if tag == parsed {
+					name = parsed
+				}
+			}
+		}
+		layers, layerPaths, err := aw.writeLayers(img, format)
+		if err != nil {
+			return err
+		}
+		configPath, err := aw.writeBlob(img.ID, format, ".json")
+		if err != nil {
+			return err
+		}
+		if format == FormatOCI {
+			manifest := &Manifest{
+				SchemaVersion: 2,
+				MediaType:     MediaTypeManifest,
+				Config:        Descriptor{MediaType: MediaTypeConfig, Digest: img.ID, Size: img.Manifest.Config.Size},
+				Layers:        layers,
+			}
+			desc, err := aw.writeJSON(manifest)
+			if err != nil {
+				return err
+			}
+			desc.MediaType = MediaTypeManifest
+			if name != "" {
+				_, tag := SplitReference(name)
+				desc.Annotations = map[string]string{annotationRefName: tag, annotationContainerdRef: name}
+			}
+			index.Manifests = append(index.Manifests, IndexDescriptor{Descriptor: desc})
+			continue
+		}
+		entry := dockerManifestEntry{Config: configPath, Layers: layerPaths}
+		if name != "" {
+			entry.RepoTags = []string{name}
+			// repositories记录最上层的v1 ID，没有层的镜像不记录
+			if len(layerPaths) > 0 {
+				repo, tag := SplitReference(name)
+				if repositories[repo] == nil {
+					repositories[repo] = make(map[string]string)
+				}
+				repositories[repo][tag] = filepath.Dir(layerPaths[len(layerPaths)-1])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if format == FormatOCI {
+		if err := aw.writeFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+			return err
+		}
+		if err := aw.writeJSONFile("index.json", index); err != nil {
+			return err
+		}
+	} else {
+		if err := aw.writeJSONFile("manifest.json", entries); err != nil {
+			return err
+		}
+		if len(repositories) > 0 {
+			if err := aw.writeJSONFile("repositories", repositories); err != nil {
+				return err
+			}
+		}
+	}
+	return aw.tw.Close()
+}
+
+// writeLayers 写入镜像所有的层，返回压缩后的层描述与层在镜像包中的路径
+// docker-archive格式中每一层放在以v1 ID命名的目录下，v1 ID由层的chain ID与父层的v1 ID计算得到
+func (aw *archiveWriter) writeLayers(img *Image, format string) ([]Descriptor, []string, error) {
+	layers, paths := []Descriptor{}, []string{}
+	chainID, parentID := "", ""
+	for i, layer := range img.Manifest.Layers {
+		desc, err := aw.compressedLayer(layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		path := layoutBlob(desc.Digest)
+		if format == FormatDockerArchive {
+			chainID = chainOf(chainID, img.Config.RootFS.DiffIDs[i])
+			v1ID := sha256Hex(chainID + " " + parentID)
+			if err := aw.writeV1Layer(v1ID, parentID); err != nil {
+				return nil, nil, err
+			}
+			path, parentID = v1ID+"/layer.tar", v1ID
+		}
+		if err := aw.copyBlob(path, desc); err != nil {
+			return nil, nil, err
+		}
+		layers = append(layers, desc)
+		paths = append(paths, path)
+	}
+	return layers, paths, nil
+}
+
+// writeV1Layer 写入docker-archive格式中层目录的VERSION与json文件
+func (aw *archiveWriter) writeV1Layer(v1ID, parentID string) error {
+	if err := aw.writeFile(v1ID+"/VERSION", []byte("1.0")); err != nil {
+		return err
+	}
+	return aw.writeJSONFile(v1ID+"/json", struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent,omitempty"`
+	}{v1ID, parentID})
+}
+
+// chainOf 计算层的chain ID：第一层为diff_id，之后为sha256(父chain ID + " " + diff_id)
+func chainOf(parentChainID, diffID string) string {
+	if parentChainID == "" {
+		return diffID
+	}
+	return "sha256:" + sha256Hex(parentChainID+" "+diffID)
+}
+
+// sha256Hex 字符串的sha256
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// compressedLayer 获取gzip压缩的层，未压缩的层先压缩到临时目录中
+func (aw *archiveWriter) compressedLayer(layer Descriptor) (Descriptor, error) {
+	if layer.MediaType != MediaTypeLayer {
+		layer.MediaType = MediaTypeLayerGzip
+		return layer, nil
+	}
+	if desc, ok := aw.gzipped[layer.Digest]; ok {
+		return desc, nil
+	}
+	src, err := os.Open(store.blobPath(layer.Digest))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(aw.tmpDir, "layer-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer tmp.Close()
+	hash := sha256.New()
+	counter := &countWriter{}
+	gz := gzip.NewWriter(io.MultiWriter(tmp, hash, counter))
+	if _, err := io.Copy(gz, src); err != nil {
+		return Descriptor{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return Descriptor{}, err
+	}
+	desc := Descriptor{MediaType: MediaTypeLayerGzip, Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)), Size: counter.n}
+	// 压缩后的blob放在临时目录中，以digest命名
+	if err := os.Rename(tmp.Name(), filepath.Join(aw.tmpDir, strings.TrimPrefix(desc.Digest, "sha256:"))); err != nil {
+		return Descriptor{}, err
+	}
+	aw.gzipped[layer.Digest] = desc
+	return desc, nil
+}
+
+// blobName blob在镜像包中的路径：OCI格式为blobs/sha256/<hex>，docker-archive格式为<hex><suffix>
+func (aw *archiveWriter) blobName(digest, format, suffix string) string {
+	if format == FormatOCI {
+		return layoutBlob(digest)
+	}
+	return strings.TrimPrefix(digest, "sha256:") + suffix
+}
+
+// writeBlob 将存储中的blob写入镜像包，返回在包中的路径
+func (aw *archiveWriter) writeBlob(digest, format, suffix string) (string, error) {
+	info, err := os.Stat(store.blobPath(digest))
+	if err != nil {
+		return "", err
+	}
+	path := aw.blobName(digest, format, suffix)
+	return path, aw.copyBlob(path, Descriptor{Digest: digest, Size: info.Size()})
+}
+
+// copyBlob 从存储或者临时目录中复制blob到镜像包中
+func (aw *archiveWriter) copyBlob(path string, desc Descriptor) error {
+	if aw.written[path] {
+		return nil
+	}
+	src := filepath.Join(aw.tmpDir, strings.TrimPrefix(desc.Digest, "sha256:"))
+	if _, err := os.Stat(src); err != nil {
+		src = store.blobPath(desc.Digest)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := aw.writeHeader(path, desc.Size); err != nil {
+		return err
+	}
+	if _, err := io.Copy(aw.tw, f); err != nil {
+		return err
+	}
+	aw.written[path] = true
+	return nil
+}
+
+// writeJSON 将对象作为blob写入OCI镜像包
+func (aw *archiveWriter) writeJSON(v interface{}) (Descriptor, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	sum := sha256.Sum256(content)
+	desc := Descriptor{Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	return desc, aw.writeFile(layoutBlob(desc.Digest), content)
+}
+
+// writeJSONFile 将对象序列化后写入镜像包中的文件
+func (aw *archiveWriter) writeJSONFile(path string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return aw.writeFile(path, content)
+}
+
+// writeFile 向镜像包中写入一个文件
+func (aw *archiveWriter) writeFile(path string, content []byte) error {
+	if aw.written[path] {
+		return nil
+	}
+	if err := aw.writeHeader(path, int64(len(content))); err != nil {
+		return err
+	}
+	if _, err := aw.tw.Write(content); err != nil {
+		return err
+	}
+	aw.written[path] = true
+	return nil
+}
+
+// writeHeader 写入文件头，父目录不存在时先写入目录
+func (aw *archiveWriter) writeHeader(path string, size int64) error {
+	var parents []string
+	for dir := filepath.Dir(path); dir != "." && !aw.dirs[dir]; dir = filepath.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	epoch := time.Unix(0, 0)
+	for _, dir := range parents {
+		if err := aw.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0755, ModTime: epoch}); err != nil {
+			return err
+		}
+		aw.dirs[dir] = true
+	}
+	return aw.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: path, Mode: 0644, Size: size, ModTime: epoch})
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
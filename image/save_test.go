@@ -0,0 +1,109 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestImage 提交一个两层的镜像：第二层修改并删除第一层中的文件
+func newTestImage(t *testing.T, ref string) *Image {
+	base := t.TempDir()
+	for name, content := range map[string]string{"etc/hostname": "demo", "bin/app": "#!/bin/sh\n", "tmp/remove": "x"} {
+		path := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parent, err := Commit("", base, "", &CommitOptions{CreatedBy: "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(upper, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(upper, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "etc/hostname"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "tmp", WhiteoutPrefix+"remove"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Commit(parent.ID, upper, ref, &CommitOptions{CreatedBy: "upper", Changes: []string{`CMD ["/bin/app"]`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// 保存的镜像包加载到另一个存储后得到相同的镜像ID、层与名称
+func TestSaveLoadRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatDockerArchive, FormatOCI} {
+		t.Run(format, func(t *testing.T) {
+			useTempStore(t)
+			img := newTestImage(t, "demo:v1")
+			untagged, err := Commit(img.ID, "", "", &CommitOptions{Changes: []string{"ENV A=1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(t.TempDir(), "images.tar")
+			f, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Save(f, []string{"demo:v1", untagged.ID}, format); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			useTempStore(t)
+			loaded, err := Load(archive, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != 2 {
+				t.Fatalf("loaded %d images, want 2", len(loaded))
+			}
+			got := map[string]*Image{}
+			for _, l := range loaded {
+				got[l.ID] = l
+			}
+			for _, want := range []*Image{img, untagged} {
+				l, ok := got[want.ID]
+				if !ok {
+					t.Fatalf("image %s is not loaded, got %v", want.ID, loaded)
+				}
+				if !reflect.DeepEqual(l.Config.RootFS.DiffIDs, want.Config.RootFS.DiffIDs) {
+					t.Errorf("diff ids = %v, want %v", l.Config.RootFS.DiffIDs, want.Config.RootFS.DiffIDs)
+				}
+				for _, diffID := range l.Config.RootFS.DiffIDs {
+					if _, err := os.Stat(store.LayerPath(diffID)); err != nil {
+						t.Errorf("layer %s is not unpacked: %v", diffID, err)
+					}
+				}
+			}
+			if tags := got[img.ID].RepoTags; !reflect.DeepEqual(tags, []string{"demo:v1"}) {
+				t.Errorf("tags of saved image = %v, want demo:v1", tags)
+			}
+			if tags := got[untagged.ID].RepoTags; len(tags) != 0 {
+				t.Errorf("image saved by id has tags %v", tags)
+			}
+			// 第二层中的whiteout原样保存
+			content, err := ioutil.ReadFile(filepath.Join(store.LayerPath(img.Config.RootFS.DiffIDs[1]), "etc/hostname"))
+			if err != nil || string(content) != "changed" {
+				t.Errorf("etc/hostname in upper layer = %q, %v", content, err)
+			}
+			if _, err := os.Stat(filepath.Join(store.LayerPath(img.Config.RootFS.DiffIDs[1]), "tmp", WhiteoutPrefix+"remove")); err != nil {
+				t.Errorf("whiteout in upper layer: %v", err)
+			}
+		})
+	}
+}
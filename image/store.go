@@ -0,0 +1,349 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"xwj/mydocker/log"
+)
+
+const (
+	DefaultRoot      = "/var/lib/mydocker/image/"     // 镜像存储的根目录
+	DefaultLayerRoot = "/var/lib/mydocker/aufs/diff/" // 解压后的镜像层所在目录，与容器的读写层在同一个目录下，交给aufs挂载
+	repositoriesName = "repositories.json"
+	lockName         = "repositories.lock"
+)
+
+var digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// Store 内容寻址的本地镜像存储
+// blobs/sha256/<hex>存放层的tar包、镜像配置与manifest，层解压后放在LayerRoot/<diff_id hex>下
+// repositories.json记录name:tag到镜像ID的映射、每个镜像的manifest、构建缓存以及每个层的大小与使用它的容器
+type Store struct {
+	Root      string                  `json:"-"`                // 镜像存储的根目录
+	LayerRoot string                  `json:"-"`                // 解压后的镜像层所在目录
+	Refs      map[string]string       `json:"refs"`             // name:tag到镜像ID的映射
+	Images    map[string]*imageRecord `json:"images"`           // 镜像ID到镜像记录的映射
+	Cache     map[string]string       `json:"cache,omitempty"`  // 构建缓存，父镜像与指令的key到构建出的镜像ID的映射
+	Layers    map[string]*layerRecord `json:"layers,omitempty"` // 解压后的层的diff_id到层记录的映射
+	Leases    map[string]*leaseRecord `json:"leases,omitempty"` // 正在写入内容的操作，其中的blob与层不会被清理
+
+	locked  bool   // 当前进程是否持有文件锁
+	leaseID string // 当前进程正在使用的lease
+}
+
+// imageRecord 一个镜像的记录
+type imageRecord struct {
+	Manifest string    `json:"manifest"` // manifest的digest
+	Loaded   time.Time `json:"loaded"`   // 加入本地存储的时间
+}
+
+// 默认的镜像存储
+var store = &Store{
+	Root:      DefaultRoot,
+	LayerRoot: DefaultLayerRoot,
+}
+
+// blobPath 内容寻址的blob文件路径
+func (s *Store) blobPath(digest string) string {
+	return filepath.Join(s.Root, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// LayerPath 解压后的镜像层目录
+func (s *Store) LayerPath(diffID string) string {
+	return filepath.Join(s.LayerRoot, strings.TrimPrefix(diffID, "sha256:"))
+}
+
+// lock 对镜像存储加文件锁，返回解锁函数
+func (s *Store) lock() (func(), error) {
+	if err := os.MkdirAll(s.Root, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.Root, lockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// load 加载镜像记录
+func (s *Store) load() error {
+	s.Refs = make(map[string]string)
+	s.Images = make(map[string]*imageRecord)
+	s.Cache = make(map[string]string)
+	s.Layers = make(map[string]*layerRecord)
+	s.Leases = make(map[string]*leaseRecord)
+	content, err := ioutil.ReadFile(filepath.Join(s.Root, repositoriesName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(content, s); err != nil {
+		return err
+	}
+	if s.Refs == nil {
+		s.Refs = make(map[string]string)
+	}
+	if s.Images == nil {
+		s.Images = make(map[string]*imageRecord)
+	}
+	if s.Cache == nil {
+		s.Cache = make(map[string]string)
+	}
+	if s.Layers == nil {
+		s.Layers = make(map[string]*layerRecord)
+	}
+	if s.Leases == nil {
+		s.Leases = make(map[string]*leaseRecord)
+	}
+	return nil
+}
+
+// dump 先写入临时文件再重命名，原子地保存镜像记录
+func (s *Store) dump() error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Root, repositoriesName)
+	if err := ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// view 在文件锁的保护下加载镜像记录并执行只读的操作
+func (s *Store) view(fn func() error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.locked = true
+	defer func() { s.locked = false }()
+	if err := s.load(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// update 在文件锁的保护下加载镜像记录，执行修改并写回
+func (s *Store) update(fn func() error) error {
+	return s.view(func() error {
+		if err := fn(); err != nil {
+			return err
+		}
+		return s.dump()
+	})
+}
+
+// putBlob 将内容写入blob存储，返回内容的digest与大小，相同的内容只保存一份
+func (s *Store) putBlob(r io.Reader) (string, int64, error) {
+	dir := filepath.Dir(s.blobPath("sha256:0"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	// 在文件锁的保护下记录到lease中再让blob可见，清理时不会删除还没有被镜像引用的blob
+	err = s.withLock(func() error {
+		s.leaseContent(digest)
+		if _, err := os.Stat(s.blobPath(digest)); err == nil {
+			return nil
+		}
+		return os.Rename(tmp.Name(), s.blobPath(digest))
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return digest, size, nil
+}
+
+// putJSON 将对象序列化为json后写入blob存储
+func (s *Store) putJSON(v interface{}) (string, int64, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+	return s.putBlob(strings.NewReader(string(content)))
+}
+
+// readBlob 读取blob并校验内容的digest
+func (s *Store) readBlob(digest string) ([]byte, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, fmt.Errorf(" invalid digest: %s", digest)
+	}
+	content, err := ioutil.ReadFile(s.blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(content); "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf(" blob %s is corrupted", digest)
+	}
+	return content, nil
+}
+
+// readJSON 读取blob并反序列化
+func (s *Store) readJSON(digest string, v interface{}) error {
+	content, err := s.readBlob(digest)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// addImage 保存镜像的manifest并让refs指向这个镜像，返回镜像ID
+func (s *Store) addImage(manifest *Manifest, refs ...string) (string, error) {
+	manifestDigest, _, err := s.putJSON(manifest)
+	if err != nil {
+		return "", err
+	}
+	id := manifest.Config.Digest
+	err = s.update(func() error {
+		if _, ok := s.Images[id]; !ok {
+			s.Images[id] = &imageRecord{Manifest: manifestDigest, Loaded: time.Now()}
+		} else {
+			s.Images[id].Manifest = manifestDigest
+		}
+		config := &Config{}
+		if err := s.readJSON(id, config); err != nil {
+			return err
+		}
+		for _, diffID := range config.RootFS.DiffIDs {
+			s.recordLayer(diffID)
+		}
+		for _, ref := range refs {
+			if old, ok := s.Refs[ref]; ok && old != id {
+				log.Log.Infof("image %s moved from %s to %s", ref, ShortID(old), ShortID(id))
+			}
+			s.Refs[ref] = id
+		}
+		return nil
+	})
+	return id, err
+}
+
+// lookup 根据name:tag、镜像ID或者镜像ID的前缀查找镜像ID，调用前需要已经加载镜像记录
+func (s *Store) lookup(ref string) (string, error) {
+	if name, err := ParseReference(ref); err == nil {
+		if id, ok := s.Refs[name]; ok {
+			return id, nil
+		}
+	}
+	prefix := ref
+	if !strings.HasPrefix(prefix, "sha256:") {
+		prefix = "sha256:" + prefix
+	}
+	var found []string
+	for id := range s.Images {
+		if strings.HasPrefix(id, prefix) {
+			found = append(found, id)
+		}
+	}
+	switch {
+	case len(found) == 1 && len(ref) >= 4:
+		return found[0], nil
+	case len(found) > 1:
+		return "", fmt.Errorf(" image id prefix %s is ambiguous", ref)
+	}
+	return "", fmt.Errorf(" image %s not found", ref)
+}
+
+// image 读取镜像的manifest与配置，调用前需要已经加载镜像记录
+func (s *Store) image(id string) (*Image, error) {
+	rec, ok := s.Images[id]
+	if !ok {
+		return nil, fmt.Errorf(" image %s not found", id)
+	}
+	img := &Image{ID: id, Manifest: &Manifest{}, Config: &Config{}}
+	if err := s.readJSON(rec.Manifest, img.Manifest); err != nil {
+		return nil, err
+	}
+	if err := s.readJSON(id, img.Config); err != nil {
+		return nil, err
+	}
+	for ref, refID := range s.Refs {
+		if refID == id {
+			img.RepoTags = append(img.RepoTags, ref)
+		}
+	}
+	sort.Strings(img.RepoTags)
+	return img, nil
+}
+
+// Get 根据name:tag、镜像ID或者镜像ID的前缀获取镜像
+func (s *Store) Get(ref string) (*Image, error) {
+	var img *Image
+	err := s.view(func() error {
+		id, err := s.lookup(ref)
+		if err != nil {
+			return err
+		}
+		img, err = s.image(id)
+		return err
+	})
+	return img, err
+}
+
+// Get 从默认的镜像存储中获取镜像
+func Get(ref string) (*Image, error) {
+	return store.Get(ref)
+}
+
+// Resolve 获取容器使用的镜像，ref可以是镜像引用，也可以是兼容旧版本的镜像tar包路径
+// tar包路径会先加载到镜像存储中，相同内容的tar包只会解压一次
+func Resolve(ref string) (*Image, error) {
+	img, err := store.Get(ref)
+	if err == nil {
+		return img, nil
+	}
+	if info, statErr := os.Stat(ref); statErr == nil && info.Mode().IsRegular() {
+		images, err := Load(ref, "")
+		if err != nil {
+			return nil, err
+		}
+		return images[0], nil
+	}
+	return nil, err
+}
+
+// LayerPaths 镜像所有层解压后的目录，从最上层开始，可以直接作为aufs的只读分支
+func (img *Image) LayerPaths() []string {
+	diffIDs := img.Config.RootFS.DiffIDs
+	paths := make([]string, 0, len(diffIDs))
+	for i := len(diffIDs) - 1; i >= 0; i-- {
+		paths = append(paths, store.LayerPath(diffIDs[i]))
+	}
+	return paths
+}
@@ -0,0 +1,100 @@
+package image
+
+import (
+	"sort"
+	"time"
+)
+
+// 镜像相关的媒体类型，与OCI镜像规范一致
+const (
+	MediaTypeManifest     = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig       = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer        = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeImageIndex   = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerLayer  = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Descriptor 指向一个内容寻址的blob
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest 镜像的manifest，记录配置与所有层的blob
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Config 镜像的配置，镜像ID就是配置内容的sha256
+type Config struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config,omitempty"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// ContainerConfig 镜像中记录的容器运行默认参数
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+// RootFS 镜像的根文件系统由哪些层组成，diff_ids是每一层未压缩tar包的sha256，从最底层开始
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History 镜像每一步构建的历史记录
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// Image 本地存储中的一个镜像
+type Image struct {
+	ID       string    // 镜像ID，即配置的digest
+	RepoTags []string  // 指向这个镜像的所有name:tag
+	Manifest *Manifest // 镜像的manifest
+	Config   *Config   // 镜像的配置
+}
+
+// Command 容器启动的命令：Entrypoint加上参数，args为空时使用镜像配置的Cmd作为参数
+func (img *Image) Command(args []string) []string {
+	cfg := img.Config.Config
+	if len(args) == 0 {
+		args = cfg.Cmd
+	}
+	return append(append([]string{}, cfg.Entrypoint...), args...)
+}
+
+// ExposedPorts 镜像EXPOSE的端口，格式为port[-end]/proto，按字典序排列
+func (img *Image) ExposedPorts() []string {
+	ports := make([]string, 0, len(img.Config.Config.ExposedPorts))
+	for port := range img.Config.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return ports
+}
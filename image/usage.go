@@ -0,0 +1,99 @@
+package image
+
+import "sort"
+
+// ImageUsage 一个镜像占用的空间
+type ImageUsage struct {
+	ID         string   // 镜像ID
+	RepoTags   []string // 镜像的name:tag
+	Size       int64    // 所有层的大小
+	SharedSize int64    // 与其他镜像共享的层的大小
+	UniqueSize int64    // 只属于这个镜像的层的大小，删除镜像后释放
+	Containers int      // 使用这个镜像的容器数
+}
+
+// DiskUsage 镜像存储占用的空间
+type DiskUsage struct {
+	Images      []*ImageUsage
+	Active      int   // 被容器使用的镜像数
+	Size        int64 // 所有解压后的层去重后的大小
+	Reclaimable int64 // 没有被容器使用的层的大小，prune --all后释放
+}
+
+// Usage 根据层记录中的大小统计镜像占用的空间，没有记录的层统计一次后写入记录
+// inUse为镜像ID到使用它的容器的映射
+func Usage(inUse map[string][]string) (*DiskUsage, error) {
+	usage := &DiskUsage{}
+	err := store.update(func() error {
+		images := make(map[string]*Image)
+		refs := make(map[string]int) // 层被多少个镜像引用
+		for id := range store.Images {
+			img, err := store.image(id)
+			if err != nil {
+				return err
+			}
+			images[id] = img
+			for _, diffID := range uniqueStrings(img.Config.RootFS.DiffIDs) {
+				refs[diffID]++
+			}
+		}
+		// 被容器使用的镜像的层以及被容器直接引用的层都不能释放
+		containers := make(map[string]bool)
+		for _, ids := range inUse {
+			for _, id := range ids {
+				containers[id] = true
+			}
+		}
+		active := make(map[string]bool)
+		for diffID, rec := range store.Layers {
+			for _, id := range rec.Containers {
+				if containers[id] {
+					active[diffID] = true
+				}
+			}
+		}
+		for id, img := range images {
+			iu := &ImageUsage{ID: id, RepoTags: img.RepoTags, Containers: len(inUse[id])}
+			for _, diffID := range uniqueStrings(img.Config.RootFS.DiffIDs) {
+				size := store.recordLayer(diffID).Size
+				iu.Size += size
+				if refs[diffID] > 1 {
+					iu.SharedSize += size
+				} else {
+					iu.UniqueSize += size
+				}
+				if iu.Containers > 0 {
+					active[diffID] = true
+				}
+			}
+			if iu.Containers > 0 {
+				usage.Active++
+			}
+			usage.Images = append(usage.Images, iu)
+		}
+		for diffID, rec := range store.Layers {
+			usage.Size += rec.Size
+			if !active[diffID] {
+				usage.Reclaimable += rec.Size
+			}
+		}
+		return nil
+	})
+	sort.Slice(usage.Images, func(i, j int) bool {
+		return usage.Images[i].Size > usage.Images[j].Size
+	})
+	return usage, err
+}
+
+// uniqueStrings 去掉切片中重复的字符串，同一个层可能在镜像中出现多次
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package image
+
+import (
+	"testing"
+	"xwj/mydocker/utils"
+)
+
+// 共享的层计入SharedSize，只属于一个镜像的层计入UniqueSize；被容器使用的镜像以及被容器引用的层不可释放
+func TestUsage(t *testing.T) {
+	useTempStore(t)
+	img := newTestImage(t, "demo:v1")
+	diffIDs := img.Config.RootFS.DiffIDs
+	base, top := utils.DirSize(store.LayerPath(diffIDs[0])), utils.DirSize(store.LayerPath(diffIDs[1]))
+	if base <= 0 || top <= 0 {
+		t.Fatalf("layer sizes = %d, %d, want > 0", base, top)
+	}
+	var parentID string
+	for id := range store.Images {
+		if id != img.ID {
+			parentID = id
+		}
+	}
+	usage := func(inUse map[string][]string) (*DiskUsage, map[string]*ImageUsage) {
+		u, err := Usage(inUse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]*ImageUsage)
+		for _, iu := range u.Images {
+			byID[iu.ID] = iu
+		}
+		return u, byID
+	}
+
+	u, byID := usage(nil)
+	if len(u.Images) != 2 || u.Images[0].ID != img.ID {
+		t.Fatalf("Images = %+v, want the child image first", u.Images)
+	}
+	if got := byID[img.ID]; got.Size != base+top || got.SharedSize != base || got.UniqueSize != top || got.Containers != 0 {
+		t.Errorf("child usage = %+v, want %d shared and %d unique", got, base, top)
+	}
+	if got := byID[parentID]; got.Size != base || got.SharedSize != base || got.UniqueSize != 0 {
+		t.Errorf("parent usage = %+v, want size %d shared", got, base)
+	}
+	if u.Active != 0 || u.Size != base+top || u.Reclaimable != base+top {
+		t.Errorf("usage = %+v, want nothing active and %d reclaimable", u, base+top)
+	}
+
+	// 容器使用父镜像时只有子镜像的层可以释放
+	u, byID = usage(map[string][]string{parentID: {"c1"}})
+	if u.Active != 1 || u.Reclaimable != top || byID[parentID].Containers != 1 {
+		t.Errorf("usage with parent in use = %+v, want 1 active and %d reclaimable", u, top)
+	}
+
+	// 镜像被删除后容器仍然引用的层也不能释放
+	if err := Acquire("c2", img); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = usage(map[string][]string{"removed": {"c2"}})
+	if u.Active != 0 || u.Reclaimable != 0 {
+		t.Errorf("usage with layers held by a container = %+v, want nothing reclaimable", u)
+	}
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	tbfLatencyUsec = 25000     // tbf队列中数据包最多等待的时间(微秒)
+	tbfMinBurst    = 32 * 1024 // 令牌桶的最小容量(字节)，不能小于一个数据包
+)
+
+// Bandwidth 网络端点的带宽限制，速率的单位是bit/s
+// 宿主机一端Veth发出的流量就是容器收到的流量，直接在Veth上用tbf整形
+// 容器发出的流量是宿主机一端Veth收到的流量，通过ingress队列重定向到IFB设备后再用tbf整形
+type Bandwidth struct {
+	Egress  uint64 `json:"egress,omitempty"`  // 容器发出流量的速率上限
+	Ingress uint64 `json:"ingress,omitempty"` // 容器收到流量的速率上限
+	IFB     string `json:"ifb,omitempty"`     // 对容器发出的流量整形的IFB设备名
+}
+
+// rateUnits 速率的单位，与tc一致：bit为比特每秒，bps为字节每秒
+var rateUnits = []struct {
+	suffix string
+	factor uint64
+}{
+	{"kbit", 1000}, {"mbit", 1000 * 1000}, {"gbit", 1000 * 1000 * 1000}, {"bit", 1},
+	{"kbps", 8 * 1000}, {"mbps", 8 * 1000 * 1000}, {"gbps", 8 * 1000 * 1000 * 1000}, {"bps", 8},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+}
+
+// parseRate 解析速率字符串，例如10mbit、1gbit、500kbps，没有单位时为bit/s
+func parseRate(rate string) (uint64, error) {
+	value := strings.ToLower(strings.TrimSpace(rate))
+	factor := uint64(1)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf(" invalid rate: %s", rate)
+	}
+	bits := uint64(n * float64(factor))
+	// 速率过低时令牌桶无法工作
+	if bits < 8 {
+		return 0, fmt.Errorf(" rate %s is too low", rate)
+	}
+	return bits, nil
+}
+
+// newBandwidth 解析容器运行时指定的速率限制，都没有指定时返回nil
+func newBandwidth(rateOut, rateIn string) (*Bandwidth, error) {
+	if rateOut == "" && rateIn == "" {
+		return nil, nil
+	}
+	bw := &Bandwidth{}
+	var err error
+	if rateOut != "" {
+		if bw.Egress, err = parseRate(rateOut); err != nil {
+			return nil, err
+		}
+	}
+	if rateIn != "" {
+		if bw.Ingress, err = parseRate(rateIn); err != nil {
+			return nil, err
+		}
+	}
+	return bw, nil
+}
+
+// setupBandwidth 在宿主机一端的Veth上配置网络端点的带宽限制
+func setupBandwidth(ep *Endpoint, hostLink netlink.Link) error {
+	bw := ep.Bandwidth
+	if bw == nil {
+		return nil
+	}
+	// 容器收到的流量：宿主机一端Veth的根队列
+	if bw.Ingress > 0 {
+		if err := addTbf(hostLink, bw.Ingress); err != nil {
+			return fmt.Errorf(" Error add tbf qdisc on %s: %v", hostLink.Attrs().Name, err)
+		}
+	}
+	if bw.Egress == 0 {
+		return nil
+	}
+	// 容器发出的流量：创建IFB设备并在其上整形
+	la := netlink.NewLinkAttrs()
+	la.Name = endpointLinkNames(ep.ID, "ifb-")[0]
+	la.MTU = hostLink.Attrs().MTU
+	ifb := &netlink.Ifb{LinkAttrs: la}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		return fmt.Errorf(" Error add ifb device %s: %v", la.Name, err)
+	}
+	bw.IFB = la.Name
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return fmt.Errorf(" Error set ifb device %s up: %v", la.Name, err)
+	}
+	if err := addTbf(ifb, bw.Egress); err != nil {
+		return fmt.Errorf(" Error add tbf qdisc on %s: %v", la.Name, err)
+	}
+	// 宿主机一端Veth收到的所有流量都重定向到IFB设备
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostLink.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf(" Error add ingress qdisc on %s: %v", hostLink.Attrs().Name, err)
+	}
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostLink.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf(" Error add redirect filter on %s: %v", hostLink.Attrs().Name, err)
+	}
+	return nil
+}
+
+// removeBandwidth 删除网络端点的带宽限制，Veth已经不存在时其上的队列也随之删除
+func removeBandwidth(ep *Endpoint) error {
+	if ep.Bandwidth == nil {
+		return nil
+	}
+	if link, err := netlink.LinkByName(ep.Device.Name); err == nil {
+		qdiscs, err := netlink.QdiscList(link)
+		if err != nil {
+			return err
+		}
+		for _, qdisc := range qdiscs {
+			switch qdisc.(type) {
+			case *netlink.Tbf, *netlink.Ingress:
+				if err := netlink.QdiscDel(qdisc); err != nil {
+					return fmt.Errorf(" Error delete qdisc on %s: %v", ep.Device.Name, err)
+				}
+			}
+		}
+	}
+	return deleteLinkIfExist(ep.Bandwidth.IFB)
+}
+
+// addTbf 在网络设备的根队列上添加tbf令牌桶，rate的单位是bit/s
+func addTbf(link netlink.Link, rate uint64) error {
+	rateBytes := rate / 8
+	// 令牌桶容量取100ms的流量，至少能容纳一个大包
+	burst := rateBytes / 10
+	if burst < tbfMinBurst {
+		burst = tbfMinBurst
+	}
+	bufferTicks := uint32(float64(burst) * netlink.TIME_UNITS_PER_SEC / float64(rateBytes) * netlink.TickInUsec())
+	limit := uint32(float64(rateBytes)*tbfLatencyUsec/netlink.TIME_UNITS_PER_SEC) + uint32(burst)
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateBytes,
+		Limit:  limit,
+		Buffer: bufferTicks,
+	}
+	return netlink.QdiscAdd(tbf)
+}
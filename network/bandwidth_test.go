@@ -0,0 +1,57 @@
+package network
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want uint64
+		err  bool
+	}{
+		{rate: "1000", want: 1000},
+		{rate: "100bit", want: 100},
+		{rate: "10kbit", want: 10 * 1000},
+		{rate: "10mbit", want: 10 * 1000 * 1000},
+		{rate: "1Gbit", want: 1000 * 1000 * 1000},
+		{rate: " 1.5mbit ", want: 1500 * 1000},
+		// bps为字节每秒
+		{rate: "100bps", want: 800},
+		{rate: "500kbps", want: 500 * 8 * 1000},
+		{rate: "2mbps", want: 2 * 8 * 1000 * 1000},
+		{rate: "1gbps", want: 8 * 1000 * 1000 * 1000},
+		{rate: "10k", want: 10 * 1000},
+		{rate: "10M", want: 10 * 1000 * 1000},
+		{rate: "1g", want: 1000 * 1000 * 1000},
+		{rate: "7bit", err: true},
+		{rate: "0", err: true},
+		{rate: "-1mbit", err: true},
+		{rate: "mbit", err: true},
+		{rate: "10tbit", err: true},
+		{rate: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.rate)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseRate(%q) = %d, want error", tt.rate, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseRate(%q) = %d, %v, want %d", tt.rate, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewBandwidth(t *testing.T) {
+	if bw, err := newBandwidth("", ""); bw != nil || err != nil {
+		t.Fatalf("newBandwidth without rates = %+v, %v, want nil", bw, err)
+	}
+	bw, err := newBandwidth("1mbit", "")
+	if err != nil || bw.Egress != 1000*1000 || bw.Ingress != 0 {
+		t.Fatalf("newBandwidth(1mbit, \"\") = %+v, %v", bw, err)
+	}
+	if _, err := newBandwidth("1mbit", "fast"); err == nil {
+		t.Fatal("newBandwidth with invalid ingress rate, want error")
+	}
+}
@@ -3,10 +3,22 @@ package network
 import (
 	"fmt"
 	"github.com/vishvananda/netlink"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
 	"strings"
 	"xwj/mydocker/log"
+
+	"golang.org/x/sys/unix"
+)
+
+const bridgeDriverName = "bridge"
+
+// bridge网络的选项
+const (
+	iccOption      = "icc"      // 为false时禁止同一网络中容器之间的通信，发布的端口除外
+	internalOption = "internal" // 为true时网络不做SNAT，容器无法访问外部网络
 )
 
 // BridgeNetworkDriver Bridge网络驱动
@@ -17,7 +29,11 @@ type BridgeNetworkDriver struct {
 func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 	// 1. 创建Bridge虚拟设备
 	bridgeName := n.Name
-	if err := createBridgeInterface(bridgeName); err != nil {
+	mtu, err := networkMTU(n)
+	if err != nil {
+		return err
+	}
+	if err := createBridgeInterface(bridgeName, mtu); err != nil {
 		return fmt.Errorf(" Error add bridge： %s, Error: %v", bridgeName, err)
 	}
 	// 2. 设置Bridge设备的地址和路由
@@ -26,23 +42,45 @@ func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 	if err := setInterfaceIP(bridgeName, gatewayIp.String()); err != nil {
 		return fmt.Errorf(" Error assigning address: %s on bridge: %s with an error of: %v", gatewayIp, bridgeName, err)
 	}
+	// 双栈网络同时设置Bridge设备的IPv6地址，并开启IPv6转发
+	if n.IpRange6 != nil {
+		if err := setInterfaceIP(bridgeName, n.IpRange6.String()); err != nil {
+			return fmt.Errorf(" Error assigning address: %s on bridge: %s with an error of: %v", n.IpRange6, bridgeName, err)
+		}
+		if err := enableIPv6Forwarding(); err != nil {
+			log.Log.Warnf("enable ipv6 forwarding error: %v", err)
+		}
+	}
 	// 3. 启动Bridge设备
 	if err := setInterfaceUP(bridgeName); err != nil {
 		return fmt.Errorf(" Error set bridge up: %s, Error: %v", bridgeName, err)
 	}
 
-	// 4. 设置iptables的SNAT规则
-	if err := setupIPTables(bridgeName, n.IpRange); err != nil {
-		return fmt.Errorf(" Error setting iptables for %s: %v", bridgeName, err)
+	// 4. 允许宿主机通过localhost访问发布的端口
+	if err := enableRouteLocalnet(bridgeName); err != nil {
+		log.Log.Warnf("enable route_localnet on %s error: %v", bridgeName, err)
+	}
+	// 5. 禁止容器间通信时需要网桥上的流量经过防火墙
+	// 无法开启时DROP规则对网桥上的流量不起作用，不能创建一个看起来隔离实际上不隔离的网络
+	if !iccEnabled(n) {
+		if err := enableBridgeNFCall(n.IpRange6 != nil); err != nil {
+			_ = deleteLinkIfExist(bridgeName)
+			return fmt.Errorf(" --icc=false requires bridged traffic to pass the firewall: %v", err)
+		}
+	}
+	// 6. 设置防火墙的SNAT与转发规则
+	if err := setupNetworkFirewall(n); err != nil {
+		_ = deleteLinkIfExist(bridgeName)
+		return fmt.Errorf(" Error setting firewall for %s: %v", bridgeName, err)
 	}
 	return nil
 }
 
 func (d *BridgeNetworkDriver) Name() string {
-	return "bridge"
+	return bridgeDriverName
 }
 
-func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, error) {
+func (d *BridgeNetworkDriver) Create(subnet, subnet6 string, name string, options map[string]string) (*Network, error) {
 	// 获取网段字符串的网关IP地址和网络IP段
 	ip, ipRange, err := net.ParseCIDR(subnet)
 	if err != nil {
@@ -55,6 +93,16 @@ func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, erro
 		Name:    name,
 		IpRange: ipRange,
 		Driver:  d.Name(),
+		Options: options,
+	}
+	if subnet6 != "" {
+		ip6, ipRange6, err := net.ParseCIDR(subnet6)
+		if err != nil {
+			log.Log.Error(err)
+			return nil, err
+		}
+		ipRange6.IP = ip6
+		n.IpRange6 = ipRange6
 	}
 	// 初始化配置Linux Bridge
 	if err := d.initBridge(n); err != nil {
@@ -67,15 +115,12 @@ func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, erro
 
 // Delete 删除Bridge网络设备
 func (d *BridgeNetworkDriver) Delete(network *Network) error {
-	// 网络名即Linux Bridge的设备名
-	bridgeName := network.Name
-	// 通过netlink找到对应的设备
-	iface, err := netlink.LinkByName(bridgeName)
-	if err != nil {
-		return fmt.Errorf(" error get interface: %v", err)
+	// 先删除网络的防火墙规则，网桥已经不存在(例如重启或者手动删除)时规则仍然需要清理
+	if err := cleanupNetworkFirewall(network); err != nil {
+		return err
 	}
-	// 删除网络对应的Linux Bridge设备
-	return netlink.LinkDel(iface)
+	// 删除网络对应的Linux Bridge设备，网络名即设备名，设备已经不存在时视为删除成功
+	return deleteLinkIfExist(network.Name)
 }
 
 // Connect 创建Veth并连接网络与Veth网络端点
@@ -88,18 +133,27 @@ func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 		return fmt.Errorf(" error get interface: %v", err)
 	}
 
+	mtu, err := networkMTU(network)
+	if err != nil {
+		return err
+	}
 	// 创建Veth接口的配置
 	la := netlink.NewLinkAttrs()
-	// 由于Linux接口名的限制，所以名字取前5位
-	la.Name = endpoint.ID[:5]
+	// 由于Linux接口名的限制，宿主机一端与容器一端的名字都取自端点ID的哈希，容器一端移入容器后会重命名为eth0
+	names := endpointLinkNames(endpoint.ID, "veth", "ceth")
+	la.Name = names[0]
 	// 通过设置Veth接口的master属性，设置这个Veth的一端挂载到网络对应的Linux Bridge上
 	la.MasterIndex = br.Attrs().Index
+	// Veth两端的MTU与网络一致
+	la.MTU = mtu
 
-	// 创建Veth对象，通过PeerName配置Veth另一端的接口名cif-{endpoint ID前5位}
+	// 创建Veth对象，通过PeerName配置Veth另一端的接口名，容器一端使用网络端点的MAC地址
 	endpoint.Device = netlink.Veth{
-		LinkAttrs: la,
-		PeerName:  "cif-" + endpoint.ID[:5],
+		LinkAttrs:        la,
+		PeerName:         names[1],
+		PeerHardwareAddr: endpoint.MacAddress,
 	}
+	endpoint.LinkName = endpoint.Device.PeerName
 
 	// 调用netlink的LinkAdd方法创建出这个Veth接口
 	// 因为上面已经指定了link的MasterIndex是网络接口Bridge，所以一端即已经挂载在Bridge上了
@@ -110,16 +164,26 @@ func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 	if err := netlink.LinkSetUp(&endpoint.Device); err != nil {
 		return fmt.Errorf(" Error set Endpoint Device up: %v", err)
 	}
-	return nil
+	// 开启hairpin模式，允许从这个端口进入网桥的流量再从这个端口转发回去
+	// 容器通过宿主机发布的端口访问自己时，DNAT之后的流量需要回到同一个Veth
+	if err := netlink.LinkSetHairpin(&endpoint.Device, true); err != nil {
+		return fmt.Errorf(" Error set Endpoint Device hairpin: %v", err)
+	}
+	// 在宿主机一端的Veth上配置带宽限制
+	return setupBandwidth(endpoint, &endpoint.Device)
 }
 
+// Disconnect 删除网络端点的Veth，容器的Net Namespace销毁时Veth也会被删除，这里只处理仍然存在的情况
 func (d *BridgeNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
-	// TODO 取消连接
-	return nil
+	// 删除带宽限制的队列与IFB设备
+	if err := removeBandwidth(endpoint); err != nil {
+		return err
+	}
+	return deleteLinkIfExist(endpoint.Device.Name)
 }
 
 // createBridgeInterface 创建一个Bridge网络驱动/虚拟设备
-func createBridgeInterface(bridgeName string) error {
+func createBridgeInterface(bridgeName string, mtu int) error {
 	// 先检查是否存在同名的Bridge设备
 	iface, err := net.InterfaceByName(bridgeName)
 	if iface != nil || err == nil || !strings.Contains(err.Error(), "no such network interface") {
@@ -128,6 +192,8 @@ func createBridgeInterface(bridgeName string) error {
 	// 初始化一个netlink的link基础对象，link的名字就是bridge的名字
 	la := netlink.NewLinkAttrs()
 	la.Name = bridgeName
+	// mtu为0时使用内核的默认值
+	la.MTU = mtu
 	// 使用刚才创建的Link的属性创建netlink的Bridge对象
 	br := &netlink.Bridge{LinkAttrs: la}
 	// 调用netlink的LinkAdd方法，创建Bridge虚拟网络设备
@@ -157,6 +223,10 @@ func setInterfaceIP(name string, rawIP string) error {
 		Flags: 0,
 		Scope: 0,
 	}
+	// IPv6地址跳过重复地址检测，否则地址在检测完成前无法使用
+	if ipNet.IP.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
 	return netlink.AddrAdd(iface, addr)
 }
 
@@ -173,14 +243,41 @@ func setInterfaceUP(interfaceName string) error {
 	return nil
 }
 
-// 设置iptable对应bridge的MASQUERADE规则
-func setupIPTables(bridgeName string, subnet *net.IPNet) error {
-	// 由于go没有直接操作iptables的库，所以直接使用命令
-	iptablesCmd := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subnet.String(), bridgeName)
-	cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-	output, err := cmd.Output()
-	if err != nil {
-		log.Log.Errorf("iptables Output, %v", output)
+// iccEnabled 网络中的容器之间是否可以互相通信
+func iccEnabled(n *Network) bool {
+	return n.Options[iccOption] != "false"
+}
+
+// isInternal 网络是否为内部网络
+func isInternal(n *Network) bool {
+	return n.Options[internalOption] == "true"
+}
+
+// enableBridgeNFCall 让网桥转发的二层流量也经过iptables/nftables，br_netfilter模块没有加载时先加载
+func enableBridgeNFCall(ipv6 bool) error {
+	if _, err := os.Stat("/proc/sys/net/bridge"); os.IsNotExist(err) {
+		if out, err := exec.Command("modprobe", "br_netfilter").CombinedOutput(); err != nil {
+			return fmt.Errorf(" load br_netfilter: %v, %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	files := []string{"bridge-nf-call-iptables"}
+	if ipv6 {
+		files = append(files, "bridge-nf-call-ip6tables")
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile("/proc/sys/net/bridge/"+f, []byte("1"), 0644); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// enableIPv6Forwarding 开启宿主机的IPv6转发
+func enableIPv6Forwarding() error {
+	return ioutil.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+}
+
+// enableRouteLocalnet 允许目的地址为127.0.0.1的流量被DNAT后从网桥路由出去
+func enableRouteLocalnet(bridgeName string) error {
+	return ioutil.WriteFile(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", bridgeName), []byte("1"), 0644)
+}
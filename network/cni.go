@@ -0,0 +1,287 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"xwj/mydocker/log"
+)
+
+const (
+	cniDriverName     = "cni"
+	cniConfigOption   = "config"   // conflist文件路径选项名
+	cniConflistOption = "conflist" // 创建网络时读取并保存下来的conflist内容
+	cniPathOption     = "cni_path" // 插件可执行文件的搜索目录，多个目录用:分隔
+	cniDefaultPath    = "/opt/cni/bin"
+	cniIfName         = "eth0" // 容器内网卡的名字
+)
+
+// CNINetworkDriver CNI网络驱动
+// 不直接操作网络设备，而是按照CNI规范调用conflist中声明的插件链完成容器网络的配置
+type CNINetworkDriver struct {
+}
+
+// cniConflist CNI的网络配置列表(conflist)
+type cniConflist struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// cniResult 插件ADD命令返回的结果，兼容0.3.x/0.4.0/1.0.0版本的格式
+type cniResult struct {
+	CNIVersion string `json:"cniVersion"`
+	Interfaces []struct {
+		Name    string `json:"name"`
+		Mac     string `json:"mac"`
+		Sandbox string `json:"sandbox"`
+	} `json:"interfaces"`
+	IPs []struct {
+		Interface *int   `json:"interface"`
+		Address   string `json:"address"`
+		Gateway   string `json:"gateway"`
+	} `json:"ips"`
+	Routes []struct {
+		Dst string `json:"dst"`
+		GW  string `json:"gw"`
+	} `json:"routes"`
+}
+
+// cniError 插件执行失败时输出到标准输出的错误信息
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details"`
+}
+
+func (d *CNINetworkDriver) Name() string {
+	return cniDriverName
+}
+
+// Create 读取并校验conflist，将其内容保存在网络配置中，后续连接时不再依赖原文件
+func (d *CNINetworkDriver) Create(subnet, subnet6 string, name string, options map[string]string) (*Network, error) {
+	configPath := options[cniConfigOption]
+	if configPath == "" {
+		return nil, fmt.Errorf(" cni network requires a conflist config")
+	}
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	conflist, err := parseCNIConflist(content)
+	if err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	// 确保所有插件都能找到
+	for _, plugin := range conflist.Plugins {
+		if _, err := findCNIPlugin(plugin, options[cniPathOption]); err != nil {
+			log.Log.Error(err)
+			return nil, err
+		}
+	}
+	options[cniConflistOption] = string(content)
+	n := &Network{
+		Name:    name,
+		Driver:  d.Name(),
+		Options: options,
+	}
+	// 网段是可选的，地址实际由插件链中的IPAM插件分配
+	if subnet != "" {
+		_, ipRange, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		n.IpRange = ipRange
+	}
+	if subnet6 != "" {
+		_, ipRange6, err := net.ParseCIDR(subnet6)
+		if err != nil {
+			return nil, err
+		}
+		n.IpRange6 = ipRange6
+	}
+	return n, nil
+}
+
+// Delete CNI网络在宿主机上的资源由插件自行管理
+func (d *CNINetworkDriver) Delete(network *Network) error {
+	return nil
+}
+
+// Connect 依次以ADD命令调用插件链，并将最后一个插件的结果解析到网络端点中
+func (d *CNINetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	conflist, err := parseCNIConflist([]byte(network.Options[cniConflistOption]))
+	if err != nil {
+		return err
+	}
+	var prevResult json.RawMessage
+	for i, plugin := range conflist.Plugins {
+		out, err := execCNIPlugin("ADD", conflist, plugin, prevResult, network.Options[cniPathOption], endpoint)
+		if err != nil {
+			// 以相反的顺序对已经执行成功的插件调用DEL，释放它们已经分配的地址和设备
+			for j := i - 1; j >= 0; j-- {
+				if _, delErr := execCNIPlugin("DEL", conflist, conflist.Plugins[j], prevResult, network.Options[cniPathOption], endpoint); delErr != nil {
+					log.Log.Warnf("rollback cni plugin %v error: %v", conflist.Plugins[j]["type"], delErr)
+				}
+			}
+			return err
+		}
+		prevResult = out
+	}
+	if prevResult == nil {
+		return fmt.Errorf(" cni plugins returned no result")
+	}
+	endpoint.CNIResult = prevResult
+	return parseCNIResult(prevResult, endpoint)
+}
+
+// Disconnect 以与ADD相反的顺序用DEL命令调用插件链
+func (d *CNINetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	conflist, err := parseCNIConflist([]byte(network.Options[cniConflistOption]))
+	if err != nil {
+		return err
+	}
+	for i := len(conflist.Plugins) - 1; i >= 0; i-- {
+		if _, err := execCNIPlugin("DEL", conflist, conflist.Plugins[i], endpoint.CNIResult, network.Options[cniPathOption], endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseCNIConflist 解析conflist，也接受只有单个插件的.conf格式
+func parseCNIConflist(content []byte) (*cniConflist, error) {
+	conflist := &cniConflist{}
+	if err := json.Unmarshal(content, conflist); err != nil {
+		return nil, fmt.Errorf(" invalid cni config: %v", err)
+	}
+	if len(conflist.Plugins) == 0 {
+		// 单个插件的配置，整个文件就是插件的配置
+		plugin := map[string]interface{}{}
+		if err := json.Unmarshal(content, &plugin); err != nil {
+			return nil, fmt.Errorf(" invalid cni config: %v", err)
+		}
+		if _, ok := plugin["type"]; !ok {
+			return nil, fmt.Errorf(" cni config has no plugins")
+		}
+		conflist.Plugins = append(conflist.Plugins, plugin)
+	}
+	if conflist.Name == "" || conflist.CNIVersion == "" {
+		return nil, fmt.Errorf(" cni config requires name and cniVersion")
+	}
+	return conflist, nil
+}
+
+// findCNIPlugin 在插件目录中查找插件的可执行文件
+func findCNIPlugin(plugin map[string]interface{}, cniPath string) (string, error) {
+	pluginType, _ := plugin["type"].(string)
+	if pluginType == "" {
+		return "", fmt.Errorf(" cni plugin config has no type")
+	}
+	if cniPath == "" {
+		cniPath = os.Getenv("CNI_PATH")
+	}
+	if cniPath == "" {
+		cniPath = cniDefaultPath
+	}
+	for _, dir := range filepath.SplitList(cniPath) {
+		binPath := filepath.Join(dir, pluginType)
+		if info, err := os.Stat(binPath); err == nil && !info.IsDir() {
+			return binPath, nil
+		}
+	}
+	return "", fmt.Errorf(" cni plugin %s not found in %s", pluginType, cniPath)
+}
+
+// execCNIPlugin 按照CNI规范执行一个插件，插件的配置通过标准输入传递，结果从标准输出读取
+func execCNIPlugin(command string, conflist *cniConflist, plugin map[string]interface{}, prevResult json.RawMessage, cniPath string, endpoint *Endpoint) (json.RawMessage, error) {
+	binPath, err := findCNIPlugin(plugin, cniPath)
+	if err != nil {
+		return nil, err
+	}
+	// 插件的配置需要带上conflist的name与cniVersion，链式调用时还要带上前一个插件的结果
+	netConf := make(map[string]interface{}, len(plugin)+3)
+	for k, v := range plugin {
+		netConf[k] = v
+	}
+	netConf["name"] = conflist.Name
+	netConf["cniVersion"] = conflist.CNIVersion
+	if prevResult != nil {
+		netConf["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(netConf)
+	if err != nil {
+		return nil, err
+	}
+	if cniPath == "" {
+		cniPath = filepath.Dir(binPath)
+	}
+	cmd := exec.Command(binPath)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+endpoint.ContainerID,
+		"CNI_NETNS="+endpoint.Netns,
+		"CNI_IFNAME="+cniIfName,
+		"CNI_PATH="+cniPath,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		cniErr := &cniError{}
+		if jsonErr := json.Unmarshal(stdout.Bytes(), cniErr); jsonErr == nil && cniErr.Msg != "" {
+			return nil, fmt.Errorf(" cni plugin %s %s failed: %s %s", plugin["type"], command, cniErr.Msg, cniErr.Details)
+		}
+		return nil, fmt.Errorf(" cni plugin %s %s failed: %v %s", plugin["type"], command, err, strings.TrimSpace(stderr.String()))
+	}
+	if command != "ADD" || stdout.Len() == 0 {
+		return nil, nil
+	}
+	return json.RawMessage(stdout.Bytes()), nil
+}
+
+// parseCNIResult 从插件链的结果中取出容器网卡的IP、MAC以及路由
+func parseCNIResult(out []byte, endpoint *Endpoint) error {
+	result := &cniResult{}
+	if err := json.Unmarshal(out, result); err != nil {
+		return fmt.Errorf(" invalid cni result: %v", err)
+	}
+	for _, ipConfig := range result.IPs {
+		ip, _, err := net.ParseCIDR(ipConfig.Address)
+		if err != nil {
+			return fmt.Errorf(" invalid cni result address %s: %v", ipConfig.Address, err)
+		}
+		// 只取位于容器内的网卡上的地址
+		if ipConfig.Interface != nil && *ipConfig.Interface < len(result.Interfaces) {
+			iface := result.Interfaces[*ipConfig.Interface]
+			if iface.Sandbox == "" {
+				continue
+			}
+			if mac, err := net.ParseMAC(iface.Mac); err == nil {
+				endpoint.MacAddress = mac
+			}
+		}
+		// 双栈时分别记录第一个IPv4与IPv6地址
+		if ip.To4() != nil && endpoint.IpAddress == nil {
+			endpoint.IpAddress = ip
+		} else if ip.To4() == nil && endpoint.IpAddress6 == nil {
+			endpoint.IpAddress6 = ip
+		}
+	}
+	if endpoint.IpAddress == nil && endpoint.IpAddress6 == nil {
+		return fmt.Errorf(" cni result has no container address")
+	}
+	for _, route := range result.Routes {
+		endpoint.Routes = append(endpoint.Routes, EndpointRoute{Dst: route.Dst, Gw: route.GW})
+	}
+	return nil
+}
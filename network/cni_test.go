@@ -0,0 +1,222 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cniStubPlugin 桩插件，记录收到的CNI_*环境变量与标准输入以及调用顺序
+// ADD时输出<插件名>.result的内容，存在<插件名>.fail时输出其内容并以失败退出
+const cniStubPlugin = `#!/bin/sh
+dir=$(dirname "$0")
+name=$(basename "$0")
+echo "$name $CNI_COMMAND" >> "$dir/calls"
+env | grep '^CNI_' | sort > "$dir/$name.$CNI_COMMAND.env"
+cat > "$dir/$name.$CNI_COMMAND.stdin"
+if [ -f "$dir/$name.fail" ]; then
+	cat "$dir/$name.fail"
+	exit 1
+fi
+if [ "$CNI_COMMAND" = ADD ]; then
+	cat "$dir/$name.result"
+fi
+`
+
+const (
+	cniFirstResult = `{"cniVersion":"0.4.0","interfaces":[{"name":"eth0","mac":"02:42:c0:a8:32:02","sandbox":"/proc/1/ns/net"}],` +
+		`"ips":[{"version":"4","interface":0,"address":"192.168.50.2/24","gateway":"192.168.50.1"}]}`
+	cniSecondResult = `{"cniVersion":"0.4.0","interfaces":[{"name":"eth0","mac":"02:42:c0:a8:32:03","sandbox":"/proc/1/ns/net"}],` +
+		`"ips":[{"version":"4","interface":0,"address":"192.168.50.3/24","gateway":"192.168.50.1"}],` +
+		`"routes":[{"dst":"0.0.0.0/0","gw":"192.168.50.1"}]}`
+)
+
+// newCNITestNetwork 在临时目录中安装桩插件，返回使用这些插件组成插件链的网络
+func newCNITestNetwork(t *testing.T, plugins ...string) (*Network, string) {
+	dir := t.TempDir()
+	conflist := cniConflist{CNIVersion: "0.4.0", Name: "cninet"}
+	for _, name := range plugins {
+		writeTestFile(t, filepath.Join(dir, name), cniStubPlugin, 0755)
+		conflist.Plugins = append(conflist.Plugins, map[string]interface{}{"type": name, "plugin": name})
+	}
+	content, err := json.Marshal(conflist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Network{
+		Name:   "cninet",
+		Driver: cniDriverName,
+		Options: map[string]string{
+			cniConflistOption: string(content),
+			cniPathOption:     dir,
+		},
+	}, dir
+}
+
+func writeTestFile(t *testing.T, path, content string, mode os.FileMode) {
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// readStdin 解析插件收到的网络配置
+func readStdin(t *testing.T, dir, name, command string) map[string]json.RawMessage {
+	conf := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(readTestFile(t, filepath.Join(dir, name+"."+command+".stdin"))), &conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// 插件按顺序以ADD调用，收到规范要求的环境变量，后面的插件收到前一个插件的结果作为prevResult
+// DEL以相反的顺序调用，收到ADD的最终结果
+func TestCNIConnect(t *testing.T) {
+	n, dir := newCNITestNetwork(t, "first", "second")
+	writeTestFile(t, filepath.Join(dir, "first.result"), cniFirstResult, 0644)
+	writeTestFile(t, filepath.Join(dir, "second.result"), cniSecondResult, 0644)
+	ep := &Endpoint{ID: "c1-cninet", ContainerID: "c1", Netns: "/proc/1/ns/net", Network: n}
+	d := &CNINetworkDriver{}
+	if err := d.Connect(n, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	env := readTestFile(t, filepath.Join(dir, "first.ADD.env"))
+	for _, want := range []string{"CNI_COMMAND=ADD", "CNI_CONTAINERID=c1", "CNI_NETNS=/proc/1/ns/net", "CNI_IFNAME=eth0", "CNI_PATH=" + dir} {
+		if !strings.Contains(env, want+"\n") {
+			t.Errorf("first ADD env = %q, want %s", env, want)
+		}
+	}
+	first := readStdin(t, dir, "first", "ADD")
+	if string(first["name"]) != `"cninet"` || string(first["cniVersion"]) != `"0.4.0"` || string(first["plugin"]) != `"first"` {
+		t.Errorf("first ADD stdin = %v, want name, cniVersion and plugin config", first)
+	}
+	if _, ok := first["prevResult"]; ok {
+		t.Errorf("first ADD stdin has prevResult %s", first["prevResult"])
+	}
+	second := readStdin(t, dir, "second", "ADD")
+	if string(second["prevResult"]) != cniFirstResult {
+		t.Errorf("second ADD prevResult = %s, want %s", second["prevResult"], cniFirstResult)
+	}
+
+	if !ep.IpAddress.Equal(net.ParseIP("192.168.50.3")) || ep.MacAddress.String() != "02:42:c0:a8:32:03" {
+		t.Errorf("endpoint address = %v %v, want the last plugin's result", ep.IpAddress, ep.MacAddress)
+	}
+	if len(ep.Routes) != 1 || ep.Routes[0] != (EndpointRoute{Dst: "0.0.0.0/0", Gw: "192.168.50.1"}) {
+		t.Errorf("endpoint routes = %v", ep.Routes)
+	}
+
+	if err := d.Disconnect(n, ep); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readTestFile(t, filepath.Join(dir, "calls")); calls != "first ADD\nsecond ADD\nsecond DEL\nfirst DEL\n" {
+		t.Errorf("plugin calls = %q", calls)
+	}
+	if del := readStdin(t, dir, "first", "DEL"); string(del["prevResult"]) != cniSecondResult {
+		t.Errorf("first DEL prevResult = %s, want %s", del["prevResult"], cniSecondResult)
+	}
+}
+
+// 插件链中间的插件失败时返回插件输出的错误信息，并对已经成功的插件以相反的顺序调用DEL
+func TestCNIConnectRollback(t *testing.T) {
+	n, dir := newCNITestNetwork(t, "first", "second", "third")
+	writeTestFile(t, filepath.Join(dir, "first.result"), cniFirstResult, 0644)
+	writeTestFile(t, filepath.Join(dir, "second.result"), cniSecondResult, 0644)
+	writeTestFile(t, filepath.Join(dir, "third.fail"), `{"code":7,"msg":"no addresses left","details":"pool exhausted"}`, 0644)
+	ep := &Endpoint{ID: "c1-cninet", ContainerID: "c1", Netns: "/proc/1/ns/net", Network: n}
+	err := (&CNINetworkDriver{}).Connect(n, ep)
+	if err == nil || !strings.Contains(err.Error(), "no addresses left pool exhausted") {
+		t.Fatalf("Connect = %v, want plugin error message", err)
+	}
+	if calls := readTestFile(t, filepath.Join(dir, "calls")); calls != "first ADD\nsecond ADD\nthird ADD\nsecond DEL\nfirst DEL\n" {
+		t.Errorf("plugin calls = %q, want DEL of the added plugins in reverse order", calls)
+	}
+	if env := readTestFile(t, filepath.Join(dir, "first.DEL.env")); !strings.Contains(env, "CNI_COMMAND=DEL\n") {
+		t.Errorf("first DEL env = %q", env)
+	}
+}
+
+func TestParseCNIResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		ip     string
+		ip6    string
+		mac    string
+		routes int
+		err    bool
+	}{
+		{
+			name: "0.4.0 skips host interface",
+			result: `{"cniVersion":"0.4.0","interfaces":[{"name":"veth1","mac":"aa:aa:aa:aa:aa:aa"},{"name":"eth0","mac":"02:00:00:00:00:02","sandbox":"/proc/1/ns/net"}],` +
+				`"ips":[{"version":"4","interface":0,"address":"10.0.0.1/24"},{"version":"4","interface":1,"address":"10.0.0.2/24","gateway":"10.0.0.1"}],` +
+				`"routes":[{"dst":"0.0.0.0/0"}]}`,
+			ip:     "10.0.0.2",
+			mac:    "02:00:00:00:00:02",
+			routes: 1,
+		},
+		{
+			name: "1.0.0 dual stack",
+			result: `{"cniVersion":"1.0.0","interfaces":[{"name":"eth0","mac":"02:00:00:00:00:03","sandbox":"/var/run/netns/c1"}],` +
+				`"ips":[{"interface":0,"address":"fd00::3/64","gateway":"fd00::1"},{"interface":0,"address":"10.0.0.3/24"},{"interface":0,"address":"10.0.0.4/24"}],` +
+				`"routes":[{"dst":"0.0.0.0/0","gw":"10.0.0.1"},{"dst":"::/0","gw":"fd00::1"}]}`,
+			ip:     "10.0.0.3",
+			ip6:    "fd00::3",
+			mac:    "02:00:00:00:00:03",
+			routes: 2,
+		},
+		{
+			name:   "address without interface",
+			result: `{"cniVersion":"1.0.0","ips":[{"address":"10.0.0.5/24"}]}`,
+			ip:     "10.0.0.5",
+		},
+		{
+			name:   "only host interface",
+			result: `{"cniVersion":"1.0.0","interfaces":[{"name":"veth1"}],"ips":[{"interface":0,"address":"10.0.0.1/24"}]}`,
+			err:    true,
+		},
+		{
+			name:   "invalid address",
+			result: `{"cniVersion":"1.0.0","ips":[{"address":"10.0.0.300/24"}]}`,
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := &Endpoint{}
+			err := parseCNIResult([]byte(tt.result), ep)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseCNIResult = %+v, want error", ep)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.ip != "" && !ep.IpAddress.Equal(net.ParseIP(tt.ip)) || tt.ip == "" && ep.IpAddress != nil {
+				t.Errorf("IpAddress = %v, want %s", ep.IpAddress, tt.ip)
+			}
+			if tt.ip6 != "" && !ep.IpAddress6.Equal(net.ParseIP(tt.ip6)) || tt.ip6 == "" && ep.IpAddress6 != nil {
+				t.Errorf("IpAddress6 = %v, want %s", ep.IpAddress6, tt.ip6)
+			}
+			if ep.MacAddress.String() != tt.mac {
+				t.Errorf("MacAddress = %v, want %s", ep.MacAddress, tt.mac)
+			}
+			if len(ep.Routes) != tt.routes {
+				t.Errorf("Routes = %v, want %d routes", ep.Routes, tt.routes)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"xwj/mydocker/log"
+)
+
+// dump 将网络端点信息保存在文件系统中
+func (ep *Endpoint) dump(dumpPath string) error {
+	// 检查保存的目录是否存在
+	if _, err := os.Stat(dumpPath); err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(dumpPath, 0644); err != nil {
+				log.Log.Error(err)
+				return err
+			}
+		} else {
+			log.Log.Error(err)
+			return err
+		}
+	}
+	// 保存的文件名使用网络端点的ID
+	epBytes, err := json.Marshal(ep)
+	if err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dumpPath, ep.ID), epBytes, 0644); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// load 根据网络端点的ID加载网络端点信息
+func (ep *Endpoint) load(dumpPath string) error {
+	jsonBytes, err := ioutil.ReadFile(path.Join(dumpPath, ep.ID))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonBytes, ep)
+}
+
+// remove 删除网络端点的配置文件
+func (ep *Endpoint) remove(dumpPath string) error {
+	if err := os.Remove(path.Join(dumpPath, ep.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadEndpoints 加载所有保存的网络端点
+func loadEndpoints(dumpPath string) ([]*Endpoint, error) {
+	files, err := ioutil.ReadDir(dumpPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var endpoints []*Endpoint
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		ep := &Endpoint{ID: file.Name()}
+		if err := ep.load(dumpPath); err != nil {
+			log.Log.Warnf("load endpoint %s error: %v", file.Name(), err)
+			continue
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// LoadEndpoint 加载容器在网络中的网络端点
+func LoadEndpoint(networkName, containerID string) (*Endpoint, error) {
+	ep := &Endpoint{ID: fmt.Sprintf("%s-%s", containerID, networkName)}
+	if err := ep.load(defaultEndpointPath); err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"xwj/mydocker/log"
+)
+
+// envFirewallBackend 通过环境变量强制指定防火墙后端(iptables/nftables)
+const envFirewallBackend = "MYDOCKER_FIREWALL"
+
+// Firewall 容器网络的防火墙后端，bridge驱动与端口映射只通过这个接口操作防火墙
+// 所有的添加操作都是幂等的，重复添加不会产生重复的规则
+type Firewall interface {
+	Name() string                                                 // 后端名
+	Setup() error                                                 // 创建myDocker自己的表与链
+	AddMasquerade(n *Network) error                               // 容器访问外部网络的SNAT规则
+	DelMasquerade(n *Network) error                               // 删除网络的SNAT规则
+	AddIsolation(n *Network) error                                // 网络的转发放行与隔离规则
+	DelIsolation(n *Network) error                                // 删除网络的转发放行与隔离规则
+	AddDNAT(n *Network, containerIP net.IP, pb PortBinding) error // 端口映射的DNAT规则
+	DelDNAT(n *Network, containerIP net.IP, pb PortBinding) error // 删除端口映射的DNAT规则
+	Cleanup() error                                               // 删除myDocker的所有规则
+}
+
+var firewall Firewall // 当前使用的防火墙后端，第一次使用时自动检测
+
+// getFirewall 获取防火墙后端，优先使用环境变量指定的后端
+// 否则宿主机有可用的iptables(legacy)时使用iptables，iptables缺失或者只是nf_tables的兼容层时使用原生的nftables
+func getFirewall() (Firewall, error) {
+	if firewall != nil {
+		return firewall, nil
+	}
+	switch os.Getenv(envFirewallBackend) {
+	case iptablesBackendName:
+		if !iptablesAvailable() {
+			return nil, fmt.Errorf(" iptables is not available")
+		}
+		firewall = &iptablesFirewall{}
+	case nftablesBackendName:
+		if !nftablesAvailable() {
+			return nil, fmt.Errorf(" nftables is not available")
+		}
+		firewall = &nftablesFirewall{}
+	default:
+		legacy := iptablesAvailable() && !iptablesIsNFTShim()
+		switch {
+		case legacy:
+			firewall = &iptablesFirewall{}
+		case nftablesAvailable():
+			firewall = &nftablesFirewall{}
+		case iptablesAvailable():
+			firewall = &iptablesFirewall{}
+		default:
+			return nil, fmt.Errorf(" neither iptables nor nftables is available")
+		}
+	}
+	log.Log.Debugf("use %s firewall backend", firewall.Name())
+	return firewall, nil
+}
+
+// iptablesIsNFTShim 判断iptables命令是否只是基于nf_tables的兼容层
+func iptablesIsNFTShim() bool {
+	output, err := exec.Command("iptables", "-V").CombinedOutput()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(output), "nf_tables")
+}
+
+// setupNetworkFirewall 设置bridge网络的防火墙规则
+// 宿主机没有防火墙后端时跳过SNAT与隔离规则，将网络标记为只能使用用户态代理；禁止容器间通信或者内部网络依赖隔离规则，不能跳过
+// 标记在网络的整个生命周期内保持不变，重新创建设备时不会补上规则
+func setupNetworkFirewall(n *Network) error {
+	if n.ProxyOnly {
+		return nil
+	}
+	fw, err := getFirewall()
+	if err != nil {
+		if !iccEnabled(n) || isInternal(n) {
+			return err
+		}
+		log.Log.Warnf("%v, network %s has no NAT and isolation rules, port mappings use userland proxy", err, n.Name)
+		n.ProxyOnly = true
+		return nil
+	}
+	if err := fw.Setup(); err != nil {
+		return err
+	}
+	if err := fw.AddMasquerade(n); err != nil {
+		return err
+	}
+	return fw.AddIsolation(n)
+}
+
+// cleanupNetworkFirewall 删除bridge网络的防火墙规则
+func cleanupNetworkFirewall(n *Network) error {
+	if n.ProxyOnly {
+		return nil
+	}
+	fw, err := getFirewall()
+	if err != nil {
+		return err
+	}
+	if err := fw.DelIsolation(n); err != nil {
+		return err
+	}
+	return fw.DelMasquerade(n)
+}
+
+// ReconcileFirewall 清空myDocker的所有规则，根据保存的网络与网络端点重新生成
+// 只使用用户态代理的网络没有防火墙规则，所有的bridge网络都是这样时宿主机可以没有防火墙后端
+func ReconcileFirewall() error {
+	fw, err := getFirewall()
+	if err != nil {
+		for _, n := range networks {
+			if isBridgeNetwork(n) && !n.ProxyOnly {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := fw.Cleanup(); err != nil {
+		return err
+	}
+	if err := fw.Setup(); err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if !isBridgeNetwork(n) || n.ProxyOnly {
+			continue
+		}
+		if err := fw.AddMasquerade(n); err != nil {
+			return err
+		}
+		if err := fw.AddIsolation(n); err != nil {
+			return err
+		}
+	}
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		if ep.Network == nil {
+			continue
+		}
+		n, ok := networks[ep.Network.Name]
+		if !ok || !isBridgeNetwork(n) || n.ProxyOnly {
+			continue
+		}
+		for _, pb := range ep.PortBindings {
+			// 使用用户态代理的端口映射没有防火墙规则
+			if pb.ProxyPid > 0 {
+				continue
+			}
+			for _, ip := range dnatAddresses(ep, pb) {
+				if err := fw.AddDNAT(n, ip, pb); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -2,161 +2,331 @@ package network
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
-	"strings"
+	"sort"
+	"syscall"
 	"xwj/mydocker/log"
 )
 
-const ipamDefaultAllocatorPath = "/var/run/mydocker/network/ipam/subnet.json"
+const (
+	ipamDefaultStorePath     = "/var/run/mydocker/network/ipam/ipam.json"
+	ipamDefaultLockPath      = "/var/run/mydocker/network/ipam/ipam.lock"
+	ipamLegacyAllocatorFile  = "subnet.json"  // 旧版本的位图文件，与存储文件在同一目录，只用于迁移
+	ipamLegacyAllocator6File = "subnet6.json" // 旧版本的IPv6分配文件，与存储文件在同一目录，只用于迁移
+)
+
+// IPAMConfig 创建网络时的地址分配配置
+type IPAMConfig struct {
+	Subnets    []string          `json:"subnets,omitempty"`     // 网段，最多一个IPv4网段与一个IPv6网段
+	Gateways   []string          `json:"gateways,omitempty"`    // 网关地址，每个协议族最多一个，不指定时使用网段的第一个地址
+	IPRanges   []string          `json:"ip_ranges,omitempty"`   // 动态分配地址的范围，必须在网段内，每个协议族最多一个
+	AuxAddress map[string]string `json:"aux_address,omitempty"` // 保留给宿主机上其他设备的地址，不会分配给容器
+}
 
+// IPAM 地址分配器
+// 每个网段只记录已经分配的地址，所有的修改都在文件锁的保护下完成，并通过重命名原子地写回文件
 type IPAM struct {
-	SubnetAllocatorPath string            // 分配文件存放的位置
-	Subnets             map[string]string // 网段和位图算法的数组map：key是网段，value是分配的位图字符串（使用字符串的一个字符标识一个状态位）
+	StorePath string                  // 分配信息存放的位置
+	LockPath  string                  // 文件锁的位置
+	Subnets   map[string]*addressPool // 网段和分配信息的map：key是网段
+}
+
+// addressPool 一个网段的地址分配信息
+type addressPool struct {
+	Range     string          `json:"range,omitempty"` // 动态分配地址的范围，为空时使用整个网段
+	Allocated []string        `json:"allocated"`       // 已经分配的地址
+	allocated map[string]bool // 已经分配的地址集合
 }
 
 // 初始化一个IPAM对象
 var ipAllocator = &IPAM{
 	// 默认使用上面的默认存储位置作为分配信息存储位置
-	SubnetAllocatorPath: ipamDefaultAllocatorPath,
+	StorePath: ipamDefaultStorePath,
+	LockPath:  ipamDefaultLockPath,
 }
 
-// load 加载IPAM的位图信息
+// lock 对分配信息加文件锁，返回解锁函数，保证多个myDocker进程不会分配出相同的地址
+func (ipam *IPAM) lock() (func(), error) {
+	lockDir, _ := path.Split(ipam.LockPath)
+	if err := os.MkdirAll(lockDir, 0644); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(ipam.LockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// load 加载IPAM的分配信息，存储文件不存在时尝试从旧版本的文件迁移
 func (ipam *IPAM) load() error {
-	// 检查存储文件的状态，如果不存在则说明之前没有分配，则不需要加载
-	if _, err := os.Stat(ipam.SubnetAllocatorPath); err != nil {
+	ipam.Subnets = make(map[string]*addressPool)
+	contentBytes, err := ioutil.ReadFile(ipam.StorePath)
+	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
-		} else {
-			return err
+			return ipam.migrate()
 		}
-	}
-	// 打开文件
-	subnetConfigFile, err := os.Open(ipam.SubnetAllocatorPath)
-	defer subnetConfigFile.Close()
-	if err != nil {
 		return err
 	}
-	// 读取文件
-	contentBytes, err := ioutil.ReadAll(subnetConfigFile)
-	// 反序列化
-	err = json.Unmarshal(contentBytes, &ipam.Subnets)
-	if err != nil {
-		log.Log.Errorf("Error dump allocation info, %v", err)
+	if err := json.Unmarshal(contentBytes, &ipam.Subnets); err != nil {
+		log.Log.Errorf("Error load allocation info, %v", err)
 		return err
 	}
+	for _, pool := range ipam.Subnets {
+		pool.allocated = make(map[string]bool)
+		for _, ip := range pool.Allocated {
+			pool.allocated[ip] = true
+		}
+	}
 	return nil
 }
 
-// dump 存储IPAM的地址分配位图信息
-func (ipam *IPAM) dump() error {
-	// 检查存储文件所在文件夹是否存在,不存在则创建
-	ipamConfigFileDir, _ := path.Split(ipam.SubnetAllocatorPath)
-	if _, err := os.Stat(ipamConfigFileDir); err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(ipamConfigFileDir, 0644); err != nil {
-				return err
+// migrate 将旧版本的位图(一个字符表示一个地址，下标c对应网段首地址+c+1)与IPv6分配文件转换为新的格式
+func (ipam *IPAM) migrate() error {
+	var bitmaps map[string]string
+	storeDir, _ := path.Split(ipam.StorePath)
+	if content, err := ioutil.ReadFile(path.Join(storeDir, ipamLegacyAllocatorFile)); err == nil {
+		if err := json.Unmarshal(content, &bitmaps); err != nil {
+			return err
+		}
+	}
+	for subnet, bitmap := range bitmaps {
+		_, cidr, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		pool := ipam.pool(cidr)
+		ip := nextIP(cidr.IP)
+		for c := 0; c < len(bitmap) && cidr.Contains(ip); c++ {
+			if bitmap[c] == '1' {
+				pool.add(ip)
 			}
-		} else {
+			ip = nextIP(ip)
+		}
+	}
+	var allocated6 map[string][]string
+	if content, err := ioutil.ReadFile(path.Join(storeDir, ipamLegacyAllocator6File)); err == nil {
+		if err := json.Unmarshal(content, &allocated6); err != nil {
 			return err
 		}
 	}
-	// 打开文件
-	subnetConfigFile, err := os.OpenFile(ipam.SubnetAllocatorPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	defer subnetConfigFile.Close()
-	if err != nil {
+	for subnet, ips := range allocated6 {
+		_, cidr, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		pool := ipam.pool(cidr)
+		for _, ip := range ips {
+			pool.add(net.ParseIP(ip))
+		}
+	}
+	return nil
+}
+
+// dump 存储IPAM的分配信息，先写入临时文件再重命名，避免写入中断后留下不完整的文件
+func (ipam *IPAM) dump() error {
+	// 检查存储文件所在文件夹是否存在,不存在则创建
+	ipamConfigFileDir, _ := path.Split(ipam.StorePath)
+	if err := os.MkdirAll(ipamConfigFileDir, 0644); err != nil {
 		return err
 	}
-	// json序列化
+	for _, pool := range ipam.Subnets {
+		pool.Allocated = pool.Allocated[:0]
+		for ip := range pool.allocated {
+			pool.Allocated = append(pool.Allocated, ip)
+		}
+		sort.Strings(pool.Allocated)
+	}
 	ipamConfigJson, err := json.Marshal(ipam.Subnets)
 	if err != nil {
 		return err
 	}
-	// 写入到文件
-	_, err = subnetConfigFile.Write(ipamConfigJson)
-	if err != nil {
+	tmpPath := ipam.StorePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, ipamConfigJson, 0644); err != nil {
 		return err
 	}
-	return nil
+	return os.Rename(tmpPath, ipam.StorePath)
 }
 
-// Allocate bitmap算法分配一个地址
-func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
-	// 存放网段中地址分配信息的map
-	ipam.Subnets = make(map[string]string)
-	// 从文件中加载已经分配的网段信息
+// update 在文件锁的保护下加载分配信息，执行修改并写回
+func (ipam *IPAM) update(fn func() error) error {
+	unlock, err := ipam.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if err := ipam.load(); err != nil {
-		log.Log.Error(err)
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return ipam.dump()
+}
+
+// pool 获取网段的分配信息，不存在时创建
+func (ipam *IPAM) pool(subnet *net.IPNet) *addressPool {
+	key := subnet.String()
+	pool, ok := ipam.Subnets[key]
+	if !ok {
+		pool = &addressPool{allocated: make(map[string]bool)}
+		ipam.Subnets[key] = pool
 	}
+	return pool
+}
+
+// add 标记地址已经分配
+func (pool *addressPool) add(ip net.IP) {
+	pool.allocated[ip.String()] = true
+}
+
+// CreatePool 创建网段的分配信息，ipRange不为空时动态分配的地址只从这个范围中选取
+func (ipam *IPAM) CreatePool(subnet, ipRange *net.IPNet) error {
+	_, subnet, _ = net.ParseCIDR(subnet.String())
+	return ipam.update(func() error {
+		if _, ok := ipam.Subnets[subnet.String()]; ok {
+			return fmt.Errorf(" subnet %s is already in use", subnet)
+		}
+		pool := ipam.pool(subnet)
+		if ipRange != nil {
+			if !subnetContains(subnet, ipRange) {
+				return fmt.Errorf(" ip range %s is not in subnet %s", ipRange, subnet)
+			}
+			pool.Range = ipRange.String()
+		}
+		return nil
+	})
+}
+
+// DeletePool 删除网段的所有分配信息
+func (ipam *IPAM) DeletePool(subnet *net.IPNet) error {
+	_, subnet, _ = net.ParseCIDR(subnet.String())
+	return ipam.update(func() error {
+		delete(ipam.Subnets, subnet.String())
+		return nil
+	})
+}
+
+// Allocate 从网段中动态分配一个地址
+// 从分配范围的第一个地址开始，跳过已经分配的地址，IPv4跳过网络地址与广播地址
+func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
 	// 这里重新生成一个子网段实例，因为传递的是指针，为了避免影响
 	_, subnet, _ = net.ParseCIDR(subnet.String())
-	// subnet.Mask.Size() 函数会返回网段前面的固定位1的长度以及后面0位的长度
-	// 例如: 127.0.0.0/8 子网掩码：255.0.0.0 subnet.Mask.Size()返回8和32
-	one, size := subnet.Mask.Size()
-	ipAddr := subnet.String()
-	// 如果之前没有分配过这个网段，则初始化网段的分配配置
-	if _, has := ipam.Subnets[ipAddr]; !has {
-		// 1 << uint8(zero) 表示 2^(zero) 表示 剩余的可分配的IP数量，后面的位数全部用0填满
-		ipam.Subnets[ipAddr] = strings.Repeat("0", 1<<uint8(size-one))
-	}
-	var AlloIP net.IP
-	// 遍历网段的位图数组
-	for c := range ipam.Subnets[ipAddr] {
-		if ipam.Subnets[ipAddr][c] == '0' {
-			// 设置这个为'0'的序号值为'1'，即表示分配这个IP
-			// 转换字符串为字节数组进行修改
-			ipalloc := []byte(ipam.Subnets[ipAddr])
-			ipalloc[c] = '1'
-			ipam.Subnets[ipAddr] = string(ipalloc)
-			// 获取该网段的IP，比如对于网段192.168.0.0/16,这里就是192.168.0.0
-			first_ip := subnet.IP
-			// ip地址是一个uint[4]的数组，例如172.16.0.0就是[172, 16, 0, 0]
-			// 需要通过数组中每一项加所需要的值, 对于当前序号,例如65535
-			// 每一位加的计算就是[uint8(65535>>24), uint8(65535>>16), uint8(65535>>8), uint8(65535>>0)]
-			for t := uint(4); t > 0; t -= 1 {
-				[]byte(first_ip)[4-t] += uint8(c >> ((t - 1) * 8))
+	err = ipam.update(func() error {
+		pool := ipam.pool(subnet)
+		allocRange := subnet
+		if pool.Range != "" {
+			_, allocRange, _ = net.ParseCIDR(pool.Range)
+		}
+		broadcast := lastIP(subnet)
+		for candidate := allocRange.IP; allocRange.Contains(candidate); candidate = nextIP(candidate) {
+			if candidate.Equal(subnet.IP) || pool.allocated[candidate.String()] {
+				continue
 			}
-			// 由于这里从1开始分配，所以再加1
-			first_ip[3] += 1
-			AlloIP = first_ip
-			break
+			if candidate.To4() != nil && candidate.Equal(broadcast) {
+				continue
+			}
+			pool.add(candidate)
+			ip = candidate
+			return nil
 		}
-	}
-	if err := ipam.dump(); err != nil {
+		return fmt.Errorf(" no available ip in subnet %s", allocRange)
+	})
+	if err != nil {
 		return nil, err
 	}
-	return AlloIP, nil
+	return ip, nil
+}
+
+// AllocateIP 分配指定的地址，地址必须在网段内并且没有被使用
+func (ipam *IPAM) AllocateIP(subnet *net.IPNet, ip net.IP) error {
+	_, subnet, _ = net.ParseCIDR(subnet.String())
+	if !subnet.Contains(ip) {
+		return fmt.Errorf(" ip %s is not in subnet %s", ip, subnet)
+	}
+	return ipam.update(func() error {
+		pool := ipam.pool(subnet)
+		if pool.allocated[ip.String()] {
+			return fmt.Errorf(" ip %s is already in use", ip)
+		}
+		pool.add(ip)
+		return nil
+	})
 }
 
 // Release 释放一个IP
 func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr *net.IP) error {
-	ipam.Subnets = make(map[string]string)
 	_, subnet, _ = net.ParseCIDR(subnet.String())
-	// 从文件中加载网段的分配信息
-	if err := ipam.load(); err != nil {
-		log.Log.Error(err)
-		return err
+	return ipam.update(func() error {
+		if pool, ok := ipam.Subnets[subnet.String()]; ok {
+			delete(pool.allocated, ipaddr.String())
+		}
+		return nil
+	})
+}
+
+// SyncPool 将网段的分配信息重置为inUse中的地址，网段不存在时重新创建，返回被释放的地址
+func (ipam *IPAM) SyncPool(subnet, ipRange *net.IPNet, inUse []net.IP) (released []string, err error) {
+	_, subnet, _ = net.ParseCIDR(subnet.String())
+	err = ipam.update(func() error {
+		pool := ipam.pool(subnet)
+		if pool.Range == "" && ipRange != nil {
+			pool.Range = ipRange.String()
+		}
+		keep := make(map[string]bool)
+		for _, ip := range inUse {
+			if subnet.Contains(ip) {
+				keep[ip.String()] = true
+			}
+		}
+		for ip := range pool.allocated {
+			if !keep[ip] {
+				released = append(released, ip)
+			}
+		}
+		pool.allocated = keep
+		return nil
+	})
+	sort.Strings(released)
+	return released, err
+}
+
+// nextIP 返回下一个IP地址，不修改传入的地址
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
 	}
-	// 计算IP地址再网段位图数组中的索引位置
-	c := 0
-	// 将IP地址转换为4个字节的表示方式
-	releaseIP := ipaddr.To4()
-	// 由于IP是从1开始分配的，所以转换成索引应减1
-	releaseIP[3] -= 1
-	for t := uint(4); t > 0; t -= 1 {
-		// 获取索引与分配IP相反：IP地址的每一位相减之后分别左移将对应的数值加到索引上
-		// *8是IP的每一个小分段都是8位，等于扩大相应的倍数
-		c += int(releaseIP[t-1]-subnet.IP[t-1]) << ((4 - t) * 8)
-	}
-	// 将分配的位图数组中索引位置的值设置为0
-	ipalloc := []byte(ipam.Subnets[subnet.String()])
-	ipalloc[c] = '0'
-	ipam.Subnets[subnet.String()] = string(ipalloc)
-	// 保存释放掉IP之后的网段IP信息
-	if err := ipam.dump(); err != nil {
-		return err
+	return next
+}
+
+// lastIP 返回网段的最后一个地址，IPv4中即广播地址
+func lastIP(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		ip[i] = subnet.IP[i] | ^subnet.Mask[i]
 	}
-	return nil
+	return ip
+}
+
+// subnetContains 判断网段inner是否完全在网段outer内
+func subnetContains(outer, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outer.Contains(inner.IP) && innerOnes >= outerOnes
 }
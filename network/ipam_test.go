@@ -0,0 +1,224 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestIPAM 分配信息存放在临时目录中的IPAM
+func newTestIPAM(t *testing.T) *IPAM {
+	dir := t.TempDir()
+	return &IPAM{StorePath: filepath.Join(dir, "ipam.json"), LockPath: filepath.Join(dir, "ipam.lock")}
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipNet
+}
+
+// allocateAll 一直分配地址直到失败，返回分配到的地址与最后的错误
+func allocateAll(ipam *IPAM, subnet *net.IPNet) ([]string, error) {
+	var ips []string
+	for {
+		ip, err := ipam.Allocate(subnet)
+		if err != nil {
+			return ips, err
+		}
+		ips = append(ips, ip.String())
+	}
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		ipRange  string
+		reserved []string // 预先用AllocateIP分配的地址，例如网关
+		want     []string
+	}{
+		{
+			name:   "ipv4 skips network and broadcast",
+			subnet: "10.1.0.0/29",
+			want:   []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4", "10.1.0.5", "10.1.0.6"},
+		},
+		{
+			name:     "ipv4 skips gateway",
+			subnet:   "10.1.0.0/29",
+			reserved: []string{"10.1.0.1", "10.1.0.4"},
+			want:     []string{"10.1.0.2", "10.1.0.3", "10.1.0.5", "10.1.0.6"},
+		},
+		{
+			name:    "ip range",
+			subnet:  "10.1.0.0/24",
+			ipRange: "10.1.0.128/30",
+			want:    []string{"10.1.0.128", "10.1.0.129", "10.1.0.130", "10.1.0.131"},
+		},
+		{
+			name:    "ip range at the end of subnet skips broadcast",
+			subnet:  "10.1.0.0/24",
+			ipRange: "10.1.0.252/30",
+			want:    []string{"10.1.0.252", "10.1.0.253", "10.1.0.254"},
+		},
+		{
+			name:     "ipv6 uses the last address",
+			subnet:   "fd00::/126",
+			reserved: []string{"fd00::1"},
+			want:     []string{"fd00::2", "fd00::3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam := newTestIPAM(t)
+			subnet := mustParseCIDR(t, tt.subnet)
+			var ipRange *net.IPNet
+			if tt.ipRange != "" {
+				ipRange = mustParseCIDR(t, tt.ipRange)
+			}
+			if err := ipam.CreatePool(subnet, ipRange); err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range tt.reserved {
+				if err := ipam.AllocateIP(subnet, net.ParseIP(ip)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := allocateAll(ipam, subnet)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("allocated %v, want %v", got, tt.want)
+			}
+			if err == nil || !strings.Contains(err.Error(), "no available ip") {
+				t.Fatalf("exhausted pool: %v, want no available ip", err)
+			}
+		})
+	}
+}
+
+func TestIPAMPool(t *testing.T) {
+	ipam := newTestIPAM(t)
+	subnet := mustParseCIDR(t, "10.2.0.0/24")
+	if err := ipam.CreatePool(subnet, mustParseCIDR(t, "10.3.0.0/28")); err == nil {
+		t.Fatal("CreatePool with ip range outside subnet, want error")
+	}
+	if err := ipam.CreatePool(subnet, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 不同的写法指向同一个网段
+	if err := ipam.CreatePool(mustParseCIDR(t, "10.2.0.7/24"), nil); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("CreatePool twice: %v, want already in use", err)
+	}
+
+	if err := ipam.AllocateIP(subnet, net.ParseIP("10.9.0.1")); err == nil {
+		t.Fatal("AllocateIP outside subnet, want error")
+	}
+	if err := ipam.AllocateIP(subnet, net.ParseIP("10.2.0.10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.AllocateIP(subnet, net.ParseIP("10.2.0.10")); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("AllocateIP twice: %v, want already in use", err)
+	}
+
+	// 重复释放同一个地址不报错，释放后地址可以重新分配
+	ip := net.ParseIP("10.2.0.10")
+	for i := 0; i < 2; i++ {
+		if err := ipam.Release(subnet, &ip); err != nil {
+			t.Fatalf("release %d: %v", i, err)
+		}
+	}
+	if err := ipam.AllocateIP(subnet, ip); err != nil {
+		t.Fatalf("AllocateIP after release: %v", err)
+	}
+	// 释放不存在的网段中的地址不报错，也不会创建网段
+	other := mustParseCIDR(t, "10.4.0.0/24")
+	if err := ipam.Release(other, &ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ipam.Subnets[other.String()]; ok {
+		t.Fatalf("Release created pool %s", other)
+	}
+
+	if err := ipam.DeletePool(subnet); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.CreatePool(subnet, nil); err != nil {
+		t.Fatalf("CreatePool after DeletePool: %v", err)
+	}
+	if got, err := ipam.Allocate(subnet); err != nil || got.String() != "10.2.0.1" {
+		t.Fatalf("Allocate after DeletePool = %v, %v, want 10.2.0.1", got, err)
+	}
+}
+
+// SyncPool只保留仍在使用并且在网段内的地址，网段不存在时重新创建
+func TestIPAMSyncPool(t *testing.T) {
+	ipam := newTestIPAM(t)
+	subnet := mustParseCIDR(t, "10.5.0.0/24")
+	for _, ip := range []string{"10.5.0.1", "10.5.0.2", "10.5.0.3"} {
+		if err := ipam.AllocateIP(subnet, net.ParseIP(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	released, err := ipam.SyncPool(subnet, nil, []net.IP{net.ParseIP("10.5.0.1"), net.ParseIP("10.5.0.3"), net.ParseIP("10.6.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(released, []string{"10.5.0.2"}) {
+		t.Fatalf("released %v, want [10.5.0.2]", released)
+	}
+	if err := ipam.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ipam.Subnets[subnet.String()].allocated; !reflect.DeepEqual(got, map[string]bool{"10.5.0.1": true, "10.5.0.3": true}) {
+		t.Fatalf("allocated after sync = %v", got)
+	}
+
+	missing := mustParseCIDR(t, "10.7.0.0/24")
+	if _, err := ipam.SyncPool(missing, mustParseCIDR(t, "10.7.0.64/26"), []net.IP{net.ParseIP("10.7.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ipam.Allocate(missing); err != nil || got.String() != "10.7.0.64" {
+		t.Fatalf("Allocate from recreated pool = %v, %v, want 10.7.0.64", got, err)
+	}
+}
+
+// 存储文件不存在时从同一目录下旧版本的位图与IPv6分配文件迁移
+func TestIPAMMigrate(t *testing.T) {
+	ipam := newTestIPAM(t)
+	dir := filepath.Dir(ipam.StorePath)
+	if err := ioutil.WriteFile(filepath.Join(dir, ipamLegacyAllocatorFile), []byte(`{"10.8.0.0/24":"1010000000"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ipamLegacyAllocator6File), []byte(`{"fd08::/64":["fd08::1","fd08::5"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	subnet := mustParseCIDR(t, "10.8.0.0/24")
+	if got, err := ipam.Allocate(subnet); err != nil || got.String() != "10.8.0.2" {
+		t.Fatalf("Allocate after migration = %v, %v, want 10.8.0.2", got, err)
+	}
+	if err := ipam.AllocateIP(subnet, net.ParseIP("10.8.0.3")); err == nil {
+		t.Fatal("AllocateIP of migrated address, want already in use")
+	}
+	if err := ipam.AllocateIP(mustParseCIDR(t, "fd08::/64"), net.ParseIP("fd08::5")); err == nil {
+		t.Fatal("AllocateIP of migrated ipv6 address, want already in use")
+	}
+	// 迁移后写入了新的存储文件，旧文件不再被读取
+	if err := os.Remove(filepath.Join(dir, ipamLegacyAllocatorFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.load(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"10.8.0.1": true, "10.8.0.2": true, "10.8.0.3": true}
+	if got := ipam.Subnets["10.8.0.0/24"].allocated; !reflect.DeepEqual(got, want) {
+		t.Fatalf("allocated after migration = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,326 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"xwj/mydocker/log"
+)
+
+const iptablesBackendName = "iptables"
+
+// iptables后端使用的命令，IPv4与IPv6的规则分别由iptables与ip6tables管理
+const (
+	iptablesCmd  = "iptables"
+	ip6tablesCmd = "ip6tables"
+)
+
+// myDocker使用的自定义链，所有规则都放在这些链中，便于检查、清理与重建
+const (
+	natChain        = "MYDOCKER"             // nat表，端口映射的DNAT规则
+	natPostChain    = "MYDOCKER-POSTROUTING" // nat表，MASQUERADE规则
+	filterChain     = "MYDOCKER"             // filter表，放行发往容器的流量
+	isolationChain  = "MYDOCKER-ISOLATION"   // filter表，网络之间的隔离规则，匹配从网桥转发出去的流量
+	isolation2Chain = "MYDOCKER-ISOLATION-2" // filter表，网络之间的隔离规则，丢弃转发进其他网桥的流量
+	localhostSubnet = "127.0.0.0/8"
+)
+
+// iptablesRule 一条iptables规则
+type iptablesRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+// iptablesAvailable 宿主机上是否可以使用iptables
+func iptablesAvailable() bool {
+	_, err := exec.LookPath(iptablesCmd)
+	return err == nil
+}
+
+// ip6tablesAvailable 宿主机上是否可以使用ip6tables
+func ip6tablesAvailable() bool {
+	_, err := exec.LookPath(ip6tablesCmd)
+	return err == nil
+}
+
+// iptablesCmds 需要配置的命令，宿主机没有ip6tables时只配置IPv4
+func iptablesCmds() []string {
+	if ip6tablesAvailable() {
+		return []string{iptablesCmd, ip6tablesCmd}
+	}
+	return []string{iptablesCmd}
+}
+
+// ipCmd 根据地址的协议族选择命令
+func ipCmd(ip net.IP) string {
+	if ip.To4() == nil {
+		return ip6tablesCmd
+	}
+	return iptablesCmd
+}
+
+// runIPTables 执行一条iptables/ip6tables命令，参数以切片传递避免按空格拆分出错
+func runIPTables(cmd string, args ...string) error {
+	output, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(" %s %s: %v %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// exists 通过-C检查规则是否已经存在
+func (r iptablesRule) exists(cmd string) bool {
+	return exec.Command(cmd, append([]string{"-t", r.table, "-C", r.chain}, r.args...)...).Run() == nil
+}
+
+// add 规则不存在时追加到链的末尾
+func (r iptablesRule) add(cmd string) error {
+	if r.exists(cmd) {
+		return nil
+	}
+	return runIPTables(cmd, append([]string{"-t", r.table, "-A", r.chain}, r.args...)...)
+}
+
+// insert 规则不存在时插入到链的开头
+func (r iptablesRule) insert(cmd string) error {
+	if r.exists(cmd) {
+		return nil
+	}
+	return runIPTables(cmd, append([]string{"-t", r.table, "-I", r.chain, "1"}, r.args...)...)
+}
+
+// remove 删除规则，重复添加过的规则也一并删除
+func (r iptablesRule) remove(cmd string) error {
+	for r.exists(cmd) {
+		if err := runIPTables(cmd, append([]string{"-t", r.table, "-D", r.chain}, r.args...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureChain 创建自定义链，链已经存在时不做处理
+func ensureChain(cmd, table, chain string) error {
+	if exec.Command(cmd, "-t", table, "-n", "-L", chain).Run() == nil {
+		return nil
+	}
+	return runIPTables(cmd, "-t", table, "-N", chain)
+}
+
+// myDockerChains myDocker的所有自定义链
+var myDockerChains = []struct{ table, chain string }{
+	{"nat", natChain},
+	{"nat", natPostChain},
+	{"filter", filterChain},
+	{"filter", isolationChain},
+	{"filter", isolation2Chain},
+}
+
+// iptablesFirewall 通过iptables命令实现的防火墙后端
+type iptablesFirewall struct {
+}
+
+func (f *iptablesFirewall) Name() string {
+	return iptablesBackendName
+}
+
+// Setup 创建myDocker的自定义链并从内置链跳转过来，可以重复调用
+func (f *iptablesFirewall) Setup() error {
+	for _, cmd := range iptablesCmds() {
+		if err := setupChains(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupChains 创建一个协议族的自定义链
+func setupChains(cmd string) error {
+	for _, c := range myDockerChains {
+		if err := ensureChain(cmd, c.table, c.chain); err != nil {
+			return err
+		}
+	}
+	// 隔离链的规则都追加在链尾，删除旧版本在链尾添加的RETURN规则，链执行完后会自动返回
+	if err := (iptablesRule{"filter", isolationChain, []string{"-j", "RETURN"}}).remove(cmd); err != nil {
+		return err
+	}
+	// 发往宿主机本机地址的流量(包括宿主机自己发出的)进入端口映射链
+	jumps := []iptablesRule{
+		{"nat", "PREROUTING", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", natChain}},
+		{"nat", "OUTPUT", []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", natChain}},
+		{"nat", "POSTROUTING", []string{"-j", natPostChain}},
+	}
+	for _, jump := range jumps {
+		if err := jump.add(cmd); err != nil {
+			return err
+		}
+	}
+	// FORWARD链中先经过隔离链，再经过放行链
+	if err := (iptablesRule{"filter", "FORWARD", []string{"-j", filterChain}}).insert(cmd); err != nil {
+		return err
+	}
+	return (iptablesRule{"filter", "FORWARD", []string{"-j", isolationChain}}).insert(cmd)
+}
+
+// Cleanup 清空myDocker的自定义链
+func (f *iptablesFirewall) Cleanup() error {
+	for _, cmd := range iptablesCmds() {
+		for _, c := range myDockerChains {
+			if exec.Command(cmd, "-t", c.table, "-n", "-L", c.chain).Run() != nil {
+				continue
+			}
+			if err := runIPTables(cmd, "-t", c.table, "-F", c.chain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) AddMasquerade(n *Network) error {
+	if err := addRules(iptablesCmd, masqueradeRules(n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil || !ip6tablesAvailable() {
+		return nil
+	}
+	return addRules(ip6tablesCmd, masquerade6Rules(n))
+}
+
+func (f *iptablesFirewall) DelMasquerade(n *Network) error {
+	if err := removeRules(iptablesCmd, masqueradeRules(n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil || !ip6tablesAvailable() {
+		return nil
+	}
+	return removeRules(ip6tablesCmd, masquerade6Rules(n))
+}
+
+// AddIsolation 转发与隔离规则只匹配网卡，IPv4与IPv6使用相同的规则
+func (f *iptablesFirewall) AddIsolation(n *Network) error {
+	if err := addRules(iptablesCmd, isolationRules(n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil || !ip6tablesAvailable() {
+		return nil
+	}
+	return addRules(ip6tablesCmd, isolationRules(n))
+}
+
+func (f *iptablesFirewall) DelIsolation(n *Network) error {
+	if err := removeRules(iptablesCmd, isolationRules(n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil || !ip6tablesAvailable() {
+		return nil
+	}
+	return removeRules(ip6tablesCmd, isolationRules(n))
+}
+
+func (f *iptablesFirewall) AddDNAT(n *Network, containerIP net.IP, pb PortBinding) error {
+	return addRules(ipCmd(containerIP), dnatRules(pb, containerIP, n.Name))
+}
+
+func (f *iptablesFirewall) DelDNAT(n *Network, containerIP net.IP, pb PortBinding) error {
+	return removeRules(ipCmd(containerIP), dnatRules(pb, containerIP, n.Name))
+}
+
+// masquerade6Rules 双栈bridge网络的IPv6 SNAT规则，IPv6的localhost不能路由到网桥，不需要localhost的规则
+func masquerade6Rules(n *Network) []iptablesRule {
+	if isInternal(n) {
+		return nil
+	}
+	subnet6 := &net.IPNet{IP: n.IpRange6.IP.Mask(n.IpRange6.Mask), Mask: n.IpRange6.Mask}
+	return []iptablesRule{
+		{"nat", natPostChain, []string{"-s", subnet6.String(), "!", "-o", n.Name, "-j", "MASQUERADE"}},
+	}
+}
+
+// masqueradeRules bridge网络的SNAT规则
+func masqueradeRules(n *Network) []iptablesRule {
+	bridgeName := n.Name
+	subnet := &net.IPNet{IP: n.IpRange.IP.Mask(n.IpRange.Mask), Mask: n.IpRange.Mask}
+	rules := []iptablesRule{
+		// 宿主机访问localhost上发布的端口时，DNAT之后源地址仍是127.0.0.1，需要做SNAT容器才能回包
+		{"nat", natPostChain, []string{"-s", localhostSubnet, "-o", bridgeName, "-j", "MASQUERADE"}},
+	}
+	// 内部网络的容器不能访问外部网络
+	if !isInternal(n) {
+		// 容器访问外部网络时做SNAT
+		rules = append(rules, iptablesRule{"nat", natPostChain, []string{"-s", subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE"}})
+	}
+	return rules
+}
+
+// isolationRules bridge网络的转发与隔离规则
+// 从一个网桥转发出去的流量先进入第一级隔离链，如果又转发进其他的网桥，就在第二级隔离链中丢弃
+func isolationRules(n *Network) []iptablesRule {
+	bridgeName := n.Name
+	rules := []iptablesRule{
+		{"filter", isolationChain, []string{"-i", bridgeName, "!", "-o", bridgeName, "-j", isolation2Chain}},
+		{"filter", isolation2Chain, []string{"-o", bridgeName, "-j", "DROP"}},
+	}
+	// 禁止容器间通信时，同一网桥内只放行经过DNAT的访问发布端口的流量，需要在放行容器流量的规则之前
+	if !iccEnabled(n) {
+		rules = append(rules,
+			iptablesRule{"filter", filterChain, []string{"-i", bridgeName, "-o", bridgeName, "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"}},
+			iptablesRule{"filter", filterChain, []string{"-i", bridgeName, "-o", bridgeName, "-j", "DROP"}},
+		)
+	}
+	// 放行容器发出的流量以及回包
+	return append(rules,
+		iptablesRule{"filter", filterChain, []string{"-i", bridgeName, "-j", "ACCEPT"}},
+		iptablesRule{"filter", filterChain, []string{"-o", bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	)
+}
+
+// dnatRules 一条端口映射需要的规则
+func dnatRules(pb PortBinding, containerIP net.IP, bridgeName string) []iptablesRule {
+	dport := strconv.Itoa(pb.HostPort)
+	cport := strconv.Itoa(pb.ContainerPort)
+	destination := net.JoinHostPort(containerIP.String(), cport)
+	var match []string
+	if !isAnyAddr(pb.HostIP) {
+		match = append(match, "-d", pb.HostIP)
+	}
+	match = append(match, "-p", pb.Proto, "-m", pb.Proto, "--dport", dport, "-j", "DNAT", "--to-destination", destination)
+	return []iptablesRule{
+		// 外部进入宿主机、宿主机本机发出以及同一网桥上的容器访问宿主机发布端口的流量
+		{"nat", natChain, match},
+		// hairpin：容器通过发布的端口访问自己时，需要做SNAT让回包经过宿主机
+		{"nat", natPostChain, []string{"-s", containerIP.String(), "-d", containerIP.String(),
+			"-p", pb.Proto, "-m", pb.Proto, "--dport", cport, "-j", "MASQUERADE"}},
+		// 放行DNAT之后转发到容器的流量
+		{"filter", filterChain, []string{"-d", containerIP.String(), "!", "-i", bridgeName, "-o", bridgeName,
+			"-p", pb.Proto, "-m", pb.Proto, "--dport", cport, "-j", "ACCEPT"}},
+	}
+}
+
+// addRules 依次添加规则，遇到错误立即返回
+func addRules(cmd string, rules []iptablesRule) error {
+	for _, rule := range rules {
+		if err := rule.add(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRules 依次删除规则，删除失败时继续删除其余规则，并返回第一个错误
+func removeRules(cmd string, rules []iptablesRule) error {
+	var firstErr error
+	for _, rule := range rules {
+		if err := rule.remove(cmd); err != nil {
+			log.Log.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// newTestBridgeNetwork 不创建设备的bridge网络配置，用于检查规则
+func newTestBridgeNetwork(t *testing.T, subnet string, options map[string]string) *Network {
+	ip, ipRange, err := net.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipRange.IP = ip
+	return &Network{Name: "testbr", IpRange: ipRange, Driver: "bridge", Options: options}
+}
+
+func TestMasqueradeRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    []iptablesRule
+	}{
+		{
+			name:    "default",
+			options: map[string]string{},
+			want: []iptablesRule{
+				{"nat", natPostChain, []string{"-s", "127.0.0.0/8", "-o", "testbr", "-j", "MASQUERADE"}},
+				{"nat", natPostChain, []string{"-s", "172.18.0.0/16", "!", "-o", "testbr", "-j", "MASQUERADE"}},
+			},
+		},
+		{
+			name:    "internal",
+			options: map[string]string{internalOption: "true"},
+			want: []iptablesRule{
+				{"nat", natPostChain, []string{"-s", "127.0.0.0/8", "-o", "testbr", "-j", "MASQUERADE"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 网段使用网关地址表示，规则中使用网络地址
+			n := newTestBridgeNetwork(t, "172.18.0.1/16", tt.options)
+			if got := masqueradeRules(n); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("masqueradeRules =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNATRules(t *testing.T) {
+	containerIP := net.ParseIP("172.18.0.2")
+	tests := []struct {
+		name string
+		pb   PortBinding
+		want []iptablesRule
+	}{
+		{
+			name: "all host addresses",
+			pb:   PortBinding{HostPort: 8080, ContainerPort: 80, Proto: "tcp"},
+			want: []iptablesRule{
+				{"nat", natChain, []string{"-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "172.18.0.2:80"}},
+				{"nat", natPostChain, []string{"-s", "172.18.0.2", "-d", "172.18.0.2", "-p", "tcp", "-m", "tcp", "--dport", "80", "-j", "MASQUERADE"}},
+				{"filter", filterChain, []string{"-d", "172.18.0.2", "!", "-i", "testbr", "-o", "testbr", "-p", "tcp", "-m", "tcp", "--dport", "80", "-j", "ACCEPT"}},
+			},
+		},
+		{
+			name: "host ip",
+			pb:   PortBinding{HostIP: "127.0.0.1", HostPort: 5353, ContainerPort: 53, Proto: "udp"},
+			want: []iptablesRule{
+				{"nat", natChain, []string{"-d", "127.0.0.1", "-p", "udp", "-m", "udp", "--dport", "5353", "-j", "DNAT", "--to-destination", "172.18.0.2:53"}},
+				{"nat", natPostChain, []string{"-s", "172.18.0.2", "-d", "172.18.0.2", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "MASQUERADE"}},
+				{"filter", filterChain, []string{"-d", "172.18.0.2", "!", "-i", "testbr", "-o", "testbr", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "ACCEPT"}},
+			},
+		},
+		{
+			// 0.0.0.0与不指定地址相同
+			name: "unspecified host ip",
+			pb:   PortBinding{HostIP: "0.0.0.0", HostPort: 8080, ContainerPort: 80, Proto: "tcp"},
+			want: []iptablesRule{
+				{"nat", natChain, []string{"-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "172.18.0.2:80"}},
+				{"nat", natPostChain, []string{"-s", "172.18.0.2", "-d", "172.18.0.2", "-p", "tcp", "-m", "tcp", "--dport", "80", "-j", "MASQUERADE"}},
+				{"filter", filterChain, []string{"-d", "172.18.0.2", "!", "-i", "testbr", "-o", "testbr", "-p", "tcp", "-m", "tcp", "--dport", "80", "-j", "ACCEPT"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dnatRules(tt.pb, containerIP, "testbr"); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("dnatRules =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsolationRules(t *testing.T) {
+	isolation := []iptablesRule{
+		{"filter", isolationChain, []string{"-i", "testbr", "!", "-o", "testbr", "-j", isolation2Chain}},
+		{"filter", isolation2Chain, []string{"-o", "testbr", "-j", "DROP"}},
+	}
+	accept := []iptablesRule{
+		{"filter", filterChain, []string{"-i", "testbr", "-j", "ACCEPT"}},
+		{"filter", filterChain, []string{"-o", "testbr", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+	icc := []iptablesRule{
+		{"filter", filterChain, []string{"-i", "testbr", "-o", "testbr", "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"}},
+		{"filter", filterChain, []string{"-i", "testbr", "-o", "testbr", "-j", "DROP"}},
+	}
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    []iptablesRule
+	}{
+		{"icc enabled", map[string]string{}, append(append([]iptablesRule{}, isolation...), accept...)},
+		{"icc=true", map[string]string{iccOption: "true"}, append(append([]iptablesRule{}, isolation...), accept...)},
+		// 禁止容器间通信的规则在放行规则之前
+		{"icc=false", map[string]string{iccOption: "false"}, append(append(append([]iptablesRule{}, isolation...), icc...), accept...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newTestBridgeNetwork(t, "172.18.0.1/16", tt.options)
+			if got := isolationRules(n); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("isolationRules =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMasquerade6Rules(t *testing.T) {
+	n := newTestBridgeNetwork(t, "172.18.0.1/16", map[string]string{})
+	n.IpRange6 = &net.IPNet{IP: net.ParseIP("fd00:18::1"), Mask: net.CIDRMask(64, 128)}
+	want := []iptablesRule{
+		{"nat", natPostChain, []string{"-s", "fd00:18::/64", "!", "-o", "testbr", "-j", "MASQUERADE"}},
+	}
+	if got := masquerade6Rules(n); !reflect.DeepEqual(got, want) {
+		t.Fatalf("masquerade6Rules =\n%v\nwant\n%v", got, want)
+	}
+	n.Options[internalOption] = "true"
+	if got := masquerade6Rules(n); len(got) != 0 {
+		t.Fatalf("masquerade6Rules of internal network = %v, want none", got)
+	}
+}
+
+// IPv6容器的端口映射使用ip6tables，目的地址带[]
+func TestDNATRulesIPv6(t *testing.T) {
+	containerIP := net.ParseIP("fd00:18::2")
+	if cmd := ipCmd(containerIP); cmd != ip6tablesCmd {
+		t.Fatalf("ipCmd(%s) = %s, want %s", containerIP, cmd, ip6tablesCmd)
+	}
+	if cmd := ipCmd(net.ParseIP("172.18.0.2")); cmd != iptablesCmd {
+		t.Fatalf("ipCmd(172.18.0.2) = %s, want %s", cmd, iptablesCmd)
+	}
+	rules := dnatRules(PortBinding{HostIP: "::1", HostPort: 8080, ContainerPort: 80, Proto: "tcp"}, containerIP, "testbr")
+	want := []string{"-d", "::1", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "[fd00:18::2]:80"}
+	if !reflect.DeepEqual(rules[0].args, want) {
+		t.Fatalf("dnat rule = %q, want %q", rules[0].args, want)
+	}
+}
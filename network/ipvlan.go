@@ -0,0 +1,96 @@
+package network
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"xwj/mydocker/log"
+)
+
+const (
+	ipvlanDriverName = "ipvlan"
+	ipvlanModeOption = "ipvlan_mode" // ipvlan模式选项名
+	ipvlanModeL2     = "l2"
+	ipvlanModeL3     = "l3"
+)
+
+// IPVlanNetworkDriver ipvlan网络驱动，支持L2与L3模式
+// 与macvlan不同，所有子接口共享父接口的MAC地址
+type IPVlanNetworkDriver struct {
+}
+
+func (d *IPVlanNetworkDriver) Name() string {
+	return ipvlanDriverName
+}
+
+// Create 创建ipvlan网络，未指定模式时默认使用L2模式
+func (d *IPVlanNetworkDriver) Create(subnet, subnet6 string, name string, options map[string]string) (*Network, error) {
+	if options == nil {
+		options = map[string]string{}
+	}
+	if options[ipvlanModeOption] == "" {
+		options[ipvlanModeOption] = ipvlanModeL2
+	}
+	if _, err := ipvlanMode(options[ipvlanModeOption]); err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	n, err := newParentNetwork(subnet, subnet6, name, d.Name(), options)
+	if err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	return n, nil
+}
+
+// Delete ipvlan网络没有宿主机上的设备需要删除
+func (d *IPVlanNetworkDriver) Delete(network *Network) error {
+	return nil
+}
+
+// Connect 在父接口上创建一个ipvlan子接口作为容器的网卡
+func (d *IPVlanNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	mode, err := ipvlanMode(network.Options[ipvlanModeOption])
+	if err != nil {
+		return err
+	}
+	parent, err := netlink.LinkByName(network.Options[parentOption])
+	if err != nil {
+		return fmt.Errorf(" error get parent interface: %v", err)
+	}
+	mtu, err := networkMTU(network)
+	if err != nil {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	// 由于Linux接口名的限制，名字取自端点ID的哈希，移入容器后会重命名为eth0
+	la.Name = endpointLinkNames(endpoint.ID, "ivl-")[0]
+	la.ParentIndex = parent.Attrs().Index
+	// 子接口的MTU不能超过父接口
+	la.MTU = mtu
+	iv := &netlink.IPVlan{
+		LinkAttrs: la,
+		Mode:      mode,
+	}
+	if err := netlink.LinkAdd(iv); err != nil {
+		return fmt.Errorf(" Error Add Endpoint Device: %v", err)
+	}
+	endpoint.LinkName = la.Name
+	return nil
+}
+
+// Disconnect 删除仍然留在宿主机上的子接口
+func (d *IPVlanNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	return deleteLinkIfExist(endpoint.LinkName)
+}
+
+// ipvlanMode 将模式字符串转换为netlink的ipvlan模式
+func ipvlanMode(mode string) (netlink.IPVlanMode, error) {
+	switch mode {
+	case "", ipvlanModeL2:
+		return netlink.IPVLAN_MODE_L2, nil
+	case ipvlanModeL3:
+		return netlink.IPVLAN_MODE_L3, nil
+	default:
+		return 0, fmt.Errorf(" Unsupported ipvlan mode: %s", mode)
+	}
+}
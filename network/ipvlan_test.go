@@ -0,0 +1,55 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// requireIPVlan 内核不支持ipvlan时跳过测试
+func requireIPVlan(t *testing.T) {
+	parent := addParentLink(t, "pparent")
+	la := netlink.NewLinkAttrs()
+	la.Name = "pipvlan"
+	la.ParentIndex = parent.Attrs().Index
+	addLinkOrSkip(t, &netlink.IPVlan{LinkAttrs: la})
+	if err := netlink.LinkDel(parent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ipvlan端点使用网络指定的模式，移入容器后配置端点的地址
+func TestIPVlanConnect(t *testing.T) {
+	tests := []struct {
+		mode string
+		want netlink.IPVlanMode
+	}{
+		{"", netlink.IPVLAN_MODE_L2},
+		{ipvlanModeL2, netlink.IPVLAN_MODE_L2},
+		{ipvlanModeL3, netlink.IPVLAN_MODE_L3},
+	}
+	for _, tt := range tests {
+		// 每种模式在自己的子测试中使用新的Net Namespace，子测试结束时清理
+		t.Run("mode="+tt.mode, func(t *testing.T) {
+			useTestNetns(t)
+			requireIPVlan(t)
+			options := map[string]string{}
+			if tt.mode != "" {
+				options[ipvlanModeOption] = tt.mode
+			}
+			link, ep := connectParentNetwork(t, &IPVlanNetworkDriver{}, options, "192.168.50.3")
+			iv, ok := link.(*netlink.IPVlan)
+			if !ok {
+				t.Fatalf("%s is a %s link, want ipvlan", ep.LinkName, link.Type())
+			}
+			if iv.Mode != tt.want {
+				t.Fatalf("ipvlan mode %q = %v, want %v", tt.mode, iv.Mode, tt.want)
+			}
+			cinfo := startContainerNetns(t)
+			if err := configEndpointIpAddressAndRoute(ep, cinfo); err != nil {
+				t.Fatal(err)
+			}
+			checkContainerAddress(t, cinfo, "192.168.50.3/24")
+		})
+	}
+}
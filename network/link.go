@@ -0,0 +1,76 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	containerIfName = "eth0" // 容器内网卡的名字
+	mtuOption       = "mtu"  // 网络设备MTU的选项名
+	linkHashLen     = 11     // 网络接口名中哈希部分的长度，加上4个字符的前缀正好是Linux接口名的上限15个字符
+)
+
+// endpointLinkNames 根据网络端点ID生成宿主机上的接口名，返回的名字都以prefixes中的前缀开头
+// 名字取自端点ID的哈希，同一个端点总是得到相同的名字；哈希前缀相同的接口已经存在时，加上序号重新计算，直到所有的名字都没有被使用
+func endpointLinkNames(id string, prefixes ...string) []string {
+	for i := 0; ; i++ {
+		key := id
+		if i > 0 {
+			key = id + "#" + strconv.Itoa(i)
+		}
+		sum := sha256.Sum256([]byte(key))
+		hash := hex.EncodeToString(sum[:])[:linkHashLen]
+		names := make([]string, 0, len(prefixes))
+		free := true
+		for _, prefix := range prefixes {
+			name := prefix + hash
+			if _, err := netlink.LinkByName(name); err == nil {
+				free = false
+				break
+			}
+			names = append(names, name)
+		}
+		if free {
+			return names
+		}
+	}
+}
+
+// endpointMacAddress 获取网络端点的MAC地址，指定了MAC地址时直接使用
+// 否则与docker一样由IPv4地址生成：02:42加上4个字节的IP地址，02表示本地管理的单播地址
+func endpointMacAddress(mac string, ip net.IP) (net.HardwareAddr, error) {
+	if mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf(" invalid mac address: %s", mac)
+		}
+		if len(hw) != 6 || hw[0]&0x01 != 0 {
+			return nil, fmt.Errorf(" mac address %s is not a unicast ethernet address", mac)
+		}
+		return hw, nil
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, nil
+	}
+	return net.HardwareAddr{0x02, 0x42, ip4[0], ip4[1], ip4[2], ip4[3]}, nil
+}
+
+// networkMTU 获取网络设备的MTU，未设置时返回0，使用内核的默认值
+func networkMTU(n *Network) (int, error) {
+	value, ok := n.Options[mtuOption]
+	if !ok || value == "" {
+		return 0, nil
+	}
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < 68 || mtu > 65535 {
+		return 0, fmt.Errorf(" invalid mtu: %s", value)
+	}
+	return mtu, nil
+}
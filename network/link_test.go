@@ -0,0 +1,94 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 接口名不超过15个字符，同一个端点总是得到相同的名字，名字被占用时换一个哈希
+func TestEndpointLinkNames(t *testing.T) {
+	useTestNetns(t)
+	names := endpointLinkNames("0123456789-testnet", "veth", "peer")
+	if len(names) != 2 || !strings.HasPrefix(names[0], "veth") || !strings.HasPrefix(names[1], "peer") ||
+		names[0][4:] != names[1][4:] {
+		t.Fatalf("endpointLinkNames = %q, want veth and peer with the same hash", names)
+	}
+	for _, name := range names {
+		if len(name) > 15 {
+			t.Fatalf("link name %s is longer than 15 characters", name)
+		}
+	}
+	if again := endpointLinkNames("0123456789-testnet", "veth", "peer"); again[0] != names[0] {
+		t.Fatalf("endpointLinkNames is not stable: %q and %q", names, again)
+	}
+	if other := endpointLinkNames("9876543210-testnet", "veth", "peer"); other[0] == names[0] {
+		t.Fatalf("different endpoints get the same link name %s", other[0])
+	}
+
+	// 只要有一个前缀的名字被占用就换一个哈希
+	la := netlink.NewLinkAttrs()
+	la.Name = names[1]
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "taken-peer"}); err != nil {
+		t.Fatal(err)
+	}
+	renamed := endpointLinkNames("0123456789-testnet", "veth", "peer")
+	if renamed[0] == names[0] || renamed[1] == names[1] || renamed[0][4:] != renamed[1][4:] {
+		t.Fatalf("endpointLinkNames with %s taken = %q", names[1], renamed)
+	}
+}
+
+func TestEndpointMacAddress(t *testing.T) {
+	tests := []struct {
+		mac  string
+		ip   string
+		want string
+		err  bool
+	}{
+		{ip: "172.18.0.2", want: "02:42:ac:12:00:02"},
+		{mac: "02:00:00:00:00:01", ip: "172.18.0.2", want: "02:00:00:00:00:01"},
+		// 只有IPv6地址时由内核生成
+		{ip: "fd00::2", want: ""},
+		{mac: "01:00:5e:00:00:01", err: true},
+		{mac: "02:00:00:00:00:00:00:01", err: true},
+		{mac: "not-a-mac", err: true},
+	}
+	for _, tt := range tests {
+		hw, err := endpointMacAddress(tt.mac, net.ParseIP(tt.ip))
+		if tt.err {
+			if err == nil {
+				t.Errorf("endpointMacAddress(%q) = %v, want error", tt.mac, hw)
+			}
+			continue
+		}
+		if err != nil || hw.String() != tt.want {
+			t.Errorf("endpointMacAddress(%q, %s) = %v, %v, want %s", tt.mac, tt.ip, hw, err, tt.want)
+		}
+	}
+}
+
+func TestNetworkMTU(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		err   bool
+	}{
+		{"", 0, false},
+		{"1450", 1450, false},
+		{"68", 68, false},
+		{"67", 0, true},
+		{"65536", 0, true},
+		{"jumbo", 0, true},
+	}
+	for _, tt := range tests {
+		mtu, err := networkMTU(&Network{Options: map[string]string{mtuOption: tt.value}})
+		if (err != nil) != tt.err || mtu != tt.want {
+			t.Errorf("networkMTU(%q) = %d, %v, want %d", tt.value, mtu, err, tt.want)
+		}
+	}
+	if mtu, err := networkMTU(&Network{}); err != nil || mtu != 0 {
+		t.Errorf("networkMTU without option = %d, %v, want 0", mtu, err)
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"net"
+	"xwj/mydocker/log"
+)
+
+const (
+	macvlanDriverName = "macvlan"
+	parentOption      = "parent" // 宿主机上的父接口(物理网卡)选项名
+)
+
+// MacvlanNetworkDriver macvlan网络驱动(bridge模式)
+// 容器的网卡是父接口上的一个macvlan子接口，拥有独立的MAC地址，直接出现在父接口所在的二层网络上
+type MacvlanNetworkDriver struct {
+}
+
+func (d *MacvlanNetworkDriver) Name() string {
+	return macvlanDriverName
+}
+
+// Create 创建macvlan网络，macvlan网络不需要在宿主机上创建任何设备，只需要检查父接口
+func (d *MacvlanNetworkDriver) Create(subnet, subnet6 string, name string, options map[string]string) (*Network, error) {
+	n, err := newParentNetwork(subnet, subnet6, name, d.Name(), options)
+	if err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	return n, nil
+}
+
+// Delete macvlan网络没有宿主机上的设备需要删除，子接口会随容器的Net Namespace一起销毁
+func (d *MacvlanNetworkDriver) Delete(network *Network) error {
+	return nil
+}
+
+// Connect 在父接口上创建一个bridge模式的macvlan子接口作为容器的网卡
+func (d *MacvlanNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	parent, err := netlink.LinkByName(network.Options[parentOption])
+	if err != nil {
+		return fmt.Errorf(" error get parent interface: %v", err)
+	}
+	mtu, err := networkMTU(network)
+	if err != nil {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	// 由于Linux接口名的限制，名字取自端点ID的哈希，移入容器后会重命名为eth0
+	la.Name = endpointLinkNames(endpoint.ID, "mvl-")[0]
+	la.ParentIndex = parent.Attrs().Index
+	// 子接口的MTU不能超过父接口
+	la.MTU = mtu
+	// 子接口使用网络端点的MAC地址
+	la.HardwareAddr = endpoint.MacAddress
+	mv := &netlink.Macvlan{
+		LinkAttrs: la,
+		Mode:      netlink.MACVLAN_MODE_BRIDGE,
+	}
+	if err := netlink.LinkAdd(mv); err != nil {
+		return fmt.Errorf(" Error Add Endpoint Device: %v", err)
+	}
+	endpoint.LinkName = la.Name
+	return nil
+}
+
+// Disconnect 删除仍然留在宿主机上的子接口
+func (d *MacvlanNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	return deleteLinkIfExist(endpoint.LinkName)
+}
+
+// newParentNetwork 创建依附于宿主机父接口的网络对象(macvlan/ipvlan)
+func newParentNetwork(subnet, subnet6, name, driver string, options map[string]string) (*Network, error) {
+	// 获取网段字符串的网关IP地址和网络IP段
+	ip, ipRange, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	ipRange.IP = ip
+	// 检查父接口是否存在
+	parentName := options[parentOption]
+	if parentName == "" {
+		return nil, fmt.Errorf(" %s network requires a parent interface", driver)
+	}
+	parent, err := netlink.LinkByName(parentName)
+	if err != nil {
+		return nil, fmt.Errorf(" error get parent interface %s: %v", parentName, err)
+	}
+	// 父接口需要处于启动状态，子接口才能收发数据
+	if err := netlink.LinkSetUp(parent); err != nil {
+		return nil, fmt.Errorf(" Error set parent interface up: %s, Error: %v", parentName, err)
+	}
+	n := &Network{
+		Name:    name,
+		IpRange: ipRange,
+		Driver:  driver,
+		Options: options,
+	}
+	// IPv6的网关由父接口所在网络中的路由器提供
+	if subnet6 != "" {
+		ip6, ipRange6, err := net.ParseCIDR(subnet6)
+		if err != nil {
+			return nil, err
+		}
+		ipRange6.IP = ip6
+		n.IpRange6 = ipRange6
+	}
+	return n, nil
+}
+
+// deleteLinkIfExist 删除宿主机Net Namespace中的网络接口，不存在时直接返回
+func deleteLinkIfExist(name string) error {
+	if name == "" {
+		return nil
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf(" error get interface: %v", err)
+	}
+	return netlink.LinkDel(link)
+}
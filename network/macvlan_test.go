@@ -0,0 +1,28 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// macvlan端点是父接口上bridge模式的子接口，使用端点的MAC地址，移入容器后配置端点的地址
+func TestMacvlanConnect(t *testing.T) {
+	useTestNetns(t)
+	link, ep := connectParentNetwork(t, &MacvlanNetworkDriver{}, map[string]string{}, "192.168.50.2")
+	mv, ok := link.(*netlink.Macvlan)
+	if !ok {
+		t.Fatalf("%s is a %s link, want macvlan", ep.LinkName, link.Type())
+	}
+	if mv.Mode != netlink.MACVLAN_MODE_BRIDGE {
+		t.Fatalf("macvlan mode = %v, want bridge", mv.Mode)
+	}
+	if mv.Attrs().HardwareAddr.String() != ep.MacAddress.String() {
+		t.Fatalf("macvlan mac = %s, want %s", mv.Attrs().HardwareAddr, ep.MacAddress)
+	}
+	cinfo := startContainerNetns(t)
+	if err := configEndpointIpAddressAndRoute(ep, cinfo); err != nil {
+		t.Fatal(err)
+	}
+	checkContainerAddress(t, cinfo, "192.168.50.2/24")
+}
@@ -3,18 +3,15 @@ package network
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 	"io/fs"
 	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"text/tabwriter"
 	"xwj/mydocker/log"
 	"xwj/mydocker/record"
@@ -22,59 +19,250 @@ import (
 
 // Network 网络
 type Network struct {
-	Name    string     `json:"name"`     // 网络名
-	IpRange *net.IPNet `json:"ip_range"` // 地址段
-	Driver  string     `json:"driver"`   // 网络驱动名
+	Name      string            `json:"name"`                 // 网络名
+	IpRange   *net.IPNet        `json:"ip_range"`             // 地址段
+	IpRange6  *net.IPNet        `json:"ip_range6,omitempty"`  // IPv6地址段，双栈网络才有
+	Driver    string            `json:"driver"`               // 网络驱动名
+	Options   map[string]string `json:"options,omitempty"`    // 驱动选项，例如macvlan/ipvlan的parent
+	IPAM      *IPAMConfig       `json:"ipam,omitempty"`       // 创建网络时的地址分配配置
+	HostRange *net.IPNet        `json:"host_range,omitempty"` // overlay网络中本机分配地址的分区
+	Overlay   *OverlayConfig    `json:"overlay,omitempty"`    // overlay网络的VXLAN配置
+	ProxyOnly bool              `json:"proxy_only,omitempty"` // 创建时没有防火墙后端，没有NAT与隔离规则，端口映射只能使用用户态代理
 }
 
 // Endpoint 网络端点
 type Endpoint struct {
-	ID          string           `json:"id"`           // ID
-	Device      netlink.Veth     `json:"dev"`          // Veth设备
-	IpAddress   net.IP           `json:"ip"`           // IP地址
-	MacAddress  net.HardwareAddr `json:"mac"`          // mac地址
-	PortMapping []string         `json:"port_mapping"` // 端口映射
-	Network     *Network         // 网络
+	ID           string           `json:"id"`                      // ID
+	Device       netlink.Veth     `json:"dev"`                     // Veth设备
+	LinkName     string           `json:"link_name"`               // 需要移入容器Net Namespace的网络接口名
+	IfName       string           `json:"if_name,omitempty"`       // 移入容器后的网络接口名
+	IpAddress    net.IP           `json:"ip"`                      // IP地址
+	IpAddress6   net.IP           `json:"ip6,omitempty"`           // IPv6地址
+	MacAddress   net.HardwareAddr `json:"mac"`                     // mac地址
+	PortMapping  []string         `json:"port_mapping"`            // 端口映射
+	PortBindings []PortBinding    `json:"port_bindings,omitempty"` // 解析后的端口映射
+	ContainerID  string           `json:"container_id"`            // 所属容器ID
+	Netns        string           `json:"netns"`                   // 容器Net Namespace的文件路径
+	Routes       []EndpointRoute  `json:"routes,omitempty"`        // 容器内的路由(CNI插件返回)
+	CNIResult    json.RawMessage  `json:"cni_result,omitempty"`    // CNI插件链ADD的结果，DEL时作为prevResult传回
+	Bandwidth    *Bandwidth       `json:"bandwidth,omitempty"`     // 带宽限制
+	Network      *Network         // 网络
+}
+
+// EndpointRoute 网络端点的路由
+type EndpointRoute struct {
+	Dst string `json:"dst"`          // 目的网段
+	Gw  string `json:"gw,omitempty"` // 网关
 }
 
 // NetworkDriver 网络驱动
 type NetworkDriver interface {
-	Name() string                                          // 驱动名
-	Create(subnet string, name string) (*Network, error)   // 创建网络
-	Delete(network *Network) error                         // 删除网络
-	Connect(network *Network, endpoint *Endpoint) error    // 连接容器网络端点到网络
-	Disconnect(network *Network, endpoint *Endpoint) error // 从网络中移除容器的网络端点
+	Name() string                                                                            // 驱动名
+	Create(subnet, subnet6 string, name string, options map[string]string) (*Network, error) // 创建网络，subnet6为空时只有IPv4
+	Delete(network *Network) error                                                           // 删除网络
+	Connect(network *Network, endpoint *Endpoint) error                                      // 连接容器网络端点到网络
+	Disconnect(network *Network, endpoint *Endpoint) error                                   // 从网络中移除容器的网络端点
 }
 
 var (
-	defaultNetworkPath = "/var/run/mydocker/network/network/" // 默认存储位置
-	drivers            = map[string]NetworkDriver{}           // 网络驱动映射
-	networks           = map[string]*Network{}                // 所有网络映射
+	defaultNetworkPath  = "/var/run/mydocker/network/network/"  // 默认存储位置
+	defaultEndpointPath = "/var/run/mydocker/network/endpoint/" // 网络端点的默认存储位置
+	drivers             = map[string]NetworkDriver{}            // 网络驱动映射
+	networks            = map[string]*Network{}                 // 所有网络映射
 )
 
-// CreateNetwork 根据网络驱动创建网络
-func CreateNetwork(driver, subnet, name string) error {
-	// ParseCIDR的功能是将网段的字符串转换为net.IPNet对象
-	_, cidr, _ := net.ParseCIDR(subnet)
-	// 通过IPAM分配网关IP，获取到网段中第一个IP作为网关的IP
-	gatewayIp, err := ipAllocator.Allocate(cidr)
+// CreateNetwork 根据网络驱动创建网络，ipamCfg中最多包含一个IPv4网段和一个IPv6网段
+func CreateNetwork(driver string, ipamCfg *IPAMConfig, ipv6 bool, name string, options map[string]string) error {
+	d, ok := drivers[driver]
+	if !ok {
+		return fmt.Errorf(" No Such Network Driver: %s", driver)
+	}
+	subnet, subnet6, err := splitSubnets(ipamCfg.Subnets)
+	if err != nil {
+		return err
+	}
+	if subnet6 != "" && !ipv6 {
+		return fmt.Errorf(" IPv6 subnet %s requires --ipv6", subnet6)
+	}
+	if _, err := networkMTU(&Network{Options: options}); err != nil {
+		return err
+	}
+	// CNI网络的地址由插件链中的IPAM插件负责分配
+	if driver == cniDriverName {
+		nw, err := d.Create(subnet, subnet6, name, options)
+		if err != nil {
+			log.Log.Error(err)
+			return err
+		}
+		return nw.dump(defaultNetworkPath)
+	}
+	if subnet == "" {
+		return fmt.Errorf(" %s network requires an IPv4 subnet", driver)
+	}
+	if ipv6 && subnet6 == "" {
+		return fmt.Errorf(" --ipv6 requires an IPv6 subnet, e.g. --subnet fd00::/64")
+	}
+	if err := validateIPAMConfig(ipamCfg); err != nil {
+		return err
+	}
+	// overlay网络的网段由多个宿主机共享，本机只在自己的分区中分配网关与容器的地址
+	poolSubnet := subnet
+	if driver == overlayDriverName {
+		hostRange, err := overlayHostRange(subnet, ipamCfg, options)
+		if err != nil {
+			return err
+		}
+		poolSubnet = hostRange.String()
+	}
+	// 通过IPAM创建网段的分配信息并分配网关IP，未指定网关时获取到网段中第一个IP作为网关的IP
+	gateway, err := setupAddressPool(poolSubnet, ipamCfg)
 	if err != nil {
 		log.Log.Error(err)
 		return err
 	}
-	// 重置IP
-	cidr.IP = gatewayIp
-
+	// 网络设备上的地址仍然使用整个网段的掩码
+	gatewaySubnet := gateway
+	if poolSubnet != subnet {
+		_, cidr, _ := net.ParseCIDR(subnet)
+		gatewaySubnet = &net.IPNet{IP: gateway.IP, Mask: cidr.Mask}
+	}
+	// IPv6网段同样分配网关
+	var gateway6 *net.IPNet
+	if subnet6 != "" {
+		if gateway6, err = setupAddressPool(subnet6, ipamCfg); err != nil {
+			log.Log.Error(err)
+			_ = ipAllocator.DeletePool(gateway)
+			return err
+		}
+	}
 	// 调用指定的网络驱动创建网络，这里的drivers字典是各个网络驱动的示例字典，通过调用网络驱动的Create方法创建网络
-	nw, err := drivers[driver].Create(cidr.String(), name)
+	nw, err := d.Create(gatewaySubnet.String(), ipNetString(gateway6), name, options)
 	if err != nil {
 		log.Log.Error(err)
+		_ = ipAllocator.DeletePool(gateway)
+		if gateway6 != nil {
+			_ = ipAllocator.DeletePool(gateway6)
+		}
 		return err
 	}
+	nw.IPAM = ipamCfg
+	if poolSubnet != subnet {
+		_, nw.HostRange, _ = net.ParseCIDR(poolSubnet)
+	}
 	// 保存网络信息，将网络信息保存在文件系统中，以便查询和在网络上连接网络端点
 	return nw.dump(defaultNetworkPath)
 }
 
+// validateIPAMConfig 检查网关、分配范围以及保留地址都属于某个网段
+func validateIPAMConfig(cfg *IPAMConfig) error {
+	var cidrs []*net.IPNet
+	for _, s := range cfg.Subnets {
+		_, cidr, _ := net.ParseCIDR(s)
+		cidrs = append(cidrs, cidr)
+	}
+	inSubnets := func(ip net.IP) bool {
+		for _, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, gw := range cfg.Gateways {
+		ip := net.ParseIP(gw)
+		if ip == nil || !inSubnets(ip) {
+			return fmt.Errorf(" invalid gateway %s: not in any subnet", gw)
+		}
+	}
+	for _, r := range cfg.IPRanges {
+		_, ipRange, err := net.ParseCIDR(r)
+		if err != nil {
+			return err
+		}
+		if !inSubnets(ipRange.IP) {
+			return fmt.Errorf(" invalid ip range %s: not in any subnet", r)
+		}
+	}
+	for host, aux := range cfg.AuxAddress {
+		ip := net.ParseIP(aux)
+		if ip == nil || !inSubnets(ip) {
+			return fmt.Errorf(" invalid aux address %s=%s: not in any subnet", host, aux)
+		}
+	}
+	return nil
+}
+
+// setupAddressPool 在IPAM中创建网段的分配信息，保留网关与辅助地址，返回带有网关地址的网段
+func setupAddressPool(subnet string, cfg *IPAMConfig) (*net.IPNet, error) {
+	_, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	ipRange := poolRange(cidr, cfg)
+	if err := ipAllocator.CreatePool(cidr, ipRange); err != nil {
+		return nil, err
+	}
+	gateway := nextIP(cidr.IP)
+	for _, gw := range cfg.Gateways {
+		if ip := net.ParseIP(gw); cidr.Contains(ip) {
+			gateway = ip
+		}
+	}
+	reserved := []net.IP{gateway}
+	for _, aux := range cfg.AuxAddress {
+		if ip := net.ParseIP(aux); cidr.Contains(ip) {
+			reserved = append(reserved, ip)
+		}
+	}
+	for _, ip := range reserved {
+		if err := ipAllocator.AllocateIP(cidr, ip); err != nil {
+			_ = ipAllocator.DeletePool(cidr)
+			return nil, err
+		}
+	}
+	// 重置IP
+	cidr.IP = gateway
+	if gateway.To4() != nil {
+		cidr.IP = gateway.To4()
+	}
+	return cidr, nil
+}
+
+// poolSubnet 获取网络在IPAM中分配IPv4地址的网段，overlay网络是本机的分区
+func (nw *Network) poolSubnet() *net.IPNet {
+	if nw.HostRange != nil {
+		return nw.HostRange
+	}
+	return nw.IpRange
+}
+
+// isBridgeNetwork 容器是否通过宿主机上的网桥连接网络，这类网络经过宿主机NAT
+func isBridgeNetwork(nw *Network) bool {
+	return nw.Driver == bridgeDriverName || nw.Driver == overlayDriverName
+}
+
+// poolRange 获取网段中动态分配地址的范围，没有指定时返回nil
+func poolRange(cidr *net.IPNet, cfg *IPAMConfig) *net.IPNet {
+	var ipRange *net.IPNet
+	if cfg == nil {
+		return nil
+	}
+	for _, r := range cfg.IPRanges {
+		if _, rangeNet, _ := net.ParseCIDR(r); rangeNet != nil && cidr.Contains(rangeNet.IP) {
+			ipRange = rangeNet
+		}
+	}
+	return ipRange
+}
+
+// ipNetString 网段为空时返回空字符串
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.String()
+}
+
 // Connect 容器连接网络
 func Connect(networkName string, cinfo *record.ContainerInfo) error {
 	// 从networks字典中获取容器连接的网络信息，networks字典中保存了当前已经创建的网络
@@ -84,19 +272,85 @@ func Connect(networkName string, cinfo *record.ContainerInfo) error {
 		log.Log.Error(err)
 		return err
 	}
-	// 通过调用IPAM从网络的网段中获取可用的IP作为容器IP地址
-	ip, err := ipAllocator.Allocate(network.IpRange)
-	if err != nil {
-		log.Log.Error(err)
-		return err
-	}
 	// 创建网络端点
 	ep := &Endpoint{
 		ID:          fmt.Sprintf("%s-%s", cinfo.Id, networkName),
-		IpAddress:   ip,
 		PortMapping: cinfo.PortMapping,
+		ContainerID: cinfo.Id,
+		Netns:       fmt.Sprintf("/proc/%s/ns/net", cinfo.Pid),
 		Network:     network,
 	}
+	// CNI插件链自行完成地址分配以及容器内网卡的配置
+	if network.Driver == cniDriverName {
+		if err := drivers[network.Driver].Connect(network, ep); err != nil {
+			log.Log.Error(err)
+			return err
+		}
+		return ep.dump(defaultEndpointPath)
+	}
+	// 只有bridge网络经过宿主机NAT，需要端口映射
+	if isBridgeNetwork(network) {
+		// 分配的端口在网络端点保存之前对其他myDocker进程不可见，整个连接过程都持有端口映射的文件锁
+		unlock, err := lockPortMapping()
+		if err != nil {
+			log.Log.Error(err)
+			return err
+		}
+		defer unlock()
+		// 解析端口映射，检查与其他容器已映射端口的冲突并自动分配宿主机端口
+		bindings, err := resolvePortBindings(ep.ID, &cinfo.NetworkConfig)
+		if err != nil {
+			log.Log.Error(err)
+			return err
+		}
+		ep.PortBindings = bindings
+		// 记录最终确定下来的端口映射
+		cinfo.PortMapping = formatPortBindings(bindings)
+		ep.PortMapping = cinfo.PortMapping
+	} else if len(cinfo.PortMapping) > 0 || cinfo.PublishAll {
+		// macvlan/ipvlan的容器直接出现在物理二层网络上，不经过宿主机NAT
+		log.Log.Warnf("port mapping is ignored on %s network %s", network.Driver, network.Name)
+	}
+	// 解析带宽限制，只有bridge网络的Veth在宿主机上可以整形
+	bw, err := newBandwidth(cinfo.RateOut, cinfo.RateIn)
+	if err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	if isBridgeNetwork(network) {
+		ep.Bandwidth = bw
+	} else if bw != nil {
+		log.Log.Warnf("rate limit is ignored on %s network %s", network.Driver, network.Name)
+	}
+	// 检查指定的MAC地址
+	if _, err := endpointMacAddress(cinfo.MacAddress, nil); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	// 通过调用IPAM从网络的网段中获取可用的IP作为容器IP地址，双栈网络同时分配IPv6地址
+	if err := allocateEndpointAddress(ep, cinfo.IP); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	// 之后的步骤失败时清理已经创建的设备、带宽限制、端口映射与代理进程，并释放分配的地址
+	connected, portMapped := false, false
+	defer func() {
+		if !connected {
+			// 端口映射失败时configPortMapping已经清理了自己添加的规则
+			if !portMapped {
+				ep.PortBindings = nil
+			}
+			if err := disconnectEndpoint(network, ep, true); err != nil {
+				log.Log.Warnf("rollback endpoint %s: %v", ep.ID, err)
+			}
+		}
+	}()
+	// 未指定MAC地址时由容器的IPv4地址生成，ipvlan的子接口共享父接口的MAC地址
+	if network.Driver != ipvlanDriverName {
+		ep.MacAddress, _ = endpointMacAddress(cinfo.MacAddress, ep.IpAddress)
+	} else if cinfo.MacAddress != "" {
+		log.Log.Warnf("mac address is ignored on ipvlan network %s", network.Name)
+	}
 	// 调用网络驱动的Connect方法连接和配置网络端点
 	if err := drivers[network.Driver].Connect(network, ep); err != nil {
 		log.Log.Error(err)
@@ -108,7 +362,74 @@ func Connect(networkName string, cinfo *record.ContainerInfo) error {
 		return err
 	}
 	// 配置容器到宿主机的端口映射
-	return configPortMapping(ep)
+	if err := configPortMapping(ep, cinfo.UserlandProxy); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	portMapped = true
+	// 保存网络端点信息，以便容器停止时断开连接
+	if err := ep.dump(defaultEndpointPath); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	connected = true
+	return nil
+}
+
+// Disconnect 容器断开网络，释放网络端点占用的资源
+func Disconnect(networkName string, cinfo *record.ContainerInfo) error {
+	network, ok := networks[networkName]
+	if !ok {
+		err := fmt.Errorf(" No Such Network: %s", networkName)
+		log.Log.Error(err)
+		return err
+	}
+	// 加载容器连接网络时保存的网络端点信息
+	ep := &Endpoint{
+		ID: fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+	}
+	if err := ep.load(defaultEndpointPath); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	ep.Network = network
+	if err := disconnectEndpoint(network, ep, false); err != nil {
+		log.Log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// disconnectEndpoint 清理网络端点的设备、端口映射与地址，并删除网络端点的配置文件
+// force为true时清理过程中的错误只记录警告，保证地址一定会被释放
+func disconnectEndpoint(network *Network, ep *Endpoint, force bool) error {
+	check := func(err error) error {
+		if err != nil && force {
+			log.Log.Warnf("disconnect endpoint %s: %v", ep.ID, err)
+			return nil
+		}
+		return err
+	}
+	// 调用网络驱动的Disconnect方法清理网络端点
+	if err := check(drivers[network.Driver].Disconnect(network, ep)); err != nil {
+		return err
+	}
+	// 删除端口映射的规则或代理进程
+	if err := check(removePortMapping(ep)); err != nil {
+		return err
+	}
+	// 释放容器IP
+	if network.Driver != cniDriverName && ep.IpAddress != nil {
+		if err := ipAllocator.Release(network.poolSubnet(), &ep.IpAddress); err != nil {
+			return err
+		}
+	}
+	if network.Driver != cniDriverName && network.IpRange6 != nil && ep.IpAddress6 != nil {
+		if err := ipAllocator.Release(network.IpRange6, &ep.IpAddress6); err != nil {
+			return err
+		}
+	}
+	return ep.remove(defaultEndpointPath)
 }
 
 // Init 从网络配置的目录中加载所有的网络配置信息到networks字典中
@@ -116,6 +437,14 @@ func Init() error {
 	// 加载网络驱动
 	var bridgeDriver = BridgeNetworkDriver{}
 	drivers[bridgeDriver.Name()] = &bridgeDriver
+	var macvlanDriver = MacvlanNetworkDriver{}
+	drivers[macvlanDriver.Name()] = &macvlanDriver
+	var ipvlanDriver = IPVlanNetworkDriver{}
+	drivers[ipvlanDriver.Name()] = &ipvlanDriver
+	var overlayDriver = OverlayNetworkDriver{}
+	drivers[overlayDriver.Name()] = &overlayDriver
+	var cniDriver = CNINetworkDriver{}
+	drivers[cniDriver.Name()] = &cniDriver
 	// 判断网络的配置目录是否存在，不存在则创建
 	if _, err := os.Stat(defaultNetworkPath); err != nil {
 		if os.IsNotExist(err) {
@@ -150,6 +479,8 @@ func Init() error {
 	}); err != nil {
 		return err
 	}
+	// 宿主机重启后网络设备与防火墙规则都不存在了，根据保存的网络信息恢复
+	reconcileOnBoot()
 	return nil
 }
 
@@ -158,9 +489,13 @@ func ListNetwork() {
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
 	fmt.Fprint(w, "NAME\tIpRange\tDriver\n")
 	for _, v := range networks {
+		ipRange := v.IpRange.String()
+		if v.IpRange6 != nil {
+			ipRange += "," + v.IpRange6.String()
+		}
 		fmt.Fprintf(w, "%s\t%s\t%s\n",
 			v.Name,
-			v.IpRange.String(),
+			ipRange,
 			v.Driver,
 		)
 	}
@@ -178,35 +513,51 @@ func DeleteNetwork(networkName string) error {
 		log.Log.Error(err)
 		return err
 	}
-	// 调用IPAM的实例释放网络网关的IP
-	if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
-		return fmt.Errorf(" Error Remove Network gateway ip: %s", err)
-	}
 	// 调用网络驱动删除网络创建的设备与配置
 	if err := drivers[nw.Driver].Delete(nw); err != nil {
 		return fmt.Errorf(" Error Remove Network DriverError: %s", err)
 	}
+	// 驱动删除成功后再调用IPAM的实例删除网段的分配信息，包括网关与保留的地址，CNI网络的地址不由IPAM管理
+	// 驱动删除失败时网络的配置文件与地址池都保留，可以再次删除
+	if nw.Driver != cniDriverName {
+		if err := ipAllocator.DeletePool(nw.poolSubnet()); err != nil {
+			return fmt.Errorf(" Error Remove Network address pool: %s", err)
+		}
+		if nw.IpRange6 != nil {
+			if err := ipAllocator.DeletePool(nw.IpRange6); err != nil {
+				return fmt.Errorf(" Error Remove Network ipv6 address pool: %s", err)
+			}
+		}
+	}
 	// 从网络的配置目录中删除该网络对应的配置文件
 	return nw.remove(defaultNetworkPath)
 }
 
 func configEndpointIpAddressAndRoute(ep *Endpoint, cinfo *record.ContainerInfo) error {
-	// 获取网络端点中的Veth的另一端
-	peerLink, err := netlink.LinkByName(ep.Device.PeerName)
+	// 获取网络端点中需要放入容器的一端，对于bridge就是Veth的另一端
+	peerLink, err := netlink.LinkByName(ep.LinkName)
 	if err != nil {
 		return fmt.Errorf("fail config endpoint: %v", err)
 	}
 	// 将容器的网络端点加入到容器的网络空间中，并使这个函数下面的操作都在这个网络空间中进行，执行完函数后，恢复为默认的网络空间
 	defer enterContainerNetns(&peerLink, cinfo)()
+	// 移入容器后的接口处于关闭状态，重命名为eth0
+	if err := netlink.LinkSetName(peerLink, containerIfName); err != nil {
+		return fmt.Errorf(" Error rename %s to %s: %v", ep.LinkName, containerIfName, err)
+	}
+	ep.IfName = containerIfName
+	if peerLink, err = netlink.LinkByName(ep.IfName); err != nil {
+		return fmt.Errorf("fail config endpoint: %v", err)
+	}
 	// 获取到容器的IP地址以及网段，用于配置容器内部接口地址
 	interfaceIP := *ep.Network.IpRange
 	interfaceIP.IP = ep.IpAddress
 	// 调用setInterfaceIp函数设置容器内Veth端点的IP
-	if err := setInterfaceIP(ep.Device.PeerName, interfaceIP.String()); err != nil {
+	if err := setInterfaceIP(ep.IfName, interfaceIP.String()); err != nil {
 		return fmt.Errorf("NetWork : %v, err : %s", ep.Network, err)
 	}
 	// 启动容器内的Veth端点
-	if err := setInterfaceUP(ep.Device.PeerName); err != nil {
+	if err := setInterfaceUP(ep.IfName); err != nil {
 		return err
 	}
 	// Net Namespace中默认本地地址127.0.0.1的lo网卡是关闭状态的，启动以保证容器访问自己的请求
@@ -222,12 +573,94 @@ func configEndpointIpAddressAndRoute(ep *Endpoint, cinfo *record.ContainerInfo)
 		Gw:        ep.Network.IpRange.IP,
 		Dst:       cidr,
 	}
+	// ipvlan的L3模式下不处理二层广播，没有网关可以ARP，默认路由直接指向设备本身
+	if ep.Network.Driver == ipvlanDriverName && ep.Network.Options[ipvlanModeOption] == ipvlanModeL3 {
+		defaultRoute.Gw = nil
+		defaultRoute.Scope = netlink.SCOPE_LINK
+	}
 	if err := netlink.RouteAdd(defaultRoute); err != nil {
 		return err
 	}
+	// 双栈网络配置IPv6地址与默认路由
+	if ep.IpAddress6 != nil {
+		interfaceIP6 := *ep.Network.IpRange6
+		interfaceIP6.IP = ep.IpAddress6
+		if err := setInterfaceIP(ep.IfName, interfaceIP6.String()); err != nil {
+			return fmt.Errorf("NetWork : %v, err : %s", ep.Network, err)
+		}
+		_, cidr6, _ := net.ParseCIDR("::/0")
+		defaultRoute6 := &netlink.Route{
+			LinkIndex: peerLink.Attrs().Index,
+			Gw:        ep.Network.IpRange6.IP,
+			Dst:       cidr6,
+		}
+		if defaultRoute.Gw == nil {
+			defaultRoute6.Gw = nil
+			defaultRoute6.Scope = netlink.SCOPE_LINK
+		}
+		if err := netlink.RouteAdd(defaultRoute6); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// allocateEndpointAddress 为网络端点分配地址，staticIP不为空时使用指定的地址
+func allocateEndpointAddress(ep *Endpoint, staticIP string) error {
+	network := ep.Network
+	var ip net.IP
+	if staticIP != "" {
+		if ip = net.ParseIP(staticIP); ip == nil {
+			return fmt.Errorf(" invalid ip address: %s", staticIP)
+		}
+		if ip.To4() == nil && network.IpRange6 == nil {
+			return fmt.Errorf(" network %s has no IPv6 subnet for %s", network.Name, staticIP)
+		}
+	}
+	allocate := func(subnet *net.IPNet) (net.IP, error) {
+		if ip != nil && subnet.Contains(ip) {
+			return ip, ipAllocator.AllocateIP(subnet, ip)
+		}
+		if ip != nil && (ip.To4() == nil) == (subnet.IP.To4() == nil) {
+			return nil, fmt.Errorf(" ip %s is not in subnet %s", ip, subnet)
+		}
+		return ipAllocator.Allocate(subnet)
+	}
+	var err error
+	if ep.IpAddress, err = allocate(network.poolSubnet()); err != nil {
+		return err
+	}
+	if network.IpRange6 != nil {
+		if ep.IpAddress6, err = allocate(network.IpRange6); err != nil {
+			_ = ipAllocator.Release(network.poolSubnet(), &ep.IpAddress)
+			return err
+		}
+	}
+	return nil
+}
+
+// splitSubnets 将网段区分为IPv4网段与IPv6网段，每种最多一个
+func splitSubnets(subnets []string) (subnet, subnet6 string, err error) {
+	for _, s := range subnets {
+		ip, _, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", "", err
+		}
+		if ip.To4() != nil {
+			if subnet != "" {
+				return "", "", fmt.Errorf(" only one IPv4 subnet is allowed")
+			}
+			subnet = s
+		} else {
+			if subnet6 != "" {
+				return "", "", fmt.Errorf(" only one IPv6 subnet is allowed")
+			}
+			subnet6 = s
+		}
+	}
+	return subnet, subnet6, nil
+}
+
 // enterContainerNetns 进入容器内部并配置veth
 // 锁定当前程序执行的线程，防止goroutine别调度到其他线程，离开目标网络空间
 // 返回一个函数指针，执行这个返回函数才会退出容器的网络空间，回到宿主机的网络空间
@@ -272,28 +705,6 @@ func enterContainerNetns(enLink *netlink.Link, cinfo *record.ContainerInfo) func
 	}
 }
 
-// configPortMapping 配置端口映射
-func configPortMapping(ep *Endpoint) error {
-	// 遍历容器端口映射列表
-	for _, pm := range ep.PortMapping {
-		portMapping := strings.Split(pm, ":")
-		if len(portMapping) != 2 {
-			log.Log.Errorf("port mapping format error, %v", pm)
-			continue
-		}
-		// 使用命令行实现iptable
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
-			portMapping[0], ep.IpAddress.String(), portMapping[1])
-		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-		output, err := cmd.Output()
-		if err != nil {
-			logrus.Errorf("iptables Output, %v", output)
-			continue
-		}
-	}
-	return nil
-}
-
 //dump 将网络配置信息保存在文件系统中
 func (nw *Network) dump(dumpPath string) error {
 	// 检查保存的目录是否存在
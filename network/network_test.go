@@ -0,0 +1,142 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"xwj/mydocker/record"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// useTestNetns 将测试的goroutine锁定在当前线程并切换到新的Net Namespace，测试创建的设备不会影响宿主机
+// 没有root权限时跳过测试，测试结束后回到原来的Net Namespace
+func useTestNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("create net namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := netns.Set(origin); err != nil {
+			t.Error(err)
+		}
+		origin.Close()
+		ns.Close()
+		runtime.UnlockOSThread()
+	})
+}
+
+// addLinkOrSkip 创建网络设备，内核不支持这种设备时跳过测试
+func addLinkOrSkip(t *testing.T, link netlink.Link) {
+	if err := netlink.LinkAdd(link); err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			t.Skipf("kernel does not support %s link: %v", link.Type(), err)
+		}
+		t.Fatal(err)
+	}
+}
+
+// addParentLink 创建一个dummy设备作为macvlan/ipvlan的父接口
+// 内核没有dummy驱动时使用veth代替，返回父接口
+func addParentLink(t *testing.T, name string) netlink.Link {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: la})
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		err = netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: name + "-peer"})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parent
+}
+
+// startContainerNetns 启动一个拥有独立Net Namespace的进程代替容器，测试结束后结束进程
+func startContainerNetns(t *testing.T) *record.ContainerInfo {
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return &record.ContainerInfo{Id: "test", Pid: strconv.Itoa(cmd.Process.Pid)}
+}
+
+// checkContainerAddress 检查容器内网卡的地址
+func checkContainerAddress(t *testing.T, cinfo *record.ContainerInfo, cidr string) {
+	pid, _ := strconv.Atoi(cinfo.Pid)
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Delete()
+	link, err := handle.LinkByName(containerIfName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := handle.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, ipNet, _ := net.ParseCIDR(cidr)
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) && addr.Mask.String() == ipNet.Mask.String() {
+			return
+		}
+	}
+	t.Fatalf("%s in container has addresses %v, want %s", containerIfName, addrs, cidr)
+}
+
+// connectParentNetwork 在父接口上创建网络并连接一个端点，检查子接口的父接口后配置到容器中
+func connectParentNetwork(t *testing.T, d NetworkDriver, options map[string]string, ip string) (netlink.Link, *Endpoint) {
+	parent := addParentLink(t, "tparent")
+	options[parentOption] = parent.Attrs().Name
+	n, err := d.Create("192.168.50.0/24", "", "testnet", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &Endpoint{ID: "container-testnet", Network: n, IpAddress: net.ParseIP(ip)}
+	if ep.MacAddress, err = endpointMacAddress("", ep.IpAddress); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Connect(n, ep); err != nil {
+		t.Fatal(err)
+	}
+	link, err := netlink.LinkByName(ep.LinkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Attrs().ParentIndex != parent.Attrs().Index {
+		t.Fatalf("parent index of %s = %d, want %d", ep.LinkName, link.Attrs().ParentIndex, parent.Attrs().Index)
+	}
+	return link, ep
+}
@@ -0,0 +1,539 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"xwj/mydocker/log"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const nftablesBackendName = "nftables"
+
+// myDocker在nftables中使用独立的表，所有规则都放在这个表中，清理时直接删除整张表
+const nftTableName = "mydocker"
+
+// nftFamily 一个协议族在nftables中的表与链，IPv4与IPv6各使用一张名为mydocker的表
+type nftFamily struct {
+	table       *nftables.Table
+	prerouting  *nftables.Chain // 端口映射的DNAT规则，外部进入宿主机的流量
+	output      *nftables.Chain // 端口映射的DNAT规则，宿主机本机发出的流量
+	postrouting *nftables.Chain // MASQUERADE规则
+	forward     *nftables.Chain // 转发的放行与隔离规则
+	isolation   *nftables.Chain // 网络之间的隔离规则，与iptables后端的两级隔离链对应
+	isolation2  *nftables.Chain
+	natFamily   uint32 // NAT表达式中的协议族
+	addrLen     uint32 // 地址长度
+	saddrOffset uint32 // 源地址在ip头中的偏移
+	daddrOffset uint32 // 目的地址在ip头中的偏移
+}
+
+var (
+	nft4 = newNFTFamily(nftables.TableFamilyIPv4, unix.NFPROTO_IPV4, net.IPv4len, 12, 16)
+	nft6 = newNFTFamily(nftables.TableFamilyIPv6, unix.NFPROTO_IPV6, net.IPv6len, 8, 24)
+)
+
+// newNFTFamily 创建一个协议族的表与链的描述
+func newNFTFamily(family nftables.TableFamily, natFamily uint32, addrLen, saddrOffset, daddrOffset uint32) *nftFamily {
+	table := &nftables.Table{Name: nftTableName, Family: family}
+	return &nftFamily{
+		table: table,
+		prerouting: &nftables.Chain{Name: "prerouting", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest},
+		output: &nftables.Chain{Name: "output", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest},
+		postrouting: &nftables.Chain{Name: "postrouting", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource},
+		forward: &nftables.Chain{Name: "forward", Table: table, Type: nftables.ChainTypeFilter,
+			Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter},
+		isolation:   &nftables.Chain{Name: "isolation", Table: table},
+		isolation2:  &nftables.Chain{Name: "isolation-2", Table: table},
+		natFamily:   natFamily,
+		addrLen:     addrLen,
+		saddrOffset: saddrOffset,
+		daddrOffset: daddrOffset,
+	}
+}
+
+// chains 协议族的所有链
+func (fam *nftFamily) chains() []*nftables.Chain {
+	return []*nftables.Chain{fam.prerouting, fam.output, fam.postrouting, fam.forward, fam.isolation, fam.isolation2}
+}
+
+// nftFamilyOf 根据地址选择协议族
+func nftFamilyOf(ip net.IP) *nftFamily {
+	if ip.To4() == nil {
+		return nft6
+	}
+	return nft4
+}
+
+// nftCtStatusDNAT 连接跟踪状态中的IPS_DST_NAT位
+const nftCtStatusDNAT uint32 = 0x20
+
+// nftablesFirewall 通过netlink直接操作nftables的防火墙后端，不依赖iptables与nft命令
+type nftablesFirewall struct {
+}
+
+// nftRule 一条nftables规则，key保存在规则的UserData中，用来识别规则实现幂等的添加与删除
+type nftRule struct {
+	chain *nftables.Chain
+	key   string
+	exprs []expr.Any
+}
+
+// nftablesAvailable 当前内核与权限是否可以使用nftables
+func nftablesAvailable() bool {
+	conn := &nftables.Conn{}
+	_, err := conn.ListTables()
+	return err == nil
+}
+
+func (f *nftablesFirewall) Name() string {
+	return nftablesBackendName
+}
+
+// Setup 创建myDocker的表与基础链，表与链已经存在时不做处理
+// 内核不支持IPv6 NAT时只给出警告，IPv4网络仍然可以使用
+func (f *nftablesFirewall) Setup() error {
+	if err := setupNFTFamily(nft4); err != nil {
+		return err
+	}
+	if err := setupNFTFamily(nft6); err != nil {
+		log.Log.Warnf("setup nftables ipv6 table error: %v", err)
+	}
+	return nil
+}
+
+// setupNFTFamily 创建一个协议族的表与链
+func setupNFTFamily(fam *nftFamily) error {
+	conn := &nftables.Conn{}
+	conn.AddTable(fam.table)
+	for _, chain := range fam.chains() {
+		conn.AddChain(chain)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf(" setup nftables table %s: %v", nftTableName, err)
+	}
+	// forward链中先经过隔离链
+	jump := nftRule{fam.forward, "jump-isolation", []expr.Any{
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: fam.isolation.Name},
+	}}
+	existing, err := findNFTRules(conn, jump)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	conn.InsertRule(&nftables.Rule{
+		Table:    fam.table,
+		Chain:    jump.chain,
+		Exprs:    jump.exprs,
+		UserData: []byte(jump.key),
+	})
+	return conn.Flush()
+}
+
+// Cleanup 删除myDocker的表，表中的所有规则一起被删除
+func (f *nftablesFirewall) Cleanup() error {
+	conn := &nftables.Conn{}
+	for _, fam := range []*nftFamily{nft4, nft6} {
+		tables, err := conn.ListTablesOfFamily(fam.table.Family)
+		if err != nil {
+			return err
+		}
+		for _, t := range tables {
+			if t.Name == nftTableName {
+				conn.DelTable(fam.table)
+			}
+		}
+	}
+	return conn.Flush()
+}
+
+func (f *nftablesFirewall) AddMasquerade(n *Network) error {
+	if err := addNFTRules(nftMasqueradeRules(n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil {
+		return nil
+	}
+	return addNFTRules(nftMasquerade6Rules(n))
+}
+
+func (f *nftablesFirewall) DelMasquerade(n *Network) error {
+	if err := removeNFTRules(nftMasqueradeRules(n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil {
+		return nil
+	}
+	return removeNFTRules(nftMasquerade6Rules(n))
+}
+
+// AddIsolation 转发与隔离规则只匹配网卡，IPv4与IPv6的表中使用相同的规则
+func (f *nftablesFirewall) AddIsolation(n *Network) error {
+	if err := addNFTRules(nftIsolationRules(nft4, n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil {
+		return nil
+	}
+	return addNFTRules(nftIsolationRules(nft6, n))
+}
+
+func (f *nftablesFirewall) DelIsolation(n *Network) error {
+	if err := removeNFTRules(nftIsolationRules(nft4, n)); err != nil {
+		return err
+	}
+	if n.IpRange6 == nil {
+		return nil
+	}
+	return removeNFTRules(nftIsolationRules(nft6, n))
+}
+
+func (f *nftablesFirewall) AddDNAT(n *Network, containerIP net.IP, pb PortBinding) error {
+	rules, err := nftDNATRules(pb, containerIP, n.Name)
+	if err != nil {
+		return err
+	}
+	return addNFTRules(rules)
+}
+
+func (f *nftablesFirewall) DelDNAT(n *Network, containerIP net.IP, pb PortBinding) error {
+	rules, err := nftDNATRules(pb, containerIP, n.Name)
+	if err != nil {
+		return err
+	}
+	return removeNFTRules(rules)
+}
+
+// nftMasqueradeRules bridge网络的SNAT规则，与iptables后端的masqueradeRules对应
+func nftMasqueradeRules(n *Network) []nftRule {
+	bridgeName := n.Name
+	_, localhost, _ := net.ParseCIDR(localhostSubnet)
+	rules := []nftRule{
+		// ip saddr 127.0.0.0/8 oifname <bridge> masquerade
+		{nft4.postrouting, "masq-localhost:" + n.Name, concatExprs(
+			matchSubnet(nft4, nft4.saddrOffset, localhost),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			[]expr.Any{&expr.Masq{}},
+		)},
+	}
+	if !isInternal(n) {
+		// ip saddr <subnet> oifname != <bridge> masquerade
+		rules = append(rules, nftRule{nft4.postrouting, "masq:" + n.Name, concatExprs(
+			matchSubnet(nft4, nft4.saddrOffset, n.IpRange),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, bridgeName),
+			[]expr.Any{&expr.Masq{}},
+		)})
+	}
+	return rules
+}
+
+// nftMasquerade6Rules 双栈bridge网络的IPv6 SNAT规则，与iptables后端的masquerade6Rules对应
+func nftMasquerade6Rules(n *Network) []nftRule {
+	if isInternal(n) {
+		return nil
+	}
+	// ip6 saddr <subnet6> oifname != <bridge> masquerade
+	return []nftRule{
+		{nft6.postrouting, "masq:" + n.Name, concatExprs(
+			matchSubnet(nft6, nft6.saddrOffset, n.IpRange6),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, n.Name),
+			[]expr.Any{&expr.Masq{}},
+		)},
+	}
+}
+
+// nftIsolationRules bridge网络的转发与隔离规则，与iptables后端的isolationRules对应
+func nftIsolationRules(fam *nftFamily, n *Network) []nftRule {
+	bridgeName := n.Name
+	rules := []nftRule{
+		// iifname <bridge> oifname != <bridge> jump isolation-2
+		{fam.isolation, "isolation:" + n.Name, concatExprs(
+			matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, bridgeName),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: fam.isolation2.Name}},
+		)},
+		// oifname <bridge> drop
+		{fam.isolation2, "isolation-2:" + n.Name, concatExprs(
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+		)},
+	}
+	if !iccEnabled(n) {
+		// iifname <bridge> oifname <bridge> ct status dnat accept
+		rules = append(rules, nftRule{fam.forward, "icc-dnat:" + n.Name, concatExprs(
+			matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			matchCtStatusDNAT(),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		)})
+		// iifname <bridge> oifname <bridge> drop
+		rules = append(rules, nftRule{fam.forward, "icc-drop:" + n.Name, concatExprs(
+			matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+		)})
+	}
+	return append(rules,
+		// iifname <bridge> accept
+		nftRule{fam.forward, "accept-out:" + n.Name, concatExprs(
+			matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		)},
+		// oifname <bridge> ct state related,established accept
+		nftRule{fam.forward, "accept-reply:" + n.Name, concatExprs(
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			matchCtEstablished(),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		)},
+	)
+}
+
+// nftDNATRules 一条端口映射需要的规则，与iptables后端的dnatRules对应
+func nftDNATRules(pb PortBinding, containerIP net.IP, bridgeName string) ([]nftRule, error) {
+	fam := nftFamilyOf(containerIP)
+	ip := nftAddr(fam, containerIP)
+	proto, err := nftProto(pb.Proto)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s:%s:%s", bridgeName, containerIP, pb)
+	// 目的地址是宿主机本机地址或者指定的宿主机地址
+	var matchHost []expr.Any
+	if isAnyAddr(pb.HostIP) {
+		matchHost = []expr.Any{
+			&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		}
+	} else {
+		hostIP := net.ParseIP(pb.HostIP)
+		if hostIP == nil || nftFamilyOf(hostIP) != fam {
+			return nil, fmt.Errorf(" invalid host ip %s", pb.HostIP)
+		}
+		matchHost = matchIP(fam, fam.daddrOffset, hostIP)
+	}
+	dnat := concatExprs(
+		matchHost,
+		matchL4Proto(proto),
+		matchPort(uint16(pb.HostPort)),
+		[]expr.Any{
+			&expr.Immediate{Register: 1, Data: ip},
+			&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(pb.ContainerPort))},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: fam.natFamily, RegAddrMin: 1, RegProtoMin: 2},
+		},
+	)
+	return []nftRule{
+		// 外部进入宿主机以及同一网桥上的容器访问宿主机发布端口的流量
+		{fam.prerouting, "dnat:" + key, dnat},
+		// 宿主机本机发出的流量
+		{fam.output, "dnat:" + key, dnat},
+		// hairpin：容器通过发布的端口访问自己时，需要做SNAT让回包经过宿主机
+		{fam.postrouting, "hairpin:" + key, concatExprs(
+			matchIP(fam, fam.saddrOffset, ip),
+			matchIP(fam, fam.daddrOffset, ip),
+			matchL4Proto(proto),
+			matchPort(uint16(pb.ContainerPort)),
+			[]expr.Any{&expr.Masq{}},
+		)},
+		// 放行DNAT之后转发到容器的流量
+		{fam.forward, "accept-dnat:" + key, concatExprs(
+			matchIP(fam, fam.daddrOffset, ip),
+			matchIfname(expr.MetaKeyIIFNAME, expr.CmpOpNeq, bridgeName),
+			matchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			matchL4Proto(proto),
+			matchPort(uint16(pb.ContainerPort)),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		)},
+	}, nil
+}
+
+// addNFTRules 依次添加规则，已经存在的规则不重复添加
+func addNFTRules(rules []nftRule) error {
+	conn := &nftables.Conn{}
+	for _, rule := range rules {
+		existing, err := findNFTRules(conn, rule)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			continue
+		}
+		conn.AddRule(&nftables.Rule{
+			Table:    rule.chain.Table,
+			Chain:    rule.chain,
+			Exprs:    rule.exprs,
+			UserData: []byte(rule.key),
+		})
+	}
+	return conn.Flush()
+}
+
+// removeNFTRules 删除规则，表或链不存在时视为已经删除
+// 与iptables一样，查找或删除某条规则失败时继续处理其他规则，返回第一个错误
+func removeNFTRules(rules []nftRule) error {
+	conn := &nftables.Conn{}
+	var firstErr error
+	for _, rule := range rules {
+		existing, err := findNFTRules(conn, rule)
+		if err != nil {
+			// 查找失败的原因是链不存在时规则也不存在
+			if exists, chainErr := nftChainExists(conn, rule.chain); chainErr == nil && !exists {
+				continue
+			}
+			err = fmt.Errorf(" find nftables rule %s in chain %s: %v", rule.key, rule.chain.Name, err)
+			log.Log.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, r := range existing {
+			if err := conn.DelRule(r); err != nil {
+				log.Log.Error(err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// nftChainExists 判断链是否存在，表不存在时链也不存在
+func nftChainExists(conn *nftables.Conn, chain *nftables.Chain) (bool, error) {
+	chains, err := conn.ListChainsOfTableFamily(chain.Table.Family)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range chains {
+		if c.Table.Name == chain.Table.Name && c.Name == chain.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findNFTRules 根据UserData中的key查找链中已经存在的规则
+func findNFTRules(conn *nftables.Conn, rule nftRule) ([]*nftables.Rule, error) {
+	rules, err := conn.GetRules(rule.chain.Table, rule.chain)
+	if err != nil {
+		return nil, err
+	}
+	var found []*nftables.Rule
+	for _, r := range rules {
+		if bytes.Equal(r.UserData, []byte(rule.key)) {
+			found = append(found, r)
+		}
+	}
+	return found, nil
+}
+
+// nftProto 协议名转换为ip协议号
+func nftProto(proto string) (byte, error) {
+	switch proto {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "sctp":
+		return unix.IPPROTO_SCTP, nil
+	}
+	return 0, fmt.Errorf(" unsupported protocol: %s", proto)
+}
+
+// concatExprs 拼接多组表达式
+func concatExprs(groups ...[]expr.Any) []expr.Any {
+	var exprs []expr.Any
+	for _, g := range groups {
+		exprs = append(exprs, g...)
+	}
+	return exprs
+}
+
+// matchIfname 匹配输入或输出网卡名，内核中网卡名是以\0结尾的16字节
+func matchIfname(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
+
+// matchIP 匹配ip头中偏移offset处的地址
+func matchIP(fam *nftFamily, offset uint32, ip net.IP) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: fam.addrLen},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftAddr(fam, ip)},
+	}
+}
+
+// matchSubnet 匹配ip头中偏移offset处的地址属于某个网段
+func matchSubnet(fam *nftFamily, offset uint32, subnet *net.IPNet) []expr.Any {
+	mask := []byte(subnet.Mask)
+	if uint32(len(mask)) != fam.addrLen {
+		mask = mask[uint32(len(mask))-fam.addrLen:]
+	}
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: fam.addrLen},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: fam.addrLen, Mask: mask, Xor: make([]byte, fam.addrLen)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftAddr(fam, subnet.IP.Mask(subnet.Mask))},
+	}
+}
+
+// nftAddr 将地址转换为协议族对应的字节长度
+func nftAddr(fam *nftFamily, ip net.IP) []byte {
+	if fam.addrLen == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// matchL4Proto 匹配传输层协议
+func matchL4Proto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+// matchPort 匹配传输层的目的端口，tcp/udp/sctp的目的端口都在偏移2处
+func matchPort(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// matchCtEstablished 匹配ct state related,established
+func matchCtEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:  binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// matchCtStatusDNAT 匹配ct status dnat，即经过了DNAT的连接
+func matchCtStatusDNAT() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(nftCtStatusDNAT),
+			Xor:  binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
@@ -0,0 +1,175 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+// nftRuleKeys 规则所在的链与标识
+func nftRuleKeys(rules []nftRule) []string {
+	var keys []string
+	for _, rule := range rules {
+		keys = append(keys, rule.chain.Table.Name+"/"+rule.chain.Name+" "+rule.key)
+	}
+	return keys
+}
+
+// nftVerdict 规则最后的动作
+func nftVerdict(rule nftRule) interface{} {
+	switch last := rule.exprs[len(rule.exprs)-1].(type) {
+	case *expr.Verdict:
+		return last.Kind
+	default:
+		return last
+	}
+}
+
+func TestNFTMasqueradeRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    []string
+	}{
+		{"default", map[string]string{}, []string{"mydocker/postrouting masq-localhost:testbr", "mydocker/postrouting masq:testbr"}},
+		{"internal", map[string]string{internalOption: "true"}, []string{"mydocker/postrouting masq-localhost:testbr"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := nftMasqueradeRules(newTestBridgeNetwork(t, "172.18.0.1/16", tt.options))
+			if got := nftRuleKeys(rules); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("nftMasqueradeRules = %q, want %q", got, tt.want)
+			}
+			for _, rule := range rules {
+				if rule.chain.Table.Family != nft4.table.Family {
+					t.Errorf("rule %s is not in the ipv4 table", rule.key)
+				}
+				if _, ok := nftVerdict(rule).(*expr.Masq); !ok {
+					t.Errorf("rule %s ends with %v, want masquerade", rule.key, nftVerdict(rule))
+				}
+			}
+		})
+	}
+}
+
+func TestNFTIsolationRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  map[string]string
+		want     []string
+		verdicts []expr.VerdictKind
+	}{
+		{
+			name:    "icc enabled",
+			options: map[string]string{},
+			want: []string{
+				"mydocker/isolation isolation:testbr",
+				"mydocker/isolation-2 isolation-2:testbr",
+				"mydocker/forward accept-out:testbr",
+				"mydocker/forward accept-reply:testbr",
+			},
+			verdicts: []expr.VerdictKind{expr.VerdictJump, expr.VerdictDrop, expr.VerdictAccept, expr.VerdictAccept},
+		},
+		{
+			name:    "icc=false",
+			options: map[string]string{iccOption: "false"},
+			want: []string{
+				"mydocker/isolation isolation:testbr",
+				"mydocker/isolation-2 isolation-2:testbr",
+				"mydocker/forward icc-dnat:testbr",
+				"mydocker/forward icc-drop:testbr",
+				"mydocker/forward accept-out:testbr",
+				"mydocker/forward accept-reply:testbr",
+			},
+			verdicts: []expr.VerdictKind{expr.VerdictJump, expr.VerdictDrop, expr.VerdictAccept, expr.VerdictDrop, expr.VerdictAccept, expr.VerdictAccept},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := nftIsolationRules(nft4, newTestBridgeNetwork(t, "172.18.0.1/16", tt.options))
+			if got := nftRuleKeys(rules); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("nftIsolationRules = %q, want %q", got, tt.want)
+			}
+			for i, rule := range rules {
+				if got := nftVerdict(rule); got != tt.verdicts[i] {
+					t.Errorf("rule %s verdict = %v, want %v", rule.key, got, tt.verdicts[i])
+				}
+			}
+			if jump := rules[0].exprs[len(rules[0].exprs)-1].(*expr.Verdict); jump.Chain != nft4.isolation2.Name {
+				t.Errorf("isolation rule jumps to %q, want %q", jump.Chain, nft4.isolation2.Name)
+			}
+		})
+	}
+}
+
+func TestNFTMasquerade6Rules(t *testing.T) {
+	n := newTestBridgeNetwork(t, "172.18.0.1/16", map[string]string{})
+	n.IpRange6 = &net.IPNet{IP: net.ParseIP("fd00:18::1"), Mask: net.CIDRMask(64, 128)}
+	rules := nftMasquerade6Rules(n)
+	if got, want := nftRuleKeys(rules), []string{"mydocker/postrouting masq:testbr"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("nftMasquerade6Rules = %q, want %q", got, want)
+	}
+	if rules[0].chain != nft6.postrouting {
+		t.Errorf("rule is in %s of family %v, want the ipv6 table", rules[0].chain.Name, rules[0].chain.Table.Family)
+	}
+	// 匹配源地址的前缀：IPv6地址长度为16字节
+	payload := rules[0].exprs[0].(*expr.Payload)
+	if payload.Offset != nft6.saddrOffset || payload.Len != net.IPv6len {
+		t.Errorf("saddr payload = %+v, want offset %d len %d", payload, nft6.saddrOffset, net.IPv6len)
+	}
+	n.Options[internalOption] = "true"
+	if got := nftMasquerade6Rules(n); len(got) != 0 {
+		t.Fatalf("nftMasquerade6Rules of internal network = %q, want none", nftRuleKeys(got))
+	}
+}
+
+func TestNFTDNATRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		containerIP string
+		pb          PortBinding
+		family      *nftFamily
+		err         bool
+	}{
+		{name: "ipv4", containerIP: "172.18.0.2", pb: PortBinding{HostPort: 8080, ContainerPort: 80, Proto: "tcp"}, family: nft4},
+		{name: "ipv4 host ip", containerIP: "172.18.0.2", pb: PortBinding{HostIP: "127.0.0.1", HostPort: 53, ContainerPort: 53, Proto: "udp"}, family: nft4},
+		{name: "ipv6", containerIP: "fd00:18::2", pb: PortBinding{HostIP: "::1", HostPort: 8080, ContainerPort: 80, Proto: "sctp"}, family: nft6},
+		{name: "host ip of another family", containerIP: "fd00:18::2", pb: PortBinding{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Proto: "tcp"}, err: true},
+		{name: "unsupported protocol", containerIP: "172.18.0.2", pb: PortBinding{HostPort: 8080, ContainerPort: 80, Proto: "icmp"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := nftDNATRules(tt.pb, net.ParseIP(tt.containerIP), "testbr")
+			if tt.err {
+				if err == nil {
+					t.Fatalf("nftDNATRules = %q, want error", nftRuleKeys(rules))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "testbr:" + tt.containerIP + ":" + tt.pb.String()
+			want := []string{
+				"mydocker/prerouting dnat:" + key,
+				"mydocker/output dnat:" + key,
+				"mydocker/postrouting hairpin:" + key,
+				"mydocker/forward accept-dnat:" + key,
+			}
+			if got := nftRuleKeys(rules); !reflect.DeepEqual(got, want) {
+				t.Fatalf("nftDNATRules = %q, want %q", got, want)
+			}
+			for _, rule := range rules {
+				if rule.chain.Table != tt.family.table {
+					t.Errorf("rule %s is in table of family %v", rule.key, rule.chain.Table.Family)
+				}
+			}
+			nat, ok := nftVerdict(rules[0]).(*expr.NAT)
+			if !ok || nat.Type != expr.NATTypeDestNAT || nat.Family != tt.family.natFamily {
+				t.Fatalf("dnat rule ends with %+v, want dnat of family %d", nftVerdict(rules[0]), tt.family.natFamily)
+			}
+		})
+	}
+}
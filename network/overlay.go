@@ -0,0 +1,374 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"xwj/mydocker/log"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 多个宿主机上的overlay网络使用相同的网段与VNI，每个宿主机上的网桥通过VXLAN设备连接成同一个二层网络
+// 在一台机器上可以用两个Net Namespace模拟两个宿主机，例如：
+//   ip netns exec h1 myDocker network create --driver overlay --subnet 10.20.0.0/16 -o vni=100 -o host_id=1 -o vxlan_local=192.168.100.1 -o peers=/etc/mydocker/peers ov1
+//   ip netns exec h2 myDocker network create --driver overlay --subnet 10.20.0.0/16 -o vni=100 -o host_id=2 -o vxlan_local=192.168.100.2 -o peers=/etc/mydocker/peers ov2
+// 两个宿主机共用存储目录时，IPAM按宿主机的地址分区记录分配信息，因此不会冲突
+
+const (
+	overlayDriverName = "overlay"
+	vniOption         = "vni"         // VXLAN网络标识
+	vxlanLocalOption  = "vxlan_local" // 本机VTEP的地址，不指定时由内核根据路由选择
+	vxlanDeviceOption = "vxlan_dev"   // 承载VXLAN流量的宿主机网卡
+	vxlanPortOption   = "vxlan_port"  // VXLAN的UDP端口
+	peersOption       = "peers"       // 其他宿主机VTEP地址的列表文件，每行一个地址，#开头为注释
+	hostIDOption      = "host_id"     // 宿主机在集群中的编号，决定本机分配地址的分区
+	hostBitsOption    = "host_bits"   // 网段中用于区分宿主机的位数
+	defaultVxlanPort  = 4789
+	defaultHostBits   = 8
+	vxlanOverhead     = 50 // VXLAN封装的额外头部长度
+	defaultOverlayMTU = 1500 - vxlanOverhead
+)
+
+// OverlayNetworkDriver 基于VXLAN的跨主机overlay网络驱动
+// 每个网络在宿主机上是一个Linux Bridge加上挂载在网桥上的VXLAN设备，容器仍然通过Veth连接到网桥
+// 其他宿主机通过静态的FDB条目指定，广播与未知单播的流量复制给所有的对端，远端容器的MAC地址由VXLAN设备学习
+type OverlayNetworkDriver struct {
+	bridge BridgeNetworkDriver
+}
+
+// OverlayConfig overlay网络的VXLAN配置
+type OverlayConfig struct {
+	VNI       int      `json:"vni"`                  // VXLAN网络标识
+	VxlanName string   `json:"vxlan_name"`           // VXLAN设备名
+	Local     string   `json:"local,omitempty"`      // 本机VTEP的地址
+	Device    string   `json:"device,omitempty"`     // 承载VXLAN流量的宿主机网卡
+	Port      int      `json:"port"`                 // VXLAN的UDP端口
+	PeersFile string   `json:"peers_file,omitempty"` // 对端列表文件
+	Peers     []string `json:"peers,omitempty"`      // 其他宿主机VTEP的地址
+}
+
+func (d *OverlayNetworkDriver) Name() string {
+	return overlayDriverName
+}
+
+// Create 创建网桥以及挂载在网桥上的VXLAN设备，并为所有对端添加FDB条目
+func (d *OverlayNetworkDriver) Create(subnet, subnet6 string, name string, options map[string]string) (*Network, error) {
+	if subnet6 != "" {
+		return nil, fmt.Errorf(" overlay network does not support IPv6")
+	}
+	cfg, err := newOverlayConfig(name, options)
+	if err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	// 未指定MTU时为VXLAN封装留出空间，容器的Veth与网桥使用相同的MTU
+	if options == nil {
+		options = map[string]string{}
+	}
+	if options[mtuOption] == "" {
+		options[mtuOption] = strconv.Itoa(defaultOverlayMTU)
+	}
+	ip, ipRange, err := net.ParseCIDR(subnet)
+	if err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	ipRange.IP = ip
+	n := &Network{
+		Name:    name,
+		IpRange: ipRange,
+		Driver:  d.Name(),
+		Options: options,
+		Overlay: cfg,
+	}
+	if err := d.bridge.initBridge(n); err != nil {
+		log.Log.Error(err)
+		return nil, err
+	}
+	if err := createVxlanInterface(n); err != nil {
+		log.Log.Error(err)
+		_ = d.bridge.Delete(n)
+		return nil, err
+	}
+	return n, nil
+}
+
+// Delete 删除VXLAN设备与网桥
+func (d *OverlayNetworkDriver) Delete(network *Network) error {
+	if network.Overlay != nil {
+		if err := deleteLinkIfExist(network.Overlay.VxlanName); err != nil {
+			return err
+		}
+	}
+	return d.bridge.Delete(network)
+}
+
+// Connect 容器与bridge网络一样通过Veth连接到网桥
+func (d *OverlayNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	return d.bridge.Connect(network, endpoint)
+}
+
+func (d *OverlayNetworkDriver) Disconnect(network *Network, endpoint *Endpoint) error {
+	return d.bridge.Disconnect(network, endpoint)
+}
+
+// newOverlayConfig 解析overlay网络的选项，读取对端列表文件
+func newOverlayConfig(name string, options map[string]string) (*OverlayConfig, error) {
+	vni, err := strconv.Atoi(options[vniOption])
+	if err != nil || vni <= 0 || vni >= 1<<24 {
+		return nil, fmt.Errorf(" overlay network requires -o %s=<1-16777215>", vniOption)
+	}
+	cfg := &OverlayConfig{
+		VNI:       vni,
+		VxlanName: endpointLinkNames("overlay-"+name, "vxl-")[0],
+		Local:     options[vxlanLocalOption],
+		Device:    options[vxlanDeviceOption],
+		Port:      defaultVxlanPort,
+		PeersFile: options[peersOption],
+	}
+	if cfg.Local != "" && net.ParseIP(cfg.Local).To4() == nil {
+		return nil, fmt.Errorf(" invalid %s: %s", vxlanLocalOption, cfg.Local)
+	}
+	if port, ok := options[vxlanPortOption]; ok {
+		if cfg.Port, err = strconv.Atoi(port); err != nil || cfg.Port <= 0 || cfg.Port > 65535 {
+			return nil, fmt.Errorf(" invalid %s: %s", vxlanPortOption, port)
+		}
+	}
+	if cfg.PeersFile != "" {
+		if cfg.Peers, err = readPeersFile(cfg.PeersFile, cfg.Local); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// readPeersFile 读取对端列表文件，跳过本机的地址
+func readPeersFile(file, local string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var peers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip.To4() == nil {
+			return nil, fmt.Errorf(" invalid peer address %s in %s", line, file)
+		}
+		if ip.String() == local {
+			continue
+		}
+		peers = append(peers, ip.String())
+	}
+	return peers, scanner.Err()
+}
+
+// createVxlanInterface 创建VXLAN设备并挂载到网桥上
+func createVxlanInterface(n *Network) error {
+	cfg := n.Overlay
+	br, err := netlink.LinkByName(n.Name)
+	if err != nil {
+		return fmt.Errorf(" error get interface: %v", err)
+	}
+	mtu, err := networkMTU(n)
+	if err != nil {
+		return err
+	}
+	la := netlink.NewLinkAttrs()
+	la.Name = cfg.VxlanName
+	la.MasterIndex = br.Attrs().Index
+	la.MTU = mtu
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: la,
+		VxlanId:   cfg.VNI,
+		Port:      cfg.Port,
+		Learning:  true,
+	}
+	if cfg.Local != "" {
+		vxlan.SrcAddr = net.ParseIP(cfg.Local)
+	}
+	if cfg.Device != "" {
+		dev, err := netlink.LinkByName(cfg.Device)
+		if err != nil {
+			return fmt.Errorf(" error get vxlan device %s: %v", cfg.Device, err)
+		}
+		vxlan.VtepDevIndex = dev.Attrs().Index
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return fmt.Errorf(" Error add vxlan device %s: %v", cfg.VxlanName, err)
+	}
+	if err := setupVxlanInterface(vxlan, cfg.Peers); err != nil {
+		// 删除已经创建的VXLAN设备，否则重新创建网络时会因为设备已经存在而失败
+		if delErr := netlink.LinkDel(vxlan); delErr != nil {
+			log.Log.Warnf("delete vxlan device %s error: %v", cfg.VxlanName, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// setupVxlanInterface 启动VXLAN设备并为所有对端添加FDB条目
+func setupVxlanInterface(vxlan *netlink.Vxlan, peers []string) error {
+	if err := netlink.LinkSetUp(vxlan); err != nil {
+		return fmt.Errorf(" Error set vxlan device %s up: %v", vxlan.Name, err)
+	}
+	for _, peer := range peers {
+		if err := addPeerFDB(vxlan, peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peerFDB 对端的FDB条目：全0的MAC地址表示广播与未知单播的流量都发往这个对端
+func peerFDB(link netlink.Link, peer string) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           net.ParseIP(peer),
+		HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+	}
+}
+
+// addPeerFDB 等价于 bridge fdb append 00:00:00:00:00:00 dev vxlan dst peer
+func addPeerFDB(link netlink.Link, peer string) error {
+	if err := netlink.NeighAppend(peerFDB(link, peer)); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf(" Error add fdb entry for peer %s: %v", peer, err)
+	}
+	return nil
+}
+
+// delPeerFDB 删除对端的FDB条目
+func delPeerFDB(link netlink.Link, peer string) error {
+	if err := netlink.NeighDel(peerFDB(link, peer)); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf(" Error delete fdb entry for peer %s: %v", peer, err)
+	}
+	return nil
+}
+
+// overlayHostRange 获取本机在overlay网段中的地址分区
+// 指定了--ip-range时直接使用，否则按host_id与host_bits把网段均分，本机使用第host_id个分区
+func overlayHostRange(subnet string, cfg *IPAMConfig, options map[string]string) (*net.IPNet, error) {
+	_, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range cfg.IPRanges {
+		if _, ipRange, _ := net.ParseCIDR(r); ipRange != nil && cidr.Contains(ipRange.IP) {
+			return ipRange, nil
+		}
+	}
+	hostID, err := strconv.Atoi(options[hostIDOption])
+	if err != nil || hostID < 0 {
+		return nil, fmt.Errorf(" overlay network requires -o %s=<n> or --ip-range to partition the subnet between hosts", hostIDOption)
+	}
+	hostBits := defaultHostBits
+	if bits, ok := options[hostBitsOption]; ok {
+		if hostBits, err = strconv.Atoi(bits); err != nil || hostBits <= 0 {
+			return nil, fmt.Errorf(" invalid %s: %s", hostBitsOption, bits)
+		}
+	}
+	ones, size := cidr.Mask.Size()
+	// 每个分区至少要留出网关与一个容器地址
+	if ones+hostBits > size-2 {
+		return nil, fmt.Errorf(" subnet %s is too small for %d host bits", cidr, hostBits)
+	}
+	if hostID >= 1<<uint(hostBits) {
+		return nil, fmt.Errorf(" %s %d is out of range for %d host bits", hostIDOption, hostID, hostBits)
+	}
+	offset := new(big.Int).Lsh(big.NewInt(int64(hostID)), uint(size-ones-hostBits))
+	base := new(big.Int).SetBytes(cidr.IP)
+	ip := base.Add(base, offset).Bytes()
+	partition := make(net.IP, len(cidr.IP))
+	copy(partition[len(partition)-len(ip):], ip)
+	return &net.IPNet{IP: partition, Mask: net.CIDRMask(ones+hostBits, size)}, nil
+}
+
+// UpdateOverlayPeers 修改overlay网络的对端并同步VXLAN设备的FDB条目
+// add与remove为要添加与删除的对端地址，reload为true时先重新读取对端列表文件
+func UpdateOverlayPeers(networkName string, add, remove []string, reload bool) error {
+	n, ok := networks[networkName]
+	if !ok {
+		return fmt.Errorf(" No Such Network: %s", networkName)
+	}
+	if n.Driver != overlayDriverName || n.Overlay == nil {
+		return fmt.Errorf(" network %s is not an overlay network", networkName)
+	}
+	cfg := n.Overlay
+	peers := cfg.Peers
+	if reload {
+		if cfg.PeersFile == "" {
+			return fmt.Errorf(" network %s has no peers file", networkName)
+		}
+		var err error
+		if peers, err = readPeersFile(cfg.PeersFile, cfg.Local); err != nil {
+			return err
+		}
+	}
+	desired := make(map[string]bool)
+	for _, peer := range peers {
+		desired[peer] = true
+	}
+	for _, peer := range add {
+		ip := net.ParseIP(peer)
+		if ip.To4() == nil {
+			return fmt.Errorf(" invalid peer address: %s", peer)
+		}
+		desired[ip.String()] = true
+	}
+	for _, peer := range remove {
+		if ip := net.ParseIP(peer); ip != nil {
+			delete(desired, ip.String())
+		}
+	}
+	vxlan, err := netlink.LinkByName(cfg.VxlanName)
+	if err != nil {
+		return fmt.Errorf(" error get vxlan device %s: %v", cfg.VxlanName, err)
+	}
+	for _, peer := range cfg.Peers {
+		if !desired[peer] {
+			if err := delPeerFDB(vxlan, peer); err != nil {
+				return err
+			}
+		}
+	}
+	cfg.Peers = cfg.Peers[:0]
+	for peer := range desired {
+		if err := addPeerFDB(vxlan, peer); err != nil {
+			return err
+		}
+		cfg.Peers = append(cfg.Peers, peer)
+	}
+	sort.Strings(cfg.Peers)
+	return n.dump(defaultNetworkPath)
+}
+
+// ListOverlayPeers 列出overlay网络的对端
+func ListOverlayPeers(networkName string) ([]string, error) {
+	n, ok := networks[networkName]
+	if !ok {
+		return nil, fmt.Errorf(" No Such Network: %s", networkName)
+	}
+	if n.Overlay == nil {
+		return nil, fmt.Errorf(" network %s is not an overlay network", networkName)
+	}
+	return n.Overlay.Peers, nil
+}
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// setTestNetns 将当前线程切换到ns，调用前需要已经调用useTestNetns锁定线程
+func setTestNetns(t *testing.T, ns netns.NsHandle) {
+	if err := netns.Set(ns); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 用两个由veth连接的Net Namespace模拟两台宿主机，分别创建同一个overlay网络
+// 每台宿主机的VXLAN设备都有发往对端的FDB条目，两台宿主机分配地址的分区不重叠
+func TestOverlayCreateTwoHosts(t *testing.T) {
+	useTestNetns(t)
+	hosts := []string{"192.168.100.1", "192.168.100.2"}
+	peersFile := filepath.Join(t.TempDir(), "peers")
+	if err := ioutil.WriteFile(peersFile, []byte("# vteps\n"+hosts[0]+"\n"+hosts[1]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var handles []netns.NsHandle
+	for range hosts {
+		ns, err := netns.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, ns)
+	}
+	t.Cleanup(func() {
+		for _, ns := range handles {
+			ns.Close()
+		}
+	})
+	// 在第一个Net Namespace中创建veth，另一端移入第二个Net Namespace
+	setTestNetns(t, handles[0])
+	la := netlink.NewLinkAttrs()
+	la.Name = "uplink"
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "uplink-peer"}); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := netlink.LinkByName("uplink-peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(handles[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	const subnet = "10.20.0.0/16"
+	var ranges []*net.IPNet
+	for i, local := range hosts {
+		setTestNetns(t, handles[i])
+		name := []string{"uplink", "uplink-peer"}[i]
+		if err := setInterfaceIP(name, local+"/24"); err != nil {
+			t.Fatal(err)
+		}
+		if err := setInterfaceUP(name); err != nil {
+			t.Fatal(err)
+		}
+		options := map[string]string{
+			vniOption:        "100",
+			hostIDOption:     strconv.Itoa(i + 1),
+			vxlanLocalOption: local,
+			peersOption:      peersFile,
+		}
+		hostRange, err := overlayHostRange(subnet, &IPAMConfig{}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = append(ranges, hostRange)
+		d := &OverlayNetworkDriver{}
+		n, err := d.Create(subnet, "", "ov"+strconv.Itoa(i+1), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vxlan, err := netlink.LinkByName(n.Overlay.VxlanName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vxlan.Attrs().MasterIndex == 0 {
+			t.Fatalf("%s is not attached to bridge %s", n.Overlay.VxlanName, n.Name)
+		}
+		remote := hosts[1-i]
+		if len(n.Overlay.Peers) != 1 || n.Overlay.Peers[0] != remote {
+			t.Fatalf("host %d peers = %v, want [%s]", i+1, n.Overlay.Peers, remote)
+		}
+		neighs, err := netlink.NeighList(vxlan.Attrs().Index, syscall.AF_BRIDGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, neigh := range neighs {
+			if neigh.IP.Equal(net.ParseIP(remote)) && neigh.HardwareAddr.String() == "00:00:00:00:00:00" {
+				found = true
+			}
+			if neigh.IP.Equal(net.ParseIP(local)) {
+				t.Fatalf("host %d has fdb entry for its own vtep %s", i+1, local)
+			}
+		}
+		if !found {
+			t.Fatalf("host %d has no fdb entry for peer %s: %v", i+1, remote, neighs)
+		}
+	}
+
+	_, cidr, _ := net.ParseCIDR(subnet)
+	for i, r := range ranges {
+		if !cidr.Contains(r.IP) {
+			t.Fatalf("host %d range %s is outside %s", i+1, r, subnet)
+		}
+	}
+	if ranges[0].Contains(ranges[1].IP) || ranges[1].Contains(ranges[0].IP) {
+		t.Fatalf("host ranges %s and %s overlap", ranges[0], ranges[1])
+	}
+}
+
+// 添加对端的FDB条目失败时删除已经创建的VXLAN设备
+func TestCreateVxlanInterfaceCleanup(t *testing.T) {
+	useTestNetns(t)
+	la := netlink.NewLinkAttrs()
+	la.Name = "vxlbr"
+	if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: la}); err != nil {
+		t.Fatal(err)
+	}
+	n := &Network{
+		Name:    "vxlbr",
+		Options: map[string]string{},
+		// IPv4的VXLAN设备不能使用IPv6的对端
+		Overlay: &OverlayConfig{VNI: 100, VxlanName: "vxltest", Port: defaultVxlanPort, Local: "192.168.100.1", Peers: []string{"fd00::2"}},
+	}
+	if err := createVxlanInterface(n); err == nil {
+		t.Fatal("createVxlanInterface with an IPv6 peer, want error")
+	}
+	if _, err := netlink.LinkByName("vxltest"); err == nil {
+		t.Fatal("vxlan device is left after the error")
+	}
+}
@@ -0,0 +1,413 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"xwj/mydocker/log"
+	"xwj/mydocker/record"
+)
+
+const (
+	ipLocalPortRangeFile  = "/proc/sys/net/ipv4/ip_local_port_range"
+	portMappingLockPath   = "/var/run/mydocker/network/portmapping.lock"
+	defaultPortRangeBegin = 49153 // 读取不到内核的临时端口范围时使用的默认范围
+	defaultPortRangeEnd   = 60999
+)
+
+// PortBinding 一条宿主机端口到容器端口的映射
+type PortBinding struct {
+	HostIP        string `json:"host_ip,omitempty"`   // 绑定的宿主机地址，为空表示宿主机的所有地址
+	HostPort      int    `json:"host_port"`           // 宿主机端口
+	ContainerPort int    `json:"container_port"`      // 容器端口
+	Proto         string `json:"proto"`               // 协议 tcp/udp/sctp
+	ProxyPid      int    `json:"proxy_pid,omitempty"` // 用户态代理进程的pid
+}
+
+// portSpec 解析后的端口映射参数，端口可以是一个范围
+type portSpec struct {
+	hostIP                       string
+	hostBegin, hostEnd           int // 为0表示未指定宿主机端口，需要自动分配
+	containerBegin, containerEnd int
+	proto                        string
+}
+
+// String 格式化为hostIP:hostPort:containerPort/proto的形式
+func (pb PortBinding) String() string {
+	mapping := fmt.Sprintf("%d:%d/%s", pb.HostPort, pb.ContainerPort, pb.Proto)
+	if pb.HostIP == "" {
+		return mapping
+	}
+	if strings.Contains(pb.HostIP, ":") {
+		return fmt.Sprintf("[%s]:%s", pb.HostIP, mapping)
+	}
+	return pb.HostIP + ":" + mapping
+}
+
+// conflictWith 判断两条映射是否会占用宿主机上相同的端口
+func (pb PortBinding) conflictWith(other PortBinding) bool {
+	if pb.Proto != other.Proto || pb.HostPort != other.HostPort {
+		return false
+	}
+	return isAnyAddr(pb.HostIP) || isAnyAddr(other.HostIP) || net.ParseIP(pb.HostIP).Equal(net.ParseIP(other.HostIP))
+}
+
+// isAnyAddr 是否表示绑定宿主机的所有地址
+func isAnyAddr(ip string) bool {
+	return ip == "" || net.ParseIP(ip).IsUnspecified()
+}
+
+// parsePortRange 解析port[-end]格式的端口范围
+func parsePortRange(ports string) (int, int, error) {
+	beginStr, endStr := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		beginStr, endStr = ports[:i], ports[i+1:]
+	}
+	begin, err := strconv.Atoi(beginStr)
+	if err != nil || begin < 1 || begin > 65535 {
+		return 0, 0, fmt.Errorf(" invalid port: %s", ports)
+	}
+	end, err := strconv.Atoi(endStr)
+	if err != nil || end < begin || end > 65535 {
+		return 0, 0, fmt.Errorf(" invalid port range: %s", ports)
+	}
+	return begin, end, nil
+}
+
+// splitProto 拆分端口与协议，未指定协议时默认为tcp
+func splitProto(spec string) (string, string, error) {
+	proto := "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		spec, proto = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+		return spec, proto, nil
+	default:
+		return "", "", fmt.Errorf(" unsupported protocol: %s", proto)
+	}
+}
+
+// parsePortMapping 解析[hostIP:]hostPort[-end]:containerPort[-end][/proto]格式的端口映射
+// 也可以只指定containerPort[-end][/proto]，此时宿主机端口自动分配
+func parsePortMapping(mapping string) (*portSpec, error) {
+	rest, proto, err := splitProto(mapping)
+	if err != nil {
+		return nil, err
+	}
+	spec := &portSpec{proto: proto}
+	// IPv6地址需要用[]括起来
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf(" invalid port mapping: %s", mapping)
+		}
+		spec.hostIP, rest = rest[1:end], rest[end+2:]
+	}
+	parts := strings.Split(rest, ":")
+	switch {
+	case len(parts) == 3 && spec.hostIP == "":
+		spec.hostIP = parts[0]
+		parts = parts[1:]
+	case len(parts) > 2:
+		return nil, fmt.Errorf(" invalid port mapping: %s", mapping)
+	}
+	if spec.hostIP != "" && net.ParseIP(spec.hostIP) == nil {
+		return nil, fmt.Errorf(" invalid host ip in port mapping: %s", mapping)
+	}
+	containerPorts := parts[len(parts)-1]
+	if spec.containerBegin, spec.containerEnd, err = parsePortRange(containerPorts); err != nil {
+		return nil, err
+	}
+	if len(parts) == 2 && parts[0] != "" {
+		if spec.hostBegin, spec.hostEnd, err = parsePortRange(parts[0]); err != nil {
+			return nil, err
+		}
+		// 宿主机端口范围与容器端口范围一一对应，或者容器只有一个端口时从宿主机的端口范围中任选一个
+		hostCount, containerCount := spec.hostEnd-spec.hostBegin, spec.containerEnd-spec.containerBegin
+		if containerCount != 0 && hostCount != containerCount {
+			return nil, fmt.Errorf(" host and container port ranges differ in size: %s", mapping)
+		}
+	}
+	return spec, nil
+}
+
+// parseExpose 解析port[-end][/proto]格式的暴露端口
+func parseExpose(expose string) (*portSpec, error) {
+	ports, proto, err := splitProto(expose)
+	if err != nil {
+		return nil, err
+	}
+	spec := &portSpec{proto: proto}
+	if spec.containerBegin, spec.containerEnd, err = parsePortRange(ports); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// resolvePortBindings 将容器的端口映射参数解析为具体的映射，检查冲突并自动分配宿主机端口
+func resolvePortBindings(endpointID string, netCfg *record.NetworkConfig) ([]PortBinding, error) {
+	var specs []*portSpec
+	for _, pm := range netCfg.PortMapping {
+		spec, err := parsePortMapping(pm)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	// -P 为所有暴露的端口自动分配宿主机端口，镜像与--expose暴露的相同端口只发布一次
+	if netCfg.PublishAll {
+		exposed := make(map[portSpec]bool)
+		for _, expose := range netCfg.Expose {
+			spec, err := parseExpose(expose)
+			if err != nil {
+				return nil, err
+			}
+			if exposed[*spec] {
+				continue
+			}
+			exposed[*spec] = true
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	// 其他容器已经映射的端口
+	used, err := usedPortBindings(endpointID)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []PortBinding
+	for _, spec := range specs {
+		for containerPort := spec.containerBegin; containerPort <= spec.containerEnd; containerPort++ {
+			pb := PortBinding{HostIP: spec.hostIP, ContainerPort: containerPort, Proto: spec.proto}
+			switch {
+			case spec.hostBegin == 0:
+				// 未指定宿主机端口，从临时端口范围中分配
+				begin, end := ephemeralPortRange()
+				if pb.HostPort, err = allocateHostPort(pb, begin, end, used); err != nil {
+					return nil, err
+				}
+			case spec.containerBegin == spec.containerEnd && spec.hostBegin != spec.hostEnd:
+				// 从指定的宿主机端口范围中选择一个
+				if pb.HostPort, err = allocateHostPort(pb, spec.hostBegin, spec.hostEnd, used); err != nil {
+					return nil, err
+				}
+			default:
+				pb.HostPort = spec.hostBegin + containerPort - spec.containerBegin
+				for _, u := range used {
+					if pb.conflictWith(u) {
+						return nil, fmt.Errorf(" port is already allocated: %s", pb)
+					}
+				}
+				// 指定的宿主机端口也可能被宿主机上的其他进程占用
+				if !hostPortFree(pb) {
+					return nil, fmt.Errorf(" port is already in use on the host: %s", pb)
+				}
+			}
+			used = append(used, pb)
+			bindings = append(bindings, pb)
+		}
+	}
+	return bindings, nil
+}
+
+// lockPortMapping 对端口映射加文件锁，返回解锁函数
+// 从分配宿主机端口到保存网络端点之间持有，保证多个myDocker进程不会分配出相同的端口
+func lockPortMapping() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(portMappingLockPath), 0644); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(portMappingLockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// usedPortBindings 读取其他网络端点已经映射的宿主机端口
+func usedPortBindings(endpointID string) ([]PortBinding, error) {
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return nil, err
+	}
+	var used []PortBinding
+	for _, ep := range endpoints {
+		if ep.ID == endpointID {
+			continue
+		}
+		used = append(used, ep.PortBindings...)
+	}
+	return used, nil
+}
+
+// ephemeralPortRange 获取内核的临时端口范围
+func ephemeralPortRange() (int, int) {
+	content, err := ioutil.ReadFile(ipLocalPortRangeFile)
+	if err != nil {
+		return defaultPortRangeBegin, defaultPortRangeEnd
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return defaultPortRangeBegin, defaultPortRangeEnd
+	}
+	begin, err1 := strconv.Atoi(fields[0])
+	end, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || begin > end {
+		return defaultPortRangeBegin, defaultPortRangeEnd
+	}
+	return begin, end
+}
+
+// allocateHostPort 在端口范围内分配一个既没有被其他容器映射、也没有被宿主机进程占用的端口
+func allocateHostPort(pb PortBinding, begin, end int, used []PortBinding) (int, error) {
+	for port := begin; port <= end; port++ {
+		pb.HostPort = port
+		conflict := false
+		for _, u := range used {
+			if pb.conflictWith(u) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict && hostPortFree(pb) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf(" no available %s port in range %d-%d", pb.Proto, begin, end)
+}
+
+// hostPortFree 尝试监听端口来判断宿主机上是否有进程占用，sctp无法通过标准库检查
+func hostPortFree(pb PortBinding) bool {
+	addr := net.JoinHostPort(pb.HostIP, strconv.Itoa(pb.HostPort))
+	switch pb.Proto {
+	case "tcp":
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return false
+		}
+		l.Close()
+	case "udp":
+		l, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		l.Close()
+	}
+	return true
+}
+
+// formatPortBindings 将端口映射格式化为字符串记录在容器信息中
+func formatPortBindings(bindings []PortBinding) []string {
+	var mappings []string
+	for _, pb := range bindings {
+		mappings = append(mappings, pb.String())
+	}
+	return mappings
+}
+
+// configPortMapping 配置端口映射
+// 网络创建时没有防火墙后端(只能使用用户态代理)或者容器要求时使用用户态代理转发，否则通过防火墙的DNAT规则实现
+func configPortMapping(ep *Endpoint, userlandProxy bool) error {
+	if len(ep.PortBindings) == 0 {
+		return nil
+	}
+	if ep.Network.ProxyOnly {
+		userlandProxy = true
+	}
+	var fw Firewall
+	if !userlandProxy {
+		var err error
+		if fw, err = getFirewall(); err != nil {
+			return err
+		}
+		if err := fw.Setup(); err != nil {
+			return err
+		}
+	}
+	// 中途失败时删除已经为前面的端口映射添加的规则与代理进程
+	rollback := func(i int, added []net.IP, err error) error {
+		done := *ep
+		done.PortBindings = ep.PortBindings[:i]
+		if rmErr := removePortMapping(&done); rmErr != nil {
+			log.Log.Warnf("remove port mapping of endpoint %s: %v", ep.ID, rmErr)
+		}
+		for _, ip := range added {
+			if rmErr := fw.DelDNAT(ep.Network, ip, ep.PortBindings[i]); rmErr != nil {
+				log.Log.Warnf("remove port mapping of endpoint %s: %v", ep.ID, rmErr)
+			}
+		}
+		return err
+	}
+	// 遍历容器端口映射列表
+	for i := range ep.PortBindings {
+		pb := &ep.PortBindings[i]
+		if userlandProxy {
+			pid, err := startUserlandProxy(*pb, ep.IpAddress)
+			if err != nil {
+				return rollback(i, nil, err)
+			}
+			pb.ProxyPid = pid
+			continue
+		}
+		var added []net.IP
+		for _, ip := range dnatAddresses(ep, *pb) {
+			if err := fw.AddDNAT(ep.Network, ip, *pb); err != nil {
+				return rollback(i, added, err)
+			}
+			added = append(added, ip)
+		}
+	}
+	return nil
+}
+
+// removePortMapping 删除端口映射的防火墙规则或者结束用户态代理进程
+func removePortMapping(ep *Endpoint) error {
+	var firstErr error
+	for _, pb := range ep.PortBindings {
+		if pb.ProxyPid > 0 {
+			stopUserlandProxy(pb)
+			continue
+		}
+		fw, err := getFirewall()
+		if err != nil {
+			continue
+		}
+		for _, ip := range dnatAddresses(ep, pb) {
+			if err := fw.DelDNAT(ep.Network, ip, pb); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// dnatAddresses 端口映射需要DNAT到的容器地址
+// 双栈的容器同时映射IPv4与IPv6地址，指定了宿主机地址时只映射同一协议族的容器地址
+func dnatAddresses(ep *Endpoint, pb PortBinding) []net.IP {
+	var addrs []net.IP
+	hostIP := net.ParseIP(pb.HostIP)
+	for _, ip := range []net.IP{ep.IpAddress, ep.IpAddress6} {
+		if ip == nil {
+			continue
+		}
+		if !isAnyAddr(pb.HostIP) && hostIP != nil && (hostIP.To4() == nil) != (ip.To4() == nil) {
+			continue
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
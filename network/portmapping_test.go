@@ -0,0 +1,109 @@
+package network
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"xwj/mydocker/record"
+)
+
+// 指定的宿主机端口被宿主机进程占用时拒绝，-P时镜像与--expose暴露的相同端口只发布一次
+func TestResolvePortBindings(t *testing.T) {
+	old := defaultEndpointPath
+	defaultEndpointPath = t.TempDir() + "/"
+	t.Cleanup(func() { defaultEndpointPath = old })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	_, err = resolvePortBindings("test", &record.NetworkConfig{PortMapping: []string{"127.0.0.1:" + port + ":80"}})
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("mapping host port %s in use: %v, want error", port, err)
+	}
+
+	bindings, err := resolvePortBindings("test", &record.NetworkConfig{
+		PublishAll: true,
+		Expose:     []string{"80/tcp", "53/udp", "80"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 2 || bindings[0].ContainerPort != 80 || bindings[1].ContainerPort != 53 || bindings[1].Proto != "udp" {
+		t.Fatalf("publish all bindings = %v, want 80/tcp and 53/udp", bindings)
+	}
+	if bindings[0].HostPort == 0 || bindings[1].HostPort == 0 {
+		t.Fatalf("publish all bindings = %v, want allocated host ports", bindings)
+	}
+}
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    portSpec
+		err     bool
+	}{
+		{mapping: "8080:80", want: portSpec{hostBegin: 8080, hostEnd: 8080, containerBegin: 80, containerEnd: 80, proto: "tcp"}},
+		{mapping: "80", want: portSpec{containerBegin: 80, containerEnd: 80, proto: "tcp"}},
+		{mapping: ":80/UDP", want: portSpec{containerBegin: 80, containerEnd: 80, proto: "udp"}},
+		{mapping: "127.0.0.1:53:53/udp", want: portSpec{hostIP: "127.0.0.1", hostBegin: 53, hostEnd: 53, containerBegin: 53, containerEnd: 53, proto: "udp"}},
+		{mapping: "127.0.0.1::80", want: portSpec{hostIP: "127.0.0.1", containerBegin: 80, containerEnd: 80, proto: "tcp"}},
+		{mapping: "[::1]:8080:80/sctp", want: portSpec{hostIP: "::1", hostBegin: 8080, hostEnd: 8080, containerBegin: 80, containerEnd: 80, proto: "sctp"}},
+		{mapping: "8000-8002:80-82", want: portSpec{hostBegin: 8000, hostEnd: 8002, containerBegin: 80, containerEnd: 82, proto: "tcp"}},
+		// 容器只有一个端口时从宿主机端口范围中选择
+		{mapping: "8000-8010:80", want: portSpec{hostBegin: 8000, hostEnd: 8010, containerBegin: 80, containerEnd: 80, proto: "tcp"}},
+		{mapping: "8000-8001:80-82", err: true},
+		{mapping: "80-70", err: true},
+		{mapping: "0:80", err: true},
+		{mapping: "8080:65536", err: true},
+		{mapping: "8080:80/icmp", err: true},
+		{mapping: "localhost:8080:80", err: true},
+		{mapping: "::1:8080:80", err: true},
+		{mapping: "[::1:8080:80", err: true},
+		{mapping: "1.2.3.4:1:2:3", err: true},
+	}
+	for _, tt := range tests {
+		spec, err := parsePortMapping(tt.mapping)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parsePortMapping(%q) = %+v, want error", tt.mapping, *spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortMapping(%q): %v", tt.mapping, err)
+			continue
+		}
+		if *spec != tt.want {
+			t.Errorf("parsePortMapping(%q) = %+v, want %+v", tt.mapping, *spec, tt.want)
+		}
+	}
+}
+
+func TestPortBindingConflict(t *testing.T) {
+	tests := []struct {
+		a, b     PortBinding
+		conflict bool
+	}{
+		{PortBinding{HostPort: 80, Proto: "tcp"}, PortBinding{HostPort: 80, Proto: "tcp"}, true},
+		{PortBinding{HostPort: 80, Proto: "tcp"}, PortBinding{HostPort: 80, Proto: "udp"}, false},
+		{PortBinding{HostPort: 80, Proto: "tcp"}, PortBinding{HostPort: 81, Proto: "tcp"}, false},
+		// 绑定所有地址与绑定某个地址冲突
+		{PortBinding{HostPort: 80, Proto: "tcp"}, PortBinding{HostIP: "127.0.0.1", HostPort: 80, Proto: "tcp"}, true},
+		{PortBinding{HostIP: "0.0.0.0", HostPort: 80, Proto: "tcp"}, PortBinding{HostIP: "10.0.0.1", HostPort: 80, Proto: "tcp"}, true},
+		{PortBinding{HostIP: "::", HostPort: 80, Proto: "tcp"}, PortBinding{HostIP: "::1", HostPort: 80, Proto: "tcp"}, true},
+		{PortBinding{HostIP: "127.0.0.1", HostPort: 80, Proto: "tcp"}, PortBinding{HostIP: "10.0.0.1", HostPort: 80, Proto: "tcp"}, false},
+		{PortBinding{HostIP: "::1", HostPort: 80, Proto: "tcp"}, PortBinding{HostIP: "0:0::1", HostPort: 80, Proto: "tcp"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.a.conflictWith(tt.b); got != tt.conflict {
+			t.Errorf("%v conflictWith %v = %v, want %v", tt.a, tt.b, got, tt.conflict)
+		}
+		if got := tt.b.conflictWith(tt.a); got != tt.conflict {
+			t.Errorf("%v conflictWith %v = %v, want %v", tt.b, tt.a, got, tt.conflict)
+		}
+	}
+}
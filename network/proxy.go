@@ -0,0 +1,194 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"xwj/mydocker/log"
+)
+
+const (
+	udpProxyIdleTimeout = 90 * time.Second // udp转发连接的空闲超时时间
+	udpProxyBufferSize  = 65507
+	proxyReadyMessage   = "ok"
+)
+
+// startUserlandProxy 启动一个独立的用户态代理进程负责一条端口映射的转发，返回代理进程的pid
+// 代理进程就是再次调用自己的proxy子命令，通过管道告知父进程是否已经开始监听
+func startUserlandProxy(pb PortBinding, containerIP net.IP) (int, error) {
+	if pb.Proto != "tcp" && pb.Proto != "udp" {
+		return 0, fmt.Errorf(" userland proxy does not support %s", pb.Proto)
+	}
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readPipe.Close()
+	hostIP := pb.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	cmd := exec.Command("/proc/self/exe", "proxy",
+		"--proto", pb.Proto,
+		"--host-ip", hostIP,
+		"--host-port", strconv.Itoa(pb.HostPort),
+		"--container-ip", containerIP.String(),
+		"--container-port", strconv.Itoa(pb.ContainerPort),
+	)
+	// 代理进程脱离当前会话，容器后台运行时不随myDocker命令一起退出
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{writePipe}
+	if err := cmd.Start(); err != nil {
+		writePipe.Close()
+		return 0, err
+	}
+	writePipe.Close()
+	// 等待代理进程开始监听
+	msg, err := ioutil.ReadAll(readPipe)
+	if err != nil {
+		return 0, err
+	}
+	if string(msg) != proxyReadyMessage {
+		_ = cmd.Wait()
+		return 0, fmt.Errorf(" start userland proxy for %s error: %s", pb, msg)
+	}
+	pid := cmd.Process.Pid
+	// 不等待代理进程结束
+	_ = cmd.Process.Release()
+	return pid, nil
+}
+
+// stopUserlandProxy 结束端口映射的代理进程
+func stopUserlandProxy(pb PortBinding) {
+	if pb.ProxyPid <= 0 {
+		return
+	}
+	if err := syscall.Kill(pb.ProxyPid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		log.Log.Warnf("stop userland proxy %d error: %v", pb.ProxyPid, err)
+	}
+}
+
+// RunUserlandProxy 在代理进程中运行，监听宿主机端口并将流量转发到容器
+// 监听结果通过文件描述符3告知父进程
+func RunUserlandProxy(proto, hostIP string, hostPort int, containerIP string, containerPort int) error {
+	readyPipe := os.NewFile(uintptr(3), "ready")
+	hostAddr := net.JoinHostPort(hostIP, strconv.Itoa(hostPort))
+	backendAddr := net.JoinHostPort(containerIP, strconv.Itoa(containerPort))
+	var serve func() error
+	switch proto {
+	case "tcp":
+		l, err := net.Listen("tcp", hostAddr)
+		if err != nil {
+			fmt.Fprint(readyPipe, err)
+			readyPipe.Close()
+			return err
+		}
+		serve = func() error { return proxyTCP(l, backendAddr) }
+	case "udp":
+		conn, err := net.ListenPacket("udp", hostAddr)
+		if err != nil {
+			fmt.Fprint(readyPipe, err)
+			readyPipe.Close()
+			return err
+		}
+		serve = func() error { return proxyUDP(conn.(*net.UDPConn), backendAddr) }
+	default:
+		err := fmt.Errorf(" unsupported protocol: %s", proto)
+		fmt.Fprint(readyPipe, err)
+		readyPipe.Close()
+		return err
+	}
+	fmt.Fprint(readyPipe, proxyReadyMessage)
+	readyPipe.Close()
+	return serve()
+}
+
+// proxyTCP 为每一个客户端连接建立到容器的连接并双向拷贝数据
+func proxyTCP(l net.Listener, backendAddr string) error {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func(client net.Conn) {
+			defer client.Close()
+			backend, err := net.Dial("tcp", backendAddr)
+			if err != nil {
+				log.Log.Errorf("userland proxy dial %s error: %v", backendAddr, err)
+				return
+			}
+			defer backend.Close()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			pipe := func(dst, src net.Conn) {
+				defer wg.Done()
+				_, _ = io.Copy(dst, src)
+				// 一个方向结束后关闭写端，让另一端读到EOF
+				if tcpConn, ok := dst.(*net.TCPConn); ok {
+					_ = tcpConn.CloseWrite()
+				}
+			}
+			go pipe(backend, client)
+			go pipe(client, backend)
+			wg.Wait()
+		}(client)
+	}
+}
+
+// proxyUDP 为每一个客户端地址维护一个到容器的udp连接，空闲超时后关闭
+func proxyUDP(listener *net.UDPConn, backendAddr string) error {
+	backend, err := net.ResolveUDPAddr("udp", backendAddr)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	conns := map[string]*net.UDPConn{}
+	buf := make([]byte, udpProxyBufferSize)
+	for {
+		n, clientAddr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		key := clientAddr.String()
+		mu.Lock()
+		conn, ok := conns[key]
+		if !ok {
+			conn, err = net.DialUDP("udp", nil, backend)
+			if err != nil {
+				mu.Unlock()
+				log.Log.Errorf("userland proxy dial %s error: %v", backendAddr, err)
+				continue
+			}
+			conns[key] = conn
+			// 将容器的回包转发回客户端
+			go func(conn *net.UDPConn, clientAddr *net.UDPAddr) {
+				replyBuf := make([]byte, udpProxyBufferSize)
+				for {
+					_ = conn.SetReadDeadline(time.Now().Add(udpProxyIdleTimeout))
+					n, err := conn.Read(replyBuf)
+					if err != nil {
+						break
+					}
+					if _, err := listener.WriteToUDP(replyBuf[:n], clientAddr); err != nil {
+						break
+					}
+				}
+				mu.Lock()
+				delete(conns, clientAddr.String())
+				mu.Unlock()
+				conn.Close()
+			}(conn, clientAddr)
+		}
+		mu.Unlock()
+		if _, err := conn.Write(buf[:n]); err != nil {
+			log.Log.Errorf("userland proxy write %s error: %v", backendAddr, err)
+		}
+	}
+}
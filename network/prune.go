@@ -0,0 +1,38 @@
+package network
+
+import "sort"
+
+// PruneNetworks 删除没有运行中的容器连接的网络，keep中的网络被容器记录引用，不删除
+// 容器已经不存在的网络端点先被清理，返回删除的网络名，调用前需要先调用Init
+func PruneNetworks(keep map[string]bool) ([]string, error) {
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, ep := range endpoints {
+		if containerAlive(ep.ContainerID) {
+			used[networkNameOfEndpoint(ep)] = true
+			continue
+		}
+		if err := releaseStaleEndpoint(ep); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for name := range networks {
+		if !used[name] && !keep[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var removed []string
+	for _, name := range names {
+		if err := DeleteNetwork(name); err != nil {
+			return removed, err
+		}
+		delete(networks, name)
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"xwj/mydocker/log"
+	"xwj/mydocker/record"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	bootIDPath          = "/proc/sys/kernel/random/boot_id"
+	containerInfoFormat = "/var/run/mydocker/%s/containerInfo.json" // 容器信息文件，与container包中的位置一致
+)
+
+// reconciledBootPath 上一次完成网络恢复时的boot_id
+var reconciledBootPath = "/var/run/mydocker/network/boot_id"
+
+// Reconcile 根据保存的网络与网络端点恢复宿主机上的网络状态
+// 1. 重新创建缺失的网桥与VXLAN设备
+// 2. 清理容器已经不存在的网络端点，释放它们占用的地址
+// 3. 让IPAM中的分配信息与网关、保留地址以及仍然存在的网络端点保持一致
+// 4. 重新生成防火墙规则
+func Reconcile() error {
+	var firstErr error
+	collect := func(err error) {
+		if err != nil {
+			log.Log.Warn(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for _, n := range networks {
+		collect(restoreNetworkDevices(n))
+	}
+	endpoints, err := loadEndpoints(defaultEndpointPath)
+	if err != nil {
+		return err
+	}
+	var alive []*Endpoint
+	for _, ep := range endpoints {
+		if containerAlive(ep.ContainerID) {
+			alive = append(alive, ep)
+			continue
+		}
+		collect(releaseStaleEndpoint(ep))
+	}
+	for _, n := range networks {
+		collect(syncAddressPools(n, alive))
+	}
+	if err := ReconcileFirewall(); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// restoreNetworkDevices 重新创建网络在宿主机上缺失的设备
+func restoreNetworkDevices(n *Network) error {
+	switch n.Driver {
+	case bridgeDriverName, overlayDriverName:
+		if _, err := netlink.LinkByName(n.Name); err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); !ok {
+				return err
+			}
+			log.Log.Infof("restore bridge of network %s", n.Name)
+			bridge := &BridgeNetworkDriver{}
+			if err := bridge.initBridge(n); err != nil {
+				return fmt.Errorf(" restore network %s: %v", n.Name, err)
+			}
+		}
+		if n.Driver == overlayDriverName && n.Overlay != nil {
+			if _, err := netlink.LinkByName(n.Overlay.VxlanName); err != nil {
+				log.Log.Infof("restore vxlan device of network %s", n.Name)
+				if err := createVxlanInterface(n); err != nil {
+					return fmt.Errorf(" restore network %s: %v", n.Name, err)
+				}
+			}
+		}
+	case macvlanDriverName, ipvlanDriverName:
+		// 这类网络在宿主机上只依赖父接口
+		if _, err := netlink.LinkByName(n.Options[parentOption]); err != nil {
+			return fmt.Errorf(" parent interface %s of network %s is missing", n.Options[parentOption], n.Name)
+		}
+	}
+	return nil
+}
+
+// releaseStaleEndpoint 清理容器已经不存在的网络端点
+func releaseStaleEndpoint(ep *Endpoint) error {
+	log.Log.Infof("release endpoint %s of removed container", ep.ID)
+	n, ok := networks[networkNameOfEndpoint(ep)]
+	if !ok {
+		// 网络已经删除，地址分配信息也随之删除了
+		return ep.remove(defaultEndpointPath)
+	}
+	ep.Network = n
+	// 代理进程的pid可能已经被其他进程复用，只停止确实是代理的进程
+	for i := range ep.PortBindings {
+		if ep.PortBindings[i].ProxyPid > 0 && !isUserlandProxy(ep.PortBindings[i].ProxyPid) {
+			ep.PortBindings[i].ProxyPid = 0
+		}
+	}
+	return disconnectEndpoint(n, ep, true)
+}
+
+// networkNameOfEndpoint 网络端点所属的网络名，网络端点ID的格式是"容器ID-网络名"
+func networkNameOfEndpoint(ep *Endpoint) string {
+	if ep.Network != nil && ep.Network.Name != "" {
+		return ep.Network.Name
+	}
+	return strings.TrimPrefix(ep.ID, ep.ContainerID+"-")
+}
+
+// syncAddressPools 让网络的地址分配信息只包含网关、保留地址与仍然存在的网络端点的地址
+func syncAddressPools(n *Network, endpoints []*Endpoint) error {
+	if n.Driver == cniDriverName {
+		return nil
+	}
+	inUse := []net.IP{n.IpRange.IP}
+	if n.IpRange6 != nil {
+		inUse = append(inUse, n.IpRange6.IP)
+	}
+	if n.IPAM != nil {
+		for _, aux := range n.IPAM.AuxAddress {
+			if ip := net.ParseIP(aux); ip != nil {
+				inUse = append(inUse, ip)
+			}
+		}
+	}
+	for _, ep := range endpoints {
+		if networkNameOfEndpoint(ep) != n.Name {
+			continue
+		}
+		for _, ip := range []net.IP{ep.IpAddress, ep.IpAddress6} {
+			if ip != nil {
+				inUse = append(inUse, ip)
+			}
+		}
+	}
+	subnets := []*net.IPNet{n.poolSubnet()}
+	if n.IpRange6 != nil {
+		subnets = append(subnets, n.IpRange6)
+	}
+	for _, subnet := range subnets {
+		_, cidr, _ := net.ParseCIDR(subnet.String())
+		released, err := ipAllocator.SyncPool(cidr, poolRange(cidr, n.IPAM), inUse)
+		if err != nil {
+			return err
+		}
+		if len(released) > 0 {
+			log.Log.Infof("release addresses %v of network %s", released, n.Name)
+		}
+	}
+	return nil
+}
+
+// containerAlive 判断容器是否仍在运行
+// 容器的信息文件存在且状态为running，进程存在并且拥有自己的Net Namespace(排除重启后pid被其他进程复用的情况)
+func containerAlive(containerID string) bool {
+	content, err := ioutil.ReadFile(fmt.Sprintf(containerInfoFormat, containerID))
+	if err != nil {
+		return false
+	}
+	var cinfo record.ContainerInfo
+	if err := json.Unmarshal(content, &cinfo); err != nil {
+		return false
+	}
+	if cinfo.Status != "running" {
+		return false
+	}
+	pid := strings.TrimSpace(cinfo.Pid)
+	if pid == "" {
+		return false
+	}
+	var containerNs, hostNs syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%s/ns/net", pid), &containerNs); err != nil {
+		return false
+	}
+	if err := syscall.Stat("/proc/self/ns/net", &hostNs); err != nil {
+		return true
+	}
+	return containerNs.Ino != hostNs.Ino
+}
+
+// isUserlandProxy 判断进程是否是myDocker的端口映射代理进程
+func isUserlandProxy(pid int) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := bytes.Split(cmdline, []byte{0})
+	return len(args) > 1 && string(args[1]) == "proxy"
+}
+
+// reconcileOnBoot 宿主机重启后第一次加载网络时自动恢复网络状态
+// 通过比较内核的boot_id与上一次恢复时记录的boot_id判断是否重启过
+func reconcileOnBoot() {
+	bootID, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return
+	}
+	last, err := ioutil.ReadFile(reconciledBootPath)
+	if err == nil && bytes.Equal(last, bootID) {
+		return
+	}
+	if len(networks) > 0 {
+		log.Log.Infof("host rebooted, reconcile container networks")
+		if err := Reconcile(); err != nil {
+			log.Log.Warnf("reconcile networks error: %v", err)
+			return
+		}
+	}
+	dir, _ := path.Split(reconciledBootPath)
+	if err := os.MkdirAll(dir, 0644); err != nil {
+		log.Log.Warn(err)
+		return
+	}
+	if err := ioutil.WriteFile(reconciledBootPath, bootID, 0644); err != nil {
+		log.Log.Warn(err)
+	}
+}
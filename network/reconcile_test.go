@@ -0,0 +1,82 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestState 让网络、网络端点、地址分配与boot_id记录都使用临时的状态
+func useTestState(t *testing.T, nws map[string]*Network) {
+	dir := t.TempDir()
+	oldEndpointPath, oldBootPath, oldNetworks, oldAllocator := defaultEndpointPath, reconciledBootPath, networks, ipAllocator
+	defaultEndpointPath = dir + "/endpoint/"
+	reconciledBootPath = filepath.Join(dir, "boot_id")
+	networks = nws
+	ipAllocator = newTestIPAM(t)
+	t.Cleanup(func() {
+		defaultEndpointPath, reconciledBootPath, networks, ipAllocator = oldEndpointPath, oldBootPath, oldNetworks, oldAllocator
+	})
+}
+
+// 只在boot_id与上一次恢复时记录的不同时恢复网络，恢复成功后才记录新的boot_id
+func TestReconcileOnBoot(t *testing.T) {
+	useTestNetns(t)
+	bootID, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		t.Skip(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.30.0.0/24")
+	newNetworks := func(parent string) map[string]*Network {
+		return map[string]*Network{"mvnet": {
+			Name:    "mvnet",
+			Driver:  macvlanDriverName,
+			IpRange: &net.IPNet{IP: net.ParseIP("10.30.0.1").To4(), Mask: subnet.Mask},
+			Options: map[string]string{parentOption: parent},
+		}}
+	}
+	// 恢复时地址分配信息会按照网关重新同步
+	reconciled := func() bool {
+		if err := ipAllocator.load(); err != nil {
+			t.Fatal(err)
+		}
+		pool, ok := ipAllocator.Subnets[subnet.String()]
+		return ok && pool.allocated["10.30.0.1"]
+	}
+	tests := []struct {
+		name       string
+		networks   map[string]*Network
+		lastBoot   string // 为空表示没有记录
+		reconciled bool
+		wantBoot   string
+	}{
+		{name: "first boot without networks", networks: map[string]*Network{}, wantBoot: string(bootID)},
+		{name: "same boot", networks: newNetworks("lo"), lastBoot: string(bootID), wantBoot: string(bootID)},
+		{name: "rebooted", networks: newNetworks("lo"), lastBoot: "old-boot-id\n", reconciled: true, wantBoot: string(bootID)},
+		// 恢复失败时不记录boot_id，下次加载网络时重试
+		{name: "reconcile fails", networks: newNetworks("tmissing"), lastBoot: "old-boot-id\n", reconciled: true, wantBoot: "old-boot-id\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestState(t, tt.networks)
+			if tt.lastBoot != "" {
+				if err := ioutil.WriteFile(reconciledBootPath, []byte(tt.lastBoot), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reconcileOnBoot()
+			if got := reconciled(); got != tt.reconciled {
+				t.Errorf("reconciled = %v, want %v", got, tt.reconciled)
+			}
+			got, err := ioutil.ReadFile(reconciledBootPath)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantBoot {
+				t.Errorf("recorded boot_id = %q, want %q", got, tt.wantBoot)
+			}
+		})
+	}
+}
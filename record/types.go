@@ -6,7 +6,22 @@ type ContainerInfo struct {
 	Name        string `json:"name"`
 	Command     string `json:"command"`
 	Volume      string `json:"volume"`
+	Image       string `json:"image"`    // 运行时指定的镜像
+	ImageID     string `json:"image_id"` // 镜像ID
 	CreatedTime string `json:"created_time"`
 	Status      string `json:"status"`
-	PortMapping []string `json:"port_mapping"` //端口映射
+	NetworkConfig
+}
+
+// NetworkConfig 容器运行时指定的网络配置
+type NetworkConfig struct {
+	Network       string   `json:"network"`            // 连接的网络名
+	PortMapping   []string `json:"port_mapping"`       //端口映射
+	PublishAll    bool     `json:"publish_all"`        // 为所有暴露的端口自动分配宿主机端口
+	Expose        []string `json:"expose"`             // 暴露的容器端口
+	UserlandProxy bool     `json:"userland_proxy"`     // 使用用户态代理而不是防火墙规则实现端口映射
+	IP            string   `json:"ip,omitempty"`       // 静态指定的容器IP地址
+	MacAddress    string   `json:"mac,omitempty"`      // 静态指定的容器MAC地址
+	RateOut       string   `json:"rate_out,omitempty"` // 容器发出流量的速率上限
+	RateIn        string   `json:"rate_in,omitempty"`  // 容器收到流量的速率上限
 }
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"os"
+	"path/filepath"
+	"syscall"
 	"xwj/mydocker/log"
 )
 
@@ -17,3 +19,41 @@ func DirOrFileExist(path string) (bool, error) {
 		return false, err
 	}
 }
+
+// DirSize 目录中所有普通文件的大小之和，硬链接只统计一次，不跨越挂载点
+func DirSize(dir string) int64 {
+	var size int64
+	var rootDev uint64
+	if info, err := os.Lstat(dir); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			rootDev = uint64(stat.Dev)
+		}
+	}
+	type inode struct{ dev, ino uint64 }
+	seen := make(map[inode]bool)
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && uint64(stat.Dev) != rootDev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if ok && stat.Nlink > 1 {
+			key := inode{uint64(stat.Dev), stat.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks 解析路径时最多跟随的符号链接数，避免链接成环
+const maxSymlinks = 255
+
+// SecureJoin 将unsafePath拼接到root下，路径中的符号链接都在root内解析
+// 绝对路径的链接目标以root为根，..最多回到root，因此返回的路径一定在root内，相当于在chroot(root)中解析路径
+// 路径中不存在的部分当作普通目录处理
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	resolved := "/"         // 已经解析的部分，相对于root
+	remaining := unsafePath // 还没有解析的部分
+	links := 0
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			part, remaining = remaining, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// 最多回到root
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// 不存在的部分当作普通目录继续逐个解析，之后的..可能回到已经存在的目录，其中的符号链接仍然需要解析
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf(" too many symlinks in %s", unsafePath)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		// 绝对路径的链接从root开始解析，相对路径从链接所在的目录开始解析
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
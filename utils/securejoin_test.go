@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	mustSymlink := func(target, name string) {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink("/etc", "b")
+	mustSymlink("nonexist/../b", "a")
+	mustSymlink("../../../..", "up")
+	mustSymlink("/", "abs")
+	mustSymlink("loop2", "loop1")
+	mustSymlink("loop1", "loop2")
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/etc/passwd", "/etc/passwd"},
+		{"/b/passwd", "/etc/passwd"},
+		// 不存在的部分之后的..回到存在的符号链接，符号链接仍然在root内解析
+		{"/a/passwd", "/etc/passwd"},
+		{"/nonexist/../b/passwd", "/etc/passwd"},
+		{"/nonexist/x/../../b/passwd", "/etc/passwd"},
+		{"/up/etc/passwd", "/etc/passwd"},
+		{"/abs/../../etc", "/etc"},
+		{"../../x", "/x"},
+		{"/new/dir/file", "/new/dir/file"},
+	}
+	for _, tt := range tests {
+		got, err := SecureJoin(root, tt.path)
+		if err != nil {
+			t.Errorf("SecureJoin(%q) error: %v", tt.path, err)
+			continue
+		}
+		if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("SecureJoin(%q) = %q, want %q", tt.path, got, want)
+		}
+	}
+	if _, err := SecureJoin(root, "/loop1/x"); err == nil {
+		t.Errorf("SecureJoin with a symlink loop should fail")
+	}
+}